@@ -25,8 +25,8 @@ func TestRootContext_OnTick(t *testing.T) {
 	for i := 1; i < 10; i++ {
 		host.Tick() // call OnTick
 		attrs := host.GetCalloutAttributesFromContext(proxytest.RootContextID)
-		require.Equal(t, len(attrs), i)                            // verify DispatchHttpCall is called
-		host.PutCalloutResponse(attrs[0].CalloutID, nil, nil, nil) // receive callout response
+		require.Equal(t, len(attrs), i)                              // verify DispatchHttpCall is called
+		host.PutCalloutResponse(attrs[i-1].CalloutID, nil, nil, nil) // receive callout response
 
 		logs := host.GetLogs(types.LogLevelInfo)
 		require.Greater(t, len(logs), 0)
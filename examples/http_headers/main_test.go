@@ -49,3 +49,19 @@ func TestHttpHeaders_OnHttpResponseHeaders(t *testing.T) {
 	assert.Equal(t, "response header <-- key2: value2", logs[len(logs)-2])
 	assert.Equal(t, "response header <-- key1: value1", logs[len(logs)-3])
 }
+
+func TestHttpHeaders_Allocations(t *testing.T) {
+	opt := proxytest.NewEmulatorOption().
+		WithNewHttpContext(newContext).
+		WithAllocationMeasurement()
+	host := proxytest.NewHostEmulator(opt)
+	defer host.Done()
+	id := host.HttpFilterInitContext()
+
+	hs := [][2]string{{"key1", "value1"}, {"key2", "value2"}}
+	stats := host.MeasureAllocations(func() {
+		host.HttpFilterPutRequestHeaders(id, hs)
+	})
+	// the numbers depend on the Go version, so only logged here rather than asserted against a budget
+	t.Logf("%.1f allocs, %.1f bytes per request", stats.Allocs, stats.Bytes)
+}
@@ -39,7 +39,12 @@ func newRootContext(uint32) proxywasm.RootContext {
 
 // override
 func (ctx *metricRootContext) OnVMStart(vmConfigurationSize int) bool {
-	counter = proxywasm.DefineCounterMetric(metricsName)
+	var err error
+	counter, err = proxywasm.DefineCounterMetric(metricsName)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to define metric %s: %v", metricsName, err)
+		return false
+	}
 	return true
 }
 
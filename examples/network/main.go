@@ -39,7 +39,12 @@ func newRootContext(contextID uint32) proxywasm.RootContext {
 }
 
 func (ctx *rootContext) OnVMStart(vmConfigurationSize int) bool {
-	counter = proxywasm.DefineCounterMetric(connectionCounterName)
+	var err error
+	counter, err = proxywasm.DefineCounterMetric(connectionCounterName)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to define metric %s: %v", connectionCounterName, err)
+		return false
+	}
 	return true
 }
 
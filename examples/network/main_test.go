@@ -78,6 +78,7 @@ func TestNetwork_OnUpstreamData(t *testing.T) {
 	host := proxytest.NewHostEmulator(opt)
 	defer host.Done() // release the host emulation lock so that other test cases can insert their own host emulation
 
+	host.SetProperty([]string{"upstream", "address"}, []byte("127.0.0.1:8099"))
 	contextID := host.NetworkFilterInitConnection() // OnNewConnection is called
 
 	msg := "this is upstream data"
@@ -86,6 +87,7 @@ func TestNetwork_OnUpstreamData(t *testing.T) {
 
 	logs := host.GetLogs(types.LogLevelInfo) // retrieve logs emitted to Envoy
 	assert.Equal(t, "<<<<<< upstream data received <<<<<<\n"+msg, logs[len(logs)-1])
+	assert.Equal(t, "remote address: 127.0.0.1:8099", logs[len(logs)-2])
 }
 
 func TestNetwork_counter(t *testing.T) {
@@ -0,0 +1,144 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxytest
+
+import (
+	"log"
+	"runtime"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// allocationMeasurementRuns is the number of runs averaged by MeasureAllocations.
+const allocationMeasurementRuns = 100
+
+// AllocationStats is the average allocations made by the plugin per run.
+type AllocationStats struct {
+	Allocs float64
+	Bytes  float64
+}
+
+// allocMeter accumulates the allocations made in the callbacks of http contexts
+// excluding the ones made by the host emulator in the host calls.
+type allocMeter struct {
+	// enabled is true if the http contexts are wrapped by measuredHttpContext
+	enabled        bool
+	active         bool
+	inCallback     bool
+	allocs, bytes  int64
+	memStatsBuffer runtime.MemStats
+}
+
+func (m *allocMeter) read() (allocs, bytes int64) {
+	runtime.ReadMemStats(&m.memStatsBuffer)
+	return int64(m.memStatsBuffer.Mallocs), int64(m.memStatsBuffer.TotalAlloc)
+}
+
+// callback measures the allocations made in the given callback of the plugin.
+func (m *allocMeter) callback(f func()) {
+	if !m.active || m.inCallback {
+		f()
+		return
+	}
+
+	m.inCallback = true
+	allocs, bytes := m.read()
+	f()
+	afterAllocs, afterBytes := m.read()
+	m.inCallback = false
+	m.allocs += afterAllocs - allocs
+	m.bytes += afterBytes - bytes
+}
+
+// hostCall returns the function to be called at the end of a host call,
+// which excludes the allocations made by the host emulator from the measurement.
+func (m *allocMeter) hostCall() func() {
+	if !m.active || !m.inCallback {
+		return func() {}
+	}
+
+	allocs, bytes := m.read()
+	return func() {
+		afterAllocs, afterBytes := m.read()
+		m.allocs -= afterAllocs - allocs
+		m.bytes -= afterBytes - bytes
+	}
+}
+
+// impl HostEmulator
+func (h *hostEmulator) MeasureAllocations(f func()) AllocationStats {
+	if !h.meter.enabled {
+		log.Fatalf("MeasureAllocations requires the emulator created with WithAllocationMeasurement")
+	}
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	// warm up
+	f()
+
+	h.meter = allocMeter{enabled: true, active: true}
+	defer func() { h.meter.active = false }()
+	for i := 0; i < allocationMeasurementRuns; i++ {
+		f()
+	}
+	return AllocationStats{
+		Allocs: float64(h.meter.allocs) / allocationMeasurementRuns,
+		Bytes:  float64(h.meter.bytes) / allocationMeasurementRuns,
+	}
+}
+
+// measuredHttpContext measures the allocations made in the callbacks of the plugin's http context.
+type measuredHttpContext struct {
+	proxywasm.HttpContext
+	meter *allocMeter
+}
+
+func (ctx *measuredHttpContext) OnHttpRequestHeaders(numHeaders int, endOfStream bool) (action types.Action) {
+	ctx.meter.callback(func() { action = ctx.HttpContext.OnHttpRequestHeaders(numHeaders, endOfStream) })
+	return
+}
+
+func (ctx *measuredHttpContext) OnHttpRequestBody(bodySize int, endOfStream bool) (action types.Action) {
+	ctx.meter.callback(func() { action = ctx.HttpContext.OnHttpRequestBody(bodySize, endOfStream) })
+	return
+}
+
+func (ctx *measuredHttpContext) OnHttpRequestTrailers(numTrailers int) (action types.Action) {
+	ctx.meter.callback(func() { action = ctx.HttpContext.OnHttpRequestTrailers(numTrailers) })
+	return
+}
+
+func (ctx *measuredHttpContext) OnHttpResponseHeaders(numHeaders int, endOfStream bool) (action types.Action) {
+	ctx.meter.callback(func() { action = ctx.HttpContext.OnHttpResponseHeaders(numHeaders, endOfStream) })
+	return
+}
+
+func (ctx *measuredHttpContext) OnHttpResponseBody(bodySize int, endOfStream bool) (action types.Action) {
+	ctx.meter.callback(func() { action = ctx.HttpContext.OnHttpResponseBody(bodySize, endOfStream) })
+	return
+}
+
+func (ctx *measuredHttpContext) OnHttpResponseTrailers(numTrailers int) (action types.Action) {
+	ctx.meter.callback(func() { action = ctx.HttpContext.OnHttpResponseTrailers(numTrailers) })
+	return
+}
+
+func (ctx *measuredHttpContext) OnHttpStreamDone() {
+	ctx.meter.callback(ctx.HttpContext.OnHttpStreamDone)
+}
+
+func (ctx *measuredHttpContext) OnLog() {
+	ctx.meter.callback(ctx.HttpContext.OnLog)
+}
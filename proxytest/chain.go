@@ -0,0 +1,204 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxytest
+
+import (
+	"strconv"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// FilterChain emulates multiple plugins configured in sequence on the same filter chain.
+//
+// Since the SDK keeps the VM state in globals, host emulators created by NewHostEmulator cannot coexist.
+// Therefore Chain takes the options of the plugins rather than host emulators, creates the host emulator
+// of each plugin, and switches the VM state to the plugin being driven. The emulators are available via Host
+// for assertions, but must not be driven directly. Done must be called at the end instead of HostEmulator.Done.
+type FilterChain struct {
+	hosts []*hostEmulator
+	// ids is the context id of the current http stream in each plugin, or nil before the first stream
+	ids []uint32
+}
+
+// HttpChainResult is the headers and the body of a request or a response as output by the plugins of a FilterChain.
+type HttpChainResult struct {
+	Headers [][2]string
+	Body    []byte
+
+	// StoppedAt is the index of the plugin which paused the iteration or sent a local response,
+	// or -1 if all the plugins continued.
+	StoppedAt int
+	// LocalResponse is the local response sent by the plugin at StoppedAt, or nil. A local response sent
+	// in the request path is the one output by the response path of the preceding plugins.
+	LocalResponse *LocalHttpResponse
+}
+
+// Chain starts the VMs and the plugins of the given options, which are in the order of the filter chain.
+// Each plugin keeps a single http stream across PutRequest and PutResponse as Envoy does,
+// so the state of an http context in the request path is visible in the response path.
+func Chain(opts ...*EmulatorOption) *FilterChain {
+	hostMux.Lock() // acquire the lock of host emulation for all the plugins
+	c := &FilterChain{}
+	for _, opt := range opts {
+		host := newHostEmulator(opt)
+		host.StartVM()
+		host.StartPlugin()
+		c.hosts = append(c.hosts, host)
+	}
+	return c
+}
+
+// Host returns the host emulator of the i-th plugin, e.g. to read its logs and metrics.
+func (c *FilterChain) Host(i int) HostEmulator {
+	return c.hosts[i]
+}
+
+// ContextID returns the context id of the current http stream in the i-th plugin, which is valid on Host(i).
+func (c *FilterChain) ContextID(i int) uint32 {
+	return c.ids[i]
+}
+
+// Done completes the current http stream and releases the host emulation.
+func (c *FilterChain) Done() {
+	defer hostMux.Unlock()
+	defer proxywasm.VMStateReset()
+	c.completeStream()
+}
+
+// PutRequest starts a new http stream in all the plugins, completing the previous one, and passes
+// the request through the plugins in the configured order. The body is delivered as a single chunk
+// with end_of_stream if it is not nil. A local response sent by a plugin is passed back through
+// the response path of the preceding plugins as Envoy does.
+func (c *FilterChain) PutRequest(headers [][2]string, body []byte) *HttpChainResult {
+	c.completeStream()
+	c.startStream()
+
+	ret := &HttpChainResult{Headers: headers, Body: body, StoppedAt: -1}
+	for i := range c.hosts {
+		if !c.put(i, ret, false) {
+			ret.StoppedAt = i
+			break
+		}
+	}
+
+	if ret.LocalResponse != nil {
+		ret.LocalResponse = c.replyLocally(ret.StoppedAt, ret.LocalResponse)
+	}
+	return ret
+}
+
+// PutResponse passes the response through the plugins in the reverse order as Envoy does,
+// on the http stream started by the last PutRequest. The body is delivered as a single chunk
+// with end_of_stream if it is not nil.
+func (c *FilterChain) PutResponse(headers [][2]string, body []byte) *HttpChainResult {
+	if c.ids == nil {
+		c.startStream()
+	}
+
+	ret := &HttpChainResult{Headers: headers, Body: body, StoppedAt: -1}
+	for i := len(c.hosts) - 1; i >= 0; i-- {
+		if !c.put(i, ret, true) {
+			ret.StoppedAt = i
+			break
+		}
+	}
+	return ret
+}
+
+func (c *FilterChain) startStream() {
+	for _, host := range c.hosts {
+		host.activate()
+		c.ids = append(c.ids, host.HttpFilterInitContext())
+	}
+}
+
+func (c *FilterChain) completeStream() {
+	for i, id := range c.ids {
+		c.hosts[i].activate()
+		c.hosts[i].HttpFilterCompleteHttpStream(id)
+	}
+	c.ids = nil
+}
+
+// replyLocally passes the local response sent by the i-th plugin through the response path of the plugins before it.
+func (c *FilterChain) replyLocally(i int, local *LocalHttpResponse) *LocalHttpResponse {
+	res := &HttpChainResult{
+		Headers: append([][2]string{{":status", strconv.Itoa(int(local.StatusCode))}}, local.Headers...),
+	}
+	if len(local.Data) != 0 {
+		res.Body = local.Data
+	}
+
+	for j := i - 1; j >= 0; j-- {
+		if !c.put(j, res, true) {
+			break
+		}
+	}
+
+	ret := *local
+	ret.Headers, ret.Data = nil, res.Body
+	for _, h := range res.Headers {
+		if h[0] != ":status" {
+			ret.Headers = append(ret.Headers, h)
+		} else if code, err := strconv.Atoi(h[1]); err == nil {
+			ret.StatusCode = uint32(code)
+		}
+	}
+	return &ret
+}
+
+func (c *FilterChain) put(i int, res *HttpChainResult, response bool) (continued bool) {
+	host, id := c.hosts[i], c.ids[i]
+	host.activate()
+
+	if response {
+		host.HttpFilterPutResponseHeadersEndOfStream(id, res.Headers, res.Body == nil)
+	} else {
+		host.HttpFilterPutRequestHeadersEndOfStream(id, res.Headers, res.Body == nil)
+	}
+	continued = c.collect(host, id, res, response, false)
+
+	// pausing on headers followed by a body means buffering the body, which Envoy still delivers
+	if res.Body == nil || res.LocalResponse != nil {
+		return
+	}
+
+	if response {
+		host.HttpFilterPutResponseBodyEndOfStream(id, res.Body, true)
+	} else {
+		host.HttpFilterPutRequestBodyEndOfStream(id, res.Body, true)
+	}
+	return c.collect(host, id, res, response, true)
+}
+
+func (c *FilterChain) collect(host HostEmulator, id uint32, res *HttpChainResult, response, body bool) (continued bool) {
+	// headers are read after the body as well since they can be modified while the body is buffered
+	switch {
+	case response && body:
+		res.Headers = host.HttpFilterGetResponseHeaders(id)
+		res.Body = host.HttpFilterGetResponseBody(id)
+	case response:
+		res.Headers = host.HttpFilterGetResponseHeaders(id)
+	case body:
+		res.Headers = host.HttpFilterGetRequestHeaders(id)
+		res.Body = host.HttpFilterGetRequestBody(id)
+	default:
+		res.Headers = host.HttpFilterGetRequestHeaders(id)
+	}
+
+	res.LocalResponse = host.HttpFilterGetSentLocalResponse(id)
+	return res.LocalResponse == nil && host.HttpFilterGetCurrentStreamAction(id) == types.ActionContinue
+}
@@ -0,0 +1,155 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxytest
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+type authenticationContext struct {
+	proxywasm.DefaultHttpContext
+	user string
+}
+
+func (ctx *authenticationContext) OnHttpRequestHeaders(int, bool) types.Action {
+	if _, err := proxywasm.GetHttpRequestHeader("authorization"); err == nil {
+		ctx.user = "alice"
+		_ = proxywasm.AddHttpRequestHeader("x-user", ctx.user)
+	}
+	return types.ActionContinue
+}
+
+func (ctx *authenticationContext) OnHttpResponseHeaders(int, bool) types.Action {
+	// kept in the http context since the request path
+	if ctx.user != "" {
+		_ = proxywasm.AddHttpResponseHeader("x-authenticated-user", ctx.user)
+	}
+	_ = proxywasm.AddHttpResponseHeader("x-authn", "done")
+	return types.ActionContinue
+}
+
+type authorizationContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *authorizationContext) OnHttpRequestHeaders(int, bool) types.Action {
+	if user, err := proxywasm.GetHttpRequestHeader("x-user"); err != nil || user != "alice" {
+		proxywasm.SendHttpResponse(403, nil, "forbidden")
+		return types.ActionPause
+	}
+	return types.ActionContinue
+}
+
+// bodySizeContext buffers the request body to add its size to the request headers.
+type bodySizeContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *bodySizeContext) OnHttpRequestHeaders(_ int, endOfStream bool) types.Action {
+	if endOfStream {
+		return types.ActionContinue
+	}
+	return types.ActionPause
+}
+
+func (ctx *bodySizeContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.Action {
+	if !endOfStream {
+		return types.ActionPause
+	}
+	_ = proxywasm.AddHttpRequestHeader("x-body-size", strconv.Itoa(bodySize))
+	return types.ActionContinue
+}
+
+type bodySizeCheckingContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *bodySizeCheckingContext) OnHttpRequestHeaders(int, bool) types.Action {
+	if _, err := proxywasm.GetHttpRequestHeader("x-body-size"); err != nil {
+		proxywasm.SendHttpResponse(411, nil, "length required")
+		return types.ActionPause
+	}
+	return types.ActionContinue
+}
+
+func TestFilterChain(t *testing.T) {
+	authn := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &authenticationContext{} })
+	authz := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &authorizationContext{} })
+
+	t.Run("authorized", func(t *testing.T) {
+		chain := Chain(authn, authz)
+		defer chain.Done()
+
+		res := chain.PutRequest([][2]string{{"authorization", "token"}}, nil)
+		assert.Equal(t, -1, res.StoppedAt)
+		assert.Nil(t, res.LocalResponse)
+		assert.Equal(t, [][2]string{{"authorization", "token"}, {"x-user", "alice"}}, res.Headers)
+
+		res = chain.PutResponse([][2]string{{":status", "200"}}, []byte("ok"))
+		assert.Equal(t, -1, res.StoppedAt)
+		assert.Equal(t, [][2]string{{":status", "200"},
+			{"x-authenticated-user", "alice"}, {"x-authn", "done"}}, res.Headers)
+		assert.Equal(t, []byte("ok"), res.Body)
+	})
+
+	t.Run("unauthenticated", func(t *testing.T) {
+		chain := Chain(authn, authz)
+		defer chain.Done()
+
+		res := chain.PutRequest(nil, nil)
+		assert.Equal(t, 1, res.StoppedAt)
+		require.NotNil(t, res.LocalResponse)
+		assert.Equal(t, uint32(403), res.LocalResponse.StatusCode)
+		// passed back through the response path of the authn plugin
+		assert.Equal(t, [][2]string{{"x-authn", "done"}}, res.LocalResponse.Headers)
+		assert.Equal(t, []byte("forbidden"), res.LocalResponse.Data)
+	})
+
+	t.Run("wrong order", func(t *testing.T) {
+		chain := Chain(authz, authn)
+		defer chain.Done()
+
+		res := chain.PutRequest([][2]string{{"authorization", "token"}}, nil)
+		assert.Equal(t, 0, res.StoppedAt)
+		require.NotNil(t, res.LocalResponse)
+		assert.Nil(t, res.LocalResponse.Headers)
+		assert.Equal(t, 0, chain.Host(1).HttpFilterGetStreamDoneCount(chain.ContextID(1)))
+	})
+}
+
+func TestFilterChain_BufferedBody(t *testing.T) {
+	chain := Chain(
+		NewEmulatorOption().
+			WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &bodySizeContext{} }),
+		NewEmulatorOption().
+			WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &bodySizeCheckingContext{} }),
+	)
+	defer chain.Done()
+
+	// the first plugin pauses on the headers to buffer the body, which does not stop the chain
+	res := chain.PutRequest([][2]string{{":method", "POST"}}, []byte("hello"))
+	assert.Equal(t, -1, res.StoppedAt)
+	assert.Equal(t, [][2]string{{":method", "POST"}, {"x-body-size", "5"}}, res.Headers)
+	assert.Equal(t, []byte("hello"), res.Body)
+
+	// without a body the headers are let through, then rejected by the second plugin
+	res = chain.PutRequest([][2]string{{":method", "GET"}}, nil)
+	assert.Equal(t, 1, res.StoppedAt)
+	require.NotNil(t, res.LocalResponse)
+	assert.Equal(t, uint32(411), res.LocalResponse.StatusCode)
+}
@@ -0,0 +1,195 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxytest
+
+import (
+	"log"
+	"time"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+type (
+	// GrpcCalloutAttribute is the unary gRPC call dispatched by proxywasm.DispatchGrpcCall.
+	GrpcCalloutAttribute struct {
+		CalloutID                     uint32
+		Upstream, ServiceName, Method string
+		InitialMetadata               [][2]string
+		Message                       []byte
+		Timeout                       time.Duration
+	}
+
+	// GrpcStreamAttribute is the gRPC stream opened by proxywasm.OpenGrpcStream.
+	GrpcStreamAttribute struct {
+		StreamID                      uint32
+		Upstream, ServiceName, Method string
+		InitialMetadata               [][2]string
+		// Messages are the messages sent by the plugin in order.
+		Messages [][]byte
+		// LocalClosed is set once the plugin half-closes the stream,
+		// and RemoteClosed is set once the stream is closed by PutGrpcStreamClose.
+		LocalClosed, RemoteClosed bool
+	}
+)
+
+// impl rawhostcall.ProxyWASMHost
+func (r *rootHostEmulator) ProxyGrpcCall(upstreamData *byte, upstreamSize int, serviceNameData *byte, serviceNameSize int,
+	methodData *byte, methodSize int, initialMetadataData *byte, initialMetadataSize int,
+	messageData *byte, messageSize int, timeout uint32, calloutIDPtr *uint32) types.Status {
+	upstream := proxywasm.RawBytePtrToString(upstreamData, upstreamSize)
+	serviceName := proxywasm.RawBytePtrToString(serviceNameData, serviceNameSize)
+	method := proxywasm.RawBytePtrToString(methodData, methodSize)
+	log.Printf("[grpc callout to %s] %s/%s timeout: %d", upstream, serviceName, method, timeout)
+
+	calloutID := r.nextCalloutID
+	r.nextCalloutID++
+	contextID := proxywasm.VMStateGetActiveContextID()
+	r.grpcCalloutIDToContextID[calloutID] = contextID
+	r.grpcContextIDToCalloutInfos[contextID] = append(r.grpcContextIDToCalloutInfos[contextID], GrpcCalloutAttribute{
+		CalloutID:       calloutID,
+		Upstream:        upstream,
+		ServiceName:     serviceName,
+		Method:          method,
+		InitialMetadata: proxywasm.DeserializeMap(proxywasm.RawBytePtrToByteSlice(initialMetadataData, initialMetadataSize)),
+		Message:         append([]byte{}, proxywasm.RawBytePtrToByteSlice(messageData, messageSize)...),
+		Timeout:         time.Duration(timeout) * time.Millisecond,
+	})
+
+	*calloutIDPtr = calloutID
+	return types.StatusOK
+}
+
+// impl rawhostcall.ProxyWASMHost
+func (r *rootHostEmulator) ProxyGrpcCancel(calloutID uint32) types.Status {
+	if _, ok := r.grpcCalloutIDToContextID[calloutID]; !ok {
+		log.Printf("grpc callout %d is not pending", calloutID)
+		return types.StatusNotFound
+	}
+	delete(r.grpcCalloutIDToContextID, calloutID)
+	return types.StatusOK
+}
+
+// impl rawhostcall.ProxyWASMHost
+func (r *rootHostEmulator) ProxyGrpcStream(upstreamData *byte, upstreamSize int, serviceNameData *byte, serviceNameSize int,
+	methodData *byte, methodSize int, initialMetadataData *byte, initialMetadataSize int, streamIDPtr *uint32) types.Status {
+	streamID := r.nextCalloutID
+	r.nextCalloutID++
+	stream := &GrpcStreamAttribute{
+		StreamID:        streamID,
+		Upstream:        proxywasm.RawBytePtrToString(upstreamData, upstreamSize),
+		ServiceName:     proxywasm.RawBytePtrToString(serviceNameData, serviceNameSize),
+		Method:          proxywasm.RawBytePtrToString(methodData, methodSize),
+		InitialMetadata: proxywasm.DeserializeMap(proxywasm.RawBytePtrToByteSlice(initialMetadataData, initialMetadataSize)),
+	}
+	log.Printf("[grpc stream to %s] %s/%s", stream.Upstream, stream.ServiceName, stream.Method)
+
+	contextID := proxywasm.VMStateGetActiveContextID()
+	r.grpcStreams[streamID] = stream
+	r.grpcContextIDToStreams[contextID] = append(r.grpcContextIDToStreams[contextID], stream)
+	*streamIDPtr = streamID
+	return types.StatusOK
+}
+
+// impl rawhostcall.ProxyWASMHost
+func (r *rootHostEmulator) ProxyGrpcSend(streamID uint32, messageData *byte, messageSize int, endOfStream bool) types.Status {
+	stream, ok := r.grpcStreams[streamID]
+	if !ok {
+		log.Printf("grpc stream %d is not found", streamID)
+		return types.StatusNotFound
+	} else if stream.LocalClosed || stream.RemoteClosed {
+		log.Printf("grpc stream %d is already closed", streamID)
+		return types.StatusBadArgument
+	}
+
+	stream.Messages = append(stream.Messages, append([]byte{}, proxywasm.RawBytePtrToByteSlice(messageData, messageSize)...))
+	stream.LocalClosed = endOfStream
+	return types.StatusOK
+}
+
+// impl rawhostcall.ProxyWASMHost
+func (r *rootHostEmulator) ProxyGrpcClose(streamID uint32) types.Status {
+	stream, ok := r.grpcStreams[streamID]
+	if !ok {
+		log.Printf("grpc stream %d is not found", streamID)
+		return types.StatusNotFound
+	}
+	stream.LocalClosed = true
+	return types.StatusOK
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetGrpcCalloutAttributesFromContext(contextID uint32) []GrpcCalloutAttribute {
+	return r.grpcContextIDToCalloutInfos[contextID]
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) PutGrpcCallResponse(calloutID uint32, status types.GrpcStatus, message []byte) {
+	if _, ok := r.grpcCalloutIDToContextID[calloutID]; !ok {
+		// either the call has not been dispatched yet, its response has already been delivered or it has been cancelled
+		log.Printf("grpc call response rejected as callout %d is not pending", calloutID)
+		return
+	}
+	delete(r.grpcCalloutIDToContextID, calloutID)
+
+	// failed calls are closed without the response as Envoy does
+	if status != types.GrpcStatusOK {
+		proxywasm.ProxyOnGrpcClose(RootContextID, calloutID, uint32(status))
+		return
+	}
+	r.deliverGrpcMessage(calloutID, message)
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetGrpcStreamAttributesFromContext(contextID uint32) []GrpcStreamAttribute {
+	streams := r.grpcContextIDToStreams[contextID]
+	if streams == nil {
+		return nil
+	}
+
+	ret := make([]GrpcStreamAttribute, len(streams))
+	for i, s := range streams {
+		ret[i] = *s
+		ret[i].Messages = append([][]byte{}, s.Messages...)
+	}
+	return ret
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) PutGrpcStreamMessage(streamID uint32, message []byte) {
+	stream, ok := r.grpcStreams[streamID]
+	if !ok || stream.RemoteClosed {
+		log.Printf("grpc stream message rejected as stream %d is not open", streamID)
+		return
+	}
+	r.deliverGrpcMessage(streamID, message)
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) PutGrpcStreamClose(streamID uint32, status types.GrpcStatus) {
+	stream, ok := r.grpcStreams[streamID]
+	if !ok || stream.RemoteClosed {
+		log.Printf("grpc stream close rejected as stream %d is not open", streamID)
+		return
+	}
+	stream.RemoteClosed = true
+	proxywasm.ProxyOnGrpcClose(RootContextID, streamID, uint32(status))
+}
+
+func (r *rootHostEmulator) deliverGrpcMessage(id uint32, message []byte) {
+	r.grpcReceiveBuffer, r.inBufferCallback = message, true
+	defer func() { r.grpcReceiveBuffer, r.inBufferCallback = nil, false }()
+	proxywasm.ProxyOnGrpcReceive(RootContextID, id, len(message))
+}
@@ -0,0 +1,231 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxytest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// extAuthzContext authorizes requests by the unary gRPC call, as the ext_authz filter does.
+type extAuthzContext struct {
+	proxywasm.DefaultHttpContext
+	calloutID uint32
+	pending   bool
+}
+
+func (ctx *extAuthzContext) OnHttpRequestHeaders(int, bool) types.Action {
+	user, _ := proxywasm.GetHttpRequestHeader("x-user")
+	id, err := proxywasm.DispatchGrpcCall("authz", "envoy.service.auth.v3.Authorization", "Check",
+		[][2]string{{"x-request-id", "1"}}, []byte(user), 500, ctx.onResponse)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to dispatch grpc call: %v", err)
+		return types.ActionContinue
+	}
+	ctx.calloutID, ctx.pending = id, true
+	return types.ActionPause
+}
+
+func (ctx *extAuthzContext) onResponse(status types.GrpcStatus, messageSize int) {
+	ctx.pending = false
+	if status != types.GrpcStatusOK {
+		proxywasm.LogWarnf("authz failed: %s", status)
+		proxywasm.SendHttpResponse(503, nil, "authz unavailable")
+		return
+	}
+
+	message, err := proxywasm.GetGrpcReceiveBuffer(0, messageSize)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get grpc response: %v", err)
+		return
+	}
+	if string(message) != "allow" {
+		proxywasm.SendHttpResponse(403, nil, "denied")
+		return
+	}
+	if err := proxywasm.ResumeHttpRequest(); err != nil {
+		proxywasm.LogCriticalf("failed to resume request: %v", err)
+	}
+}
+
+func (ctx *extAuthzContext) OnHttpStreamDone() {
+	if !ctx.pending {
+		return
+	}
+	if err := proxywasm.CancelGrpcCall(ctx.calloutID); err != nil {
+		proxywasm.LogCriticalf("failed to cancel grpc call: %v", err)
+	}
+}
+
+func TestRootHostEmulator_GrpcCall(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		status  types.GrpcStatus
+		message string
+		exp     uint32 // zero means resumed
+	}{
+		{name: "allowed", status: types.GrpcStatusOK, message: "allow"},
+		{name: "denied", status: types.GrpcStatusOK, message: "deny", exp: 403},
+		{name: "unavailable", status: types.GrpcStatusUnavailable, exp: 503},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			opt := NewEmulatorOption().
+				WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &extAuthzContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutRequestHeaders(id, [][2]string{{"x-user", "alice"}})
+			assert.Equal(t, types.ActionPause, host.HttpFilterGetCurrentStreamAction(id))
+
+			attrs := host.GetGrpcCalloutAttributesFromContext(id)
+			require.Len(t, attrs, 1)
+			assert.Equal(t, "authz", attrs[0].Upstream)
+			assert.Equal(t, "envoy.service.auth.v3.Authorization", attrs[0].ServiceName)
+			assert.Equal(t, "Check", attrs[0].Method)
+			assert.Equal(t, [][2]string{{"x-request-id", "1"}}, attrs[0].InitialMetadata)
+			assert.Equal(t, []byte("alice"), attrs[0].Message)
+			assert.Equal(t, 500*time.Millisecond, attrs[0].Timeout)
+
+			host.PutGrpcCallResponse(attrs[0].CalloutID, c.status, []byte(c.message))
+			require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+			if c.exp == 0 {
+				assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+				assert.Nil(t, host.HttpFilterGetSentLocalResponse(id))
+			} else {
+				res := host.HttpFilterGetSentLocalResponse(id)
+				require.NotNil(t, res)
+				assert.Equal(t, c.exp, res.StatusCode)
+			}
+			if c.status != types.GrpcStatusOK {
+				assert.Equal(t, []string{"authz failed: Unavailable"}, host.GetLogs(types.LogLevelWarn))
+			}
+		})
+	}
+
+	t.Run("cancelled", func(t *testing.T) {
+		opt := NewEmulatorOption().
+			WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &extAuthzContext{} })
+		host := NewHostEmulator(opt)
+		defer host.Done()
+
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestHeaders(id, nil)
+		attrs := host.GetGrpcCalloutAttributesFromContext(id)
+		require.Len(t, attrs, 1)
+
+		// the callback is never called after the call is cancelled
+		host.HttpFilterCompleteHttpStream(id)
+		host.PutGrpcCallResponse(attrs[0].CalloutID, types.GrpcStatusOK, []byte("allow"))
+		require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+		assert.Nil(t, host.HttpFilterGetSentLocalResponse(id))
+		assert.Equal(t, []string{"ProxyGrpcCall", "ProxyGrpcCancel"}, filterGrpcCalls(host.GetHostCalls()))
+	})
+}
+
+func filterGrpcCalls(calls []string) (ret []string) {
+	for _, call := range calls {
+		if len(call) > len("ProxyGrpc") && call[:len("ProxyGrpc")] == "ProxyGrpc" {
+			ret = append(ret, call)
+		}
+	}
+	return
+}
+
+// watchingRootContext watches the configuration pushed by the server over the gRPC stream.
+type watchingRootContext struct {
+	proxywasm.DefaultRootContext
+	streamID uint32
+}
+
+func (ctx *watchingRootContext) OnPluginStart(int) bool {
+	id, err := proxywasm.OpenGrpcStream("config_server", "config.Watcher", "Watch", nil,
+		func(messageSize int) {
+			message, err := proxywasm.GetGrpcReceiveBuffer(0, messageSize)
+			if err != nil {
+				proxywasm.LogCriticalf("failed to get grpc message: %v", err)
+				return
+			}
+			proxywasm.LogInfof("config: %s", message)
+		},
+		func(status types.GrpcStatus) {
+			proxywasm.LogInfof("closed: %s", status)
+		})
+	if err != nil {
+		proxywasm.LogCriticalf("failed to open grpc stream: %v", err)
+		return false
+	}
+	ctx.streamID = id
+	if err := proxywasm.SetTickPeriodMilliSeconds(1000); err != nil {
+		proxywasm.LogCriticalf("failed to set tick period: %v", err)
+		return false
+	}
+	return proxywasm.SendGrpcStreamMessage(id, []byte("subscribe"), false) == nil
+}
+
+func (ctx *watchingRootContext) OnTick() {
+	if err := proxywasm.SendGrpcStreamMessage(ctx.streamID, []byte("unsubscribe"), true); err != nil {
+		proxywasm.LogCriticalf("failed to send grpc message: %v", err)
+	}
+}
+
+func TestRootHostEmulator_GrpcStream(t *testing.T) {
+	root := &watchingRootContext{}
+	opt := NewEmulatorOption().
+		WithNewRootContext(func(uint32) proxywasm.RootContext { return root })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	host.StartPlugin()
+	require.True(t, host.IsPluginStarted())
+	streams := host.GetGrpcStreamAttributesFromContext(RootContextID)
+	require.Len(t, streams, 1)
+	assert.Equal(t, GrpcStreamAttribute{
+		StreamID:        root.streamID,
+		Upstream:        "config_server",
+		ServiceName:     "config.Watcher",
+		Method:          "Watch",
+		InitialMetadata: [][2]string{},
+		Messages:        [][]byte{[]byte("subscribe")},
+	}, streams[0])
+
+	host.PutGrpcStreamMessage(root.streamID, []byte("v1"))
+	host.PutGrpcStreamMessage(root.streamID, []byte("v2"))
+	// an empty message is read as empty
+	host.PutGrpcStreamMessage(root.streamID, nil)
+	assert.Equal(t, []string{"config: v1", "config: v2", "config: "}, host.GetLogs(types.LogLevelInfo))
+
+	// the remote keeps sending messages after the plugin half-closes the stream
+	host.Tick()
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	streams = host.GetGrpcStreamAttributesFromContext(RootContextID)
+	assert.True(t, streams[0].LocalClosed)
+	assert.Equal(t, [][]byte{[]byte("subscribe"), []byte("unsubscribe")}, streams[0].Messages)
+	assert.Error(t, proxywasm.SendGrpcStreamMessage(root.streamID, []byte("again"), false))
+	host.PutGrpcStreamMessage(root.streamID, []byte("v3"))
+
+	host.PutGrpcStreamClose(root.streamID, types.GrpcStatusUnavailable)
+	host.PutGrpcStreamMessage(root.streamID, []byte("v4"))
+	assert.Equal(t, []string{"config: v1", "config: v2", "config: ", "config: v3", "closed: Unavailable"},
+		host.GetLogs(types.LogLevelInfo))
+	assert.True(t, host.GetGrpcStreamAttributesFromContext(RootContextID)[0].RemoteClosed)
+}
@@ -16,6 +16,8 @@ package proxytest
 
 import (
 	"log"
+	"strconv"
+	"strings"
 
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
@@ -23,14 +25,43 @@ import (
 
 type (
 	httpHostEmulator struct {
-		httpStreams map[uint32]*httpStreamState
+		httpStreams         map[uint32]*httpStreamState
+		headerNormalization HeaderNormalization
+
+		strictMode      bool
+		bodyBufferLimit int
+
+		authorityRoutes map[string]string // key: authority, value: route name
+
+		lifecycles contextLifecycles
 	}
 	httpStreamState struct {
 		requestHeaders, responseHeaders,
 		requestTrailers, responseTrailers [][2]string
 		requestBody, responseBody []byte
 
+		// requestSnapshot records the request given by test code so that it can be replayed
+		requestSnapshot RequestSnapshot
+
+		// originalResponseHeaders holds the response headers given by test code before modified by the plugin
+		originalResponseHeaders [][2]string
+
+		// requestBodyBuffered and responseBodyBuffered are true while the plugin keeps pausing on body chunks,
+		// in which case the following chunks are appended to the buffered body as Envoy does.
+		requestBodyBuffered, responseBodyBuffered               bool
+		forwardedRequestBodyChunks, forwardedResponseBodyChunks [][]byte
+
+		// requestResumed and responseResumed are set when the plugin calls proxy_continue_stream
+		// during a callback, which takes effect after the callback returns.
+		requestResumed, responseResumed bool
+		// inBodyCallback is true while OnHttpRequestBody or OnHttpResponseBody is running.
+		// Otherwise, e.g. in the callout callbacks, the buffered body is forwarded as soon as the stream is resumed.
+		inBodyCallback bool
+		// phase is the phase whose callback is running, or empty out of the http callbacks.
+		phase HttpPhase
+
 		action            types.Action
+		actions           []PhaseAction
 		sentLocalResponse *LocalHttpResponse
 	}
 	LocalHttpResponse struct {
@@ -40,13 +71,104 @@ type (
 		Headers          [][2]string
 		GRPCStatus       int32
 	}
+
+	// RequestSnapshot is the request as given by test code, which can be replayed by ReplayRequest.
+	RequestSnapshot struct {
+		Headers  [][2]string
+		Body     []byte
+		Trailers [][2]string
+	}
+
+	// ReplayResult is the output of the plugin on a replayed request.
+	ReplayResult struct {
+		// Headers, Body and Trailers are the request forwarded to the upstream.
+		Headers  [][2]string
+		Body     []byte
+		Trailers [][2]string
+
+		Action        types.Action
+		LocalResponse *LocalHttpResponse
+		// Actions is the actions returned by the plugin in each phase.
+		Actions []PhaseAction
+	}
+
+	// HttpResponse is the upstream response driven by HttpFilterSendResponse.
+	HttpResponse struct {
+		Headers [][2]string
+		// BodyChunks is given to OnHttpResponseBody one by one.
+		BodyChunks [][]byte
+		Trailers   [][2]string
+	}
+
+	// ResponseResult is the output of the plugin on the response driven by HttpFilterSendResponse.
+	ResponseResult struct {
+		// Headers, Body and Trailers are the response forwarded to the downstream.
+		Headers  [][2]string
+		Body     []byte
+		Trailers [][2]string
+
+		Action        types.Action
+		LocalResponse *LocalHttpResponse
+		// Actions is the actions returned by the plugin in each phase of the stream.
+		Actions []PhaseAction
+	}
+
+	// PhaseAction is the action returned by the plugin in the phase of an http stream.
+	PhaseAction struct {
+		Phase  HttpPhase
+		Action types.Action
+	}
+)
+
+// HttpPhase is the phase of an http stream where the plugin is called.
+type HttpPhase string
+
+const (
+	PhaseRequestHeaders   HttpPhase = "request_headers"
+	PhaseRequestBody      HttpPhase = "request_body"
+	PhaseRequestTrailers  HttpPhase = "request_trailers"
+	PhaseResponseHeaders  HttpPhase = "response_headers"
+	PhaseResponseBody     HttpPhase = "response_body"
+	PhaseResponseTrailers HttpPhase = "response_trailers"
+	// PhaseRequestResumed and PhaseResponseResumed are recorded with ActionContinue when the plugin
+	// resumes the paused stream by proxywasm.ResumeHttpRequest/ResumeHttpResponse, e.g. in the callback
+	// of a callout. Resumes in the body callbacks are recorded after the action returned by the callback.
+	PhaseRequestResumed  HttpPhase = "request_resumed"
+	PhaseResponseResumed HttpPhase = "response_resumed"
+)
+
+// HeaderNormalization specifies how the header keys given by test code are normalized
+// before they are passed to plugins, which emulates the header normalization done by Envoy.
+type HeaderNormalization int
+
+const (
+	// HeaderNormalizationNone passes the header keys as-is. This is the default.
+	HeaderNormalizationNone HeaderNormalization = iota
+	// HeaderNormalizationLowercase lowercases all the header keys as Envoy does for HTTP/1 requests.
+	HeaderNormalizationLowercase
 )
 
-func newHttpHostEmulator() *httpHostEmulator {
-	host := &httpHostEmulator{httpStreams: map[uint32]*httpStreamState{}}
+func newHttpHostEmulator(strictMode bool, bodyBufferLimit int, lifecycles contextLifecycles) *httpHostEmulator {
+	host := &httpHostEmulator{
+		httpStreams:     map[uint32]*httpStreamState{},
+		strictMode:      strictMode,
+		bodyBufferLimit: bodyBufferLimit,
+		lifecycles:      lifecycles,
+	}
 	return host
 }
 
+// reset drops all the http streams and returns their context ids
+func (h *httpHostEmulator) reset() (contextIDs []uint32) {
+	for id := range h.httpStreams {
+		if id != RootContextID { // RootContextID is used by CallOnLogForAccessLogger
+			contextIDs = append(contextIDs, id)
+		}
+	}
+	h.httpStreams = map[uint32]*httpStreamState{}
+	return
+}
+
 // impl rawhostcall.ProxyWASMHost: delegated from hostEmulator
 func (h *httpHostEmulator) httpHostEmulatorProxyGetBufferBytes(bt types.BufferType, start int, maxSize int,
 	returnBufferData **byte, returnBufferSize *int) types.Status {
@@ -57,11 +179,19 @@ func (h *httpHostEmulator) httpHostEmulatorProxyGetBufferBytes(bt types.BufferTy
 	case types.BufferTypeHttpRequestBody:
 		buf = stream.requestBody
 	case types.BufferTypeHttpResponseBody:
-		buf = stream.requestBody
+		buf = stream.responseBody
 	default:
 		panic("unreachable: maybe a bug in this host emulation or SDK")
 	}
 
+	if len(buf) == 0 && start == 0 && stream.inBodyCallback {
+		// an empty chunk received in the body callback is read as empty, while the body
+		// not received yet is still reported as an error
+		*returnBufferData = &emptyBuffer[0]
+		*returnBufferSize = 0
+		return types.StatusOK
+	}
+
 	if start >= len(buf) {
 		log.Printf("start index out of range: %d (start) >= %d ", start, len(buf))
 		return types.StatusBadArgument
@@ -78,20 +208,46 @@ func (h *httpHostEmulator) httpHostEmulatorProxyGetBufferBytes(bt types.BufferTy
 
 func (h *httpHostEmulator) httpHostEmulatorProxySetBufferBytes(bt types.BufferType, start int, maxSize int,
 	bufferData *byte, bufferSize int) types.Status {
-	body := proxywasm.RawBytePtrToByteSlice(bufferData, bufferSize)
 	active := proxywasm.VMStateGetActiveContextID()
 	stream := h.httpStreams[active]
+	var body *[]byte
 	switch bt {
 	case types.BufferTypeHttpRequestBody:
-		stream.requestBody = body
+		body = &stream.requestBody
 	case types.BufferTypeHttpResponseBody:
-		stream.responseBody = body
+		body = &stream.responseBody
 	default:
 		panic("unreachable: maybe a bug in this host emulation or SDK")
 	}
+
+	data := proxywasm.RawBytePtrToByteSlice(bufferData, bufferSize)
+	spliced := spliceBuffer(*body, start, maxSize, data)
+	if h.strictMode && len(spliced) > h.bodyBufferLimit {
+		log.Printf("body size exceeds the buffer limit: %d > %d", len(spliced), h.bodyBufferLimit)
+		return types.StatusBadArgument
+	}
+	*body = spliced
 	return types.StatusOK
 }
 
+// spliceBuffer returns the copy of the buffer where the range of maxSize bytes from start is replaced with
+// the given data, with the range clamped to the buffer. This covers the operations supported by Envoy:
+// prepending with (0, 0), appending with (math.MaxInt32, 0) and replacing with (0, math.MaxInt32).
+func spliceBuffer(buf []byte, start, maxSize int, data []byte) []byte {
+	if start > len(buf) {
+		start = len(buf)
+	}
+	end := len(buf)
+	if maxSize < end-start {
+		end = start + maxSize
+	}
+
+	ret := make([]byte, 0, start+len(data)+len(buf)-end)
+	ret = append(ret, buf[:start]...)
+	ret = append(ret, data...)
+	return append(ret, buf[end:]...)
+}
+
 // impl rawhostcall.ProxyWASMHost: delegated from hostEmulator
 func (h *httpHostEmulator) httpHostEmulatorProxyGetHeaderMapValue(mapType types.MapType, keyData *byte,
 	keySize int, returnValueData **byte, returnValueSize *int) types.Status {
@@ -115,9 +271,8 @@ func (h *httpHostEmulator) httpHostEmulatorProxyGetHeaderMapValue(mapType types.
 
 	for _, h := range headers {
 		if h[0] == key {
-			value := []byte(h[1])
-			*returnValueData = &value[0]
-			*returnValueSize = len(value)
+			*returnValueData = valueBytePtr(h[1])
+			*returnValueSize = len(h[1])
 			return types.StatusOK
 		}
 	}
@@ -129,10 +284,14 @@ func (h *httpHostEmulator) httpHostEmulatorProxyGetHeaderMapValue(mapType types.
 func (h *httpHostEmulator) ProxyAddHeaderMapValue(mapType types.MapType, keyData *byte,
 	keySize int, valueData *byte, valueSize int) types.Status {
 
-	key := proxywasm.RawBytePtrToString(keyData, keySize)
-	value := proxywasm.RawBytePtrToString(valueData, valueSize)
+	// copied as the plugin may reuse the memory after the call
+	key := string(proxywasm.RawBytePtrToByteSlice(keyData, keySize))
+	value := string(proxywasm.RawBytePtrToByteSlice(valueData, valueSize))
 	active := proxywasm.VMStateGetActiveContextID()
 	stream := h.httpStreams[active]
+	if h.rejectsHeaderMutation(stream, mapType) {
+		return types.StatusBadArgument
+	}
 
 	switch mapType {
 	case types.MapTypeHttpRequestHeaders:
@@ -150,24 +309,89 @@ func (h *httpHostEmulator) ProxyAddHeaderMapValue(mapType types.MapType, keyData
 	return types.StatusOK
 }
 
-func addMapValue(base [][2]string, key, value string) [][2]string {
-	for i, h := range base {
-		if h[0] == key {
-			h[1] += value
-			base[i] = h
-			return base
+// cloneHeaders copies the given headers so that in-place mutations made by plugins
+// are never visible through the slices passed by test code.
+func cloneHeaders(headers [][2]string) [][2]string {
+	if headers == nil {
+		return nil
+	}
+	ret := make([][2]string, len(headers))
+	copy(ret, headers)
+	return ret
+}
+
+// emptyBuffer backs the reads of empty buffers, as the SDK treats nil data as not found.
+var emptyBuffer = []byte{0}
+
+// valueBytePtr returns the pointer to a copy of the header value, or nil for the empty value.
+func valueBytePtr(value string) *byte {
+	if len(value) == 0 {
+		return nil
+	}
+	b := []byte(value)
+	return &b[0]
+}
+
+// normalizeHeaders returns the copy of the given headers normalized by the configured mode.
+func (h *httpHostEmulator) normalizeHeaders(headers [][2]string) [][2]string {
+	ret := cloneHeaders(headers)
+	switch h.headerNormalization {
+	case HeaderNormalizationNone:
+	case HeaderNormalizationLowercase:
+		for i := range ret {
+			ret[i][0] = strings.ToLower(ret[i][0])
 		}
+	default:
+		panic("unreachable: maybe a bug in this host emulation or SDK")
+	}
+	return ret
+}
+
+// impl HostEmulator
+func (h *httpHostEmulator) SetHeaderNormalization(mode HeaderNormalization) {
+	h.headerNormalization = mode
+}
+
+// rejectsHeaderMutation reports whether the mutation of the given map is rejected in the strict mode
+// as Envoy does, where the request maps cannot be modified in the response phases and vice versa.
+func (h *httpHostEmulator) rejectsHeaderMutation(stream *httpStreamState, mapType types.MapType) bool {
+	if !h.strictMode || stream.phase == "" {
+		return false
+	}
+
+	var requestMap, requestPhase bool
+	switch mapType {
+	case types.MapTypeHttpRequestHeaders, types.MapTypeHttpRequestTrailers:
+		requestMap = true
 	}
+	switch stream.phase {
+	case PhaseRequestHeaders, PhaseRequestBody, PhaseRequestTrailers:
+		requestPhase = true
+	}
+	if requestMap != requestPhase {
+		log.Printf("map type %d cannot be modified in the %s phase", mapType, stream.phase)
+		return true
+	}
+	return false
+}
+
+// addMapValue appends the header as a separate entry even if the key already exists as Envoy does,
+// so that headers which must not be comma-joined such as set-cookie are kept distinct.
+func addMapValue(base [][2]string, key, value string) [][2]string {
 	return append(base, [2]string{key, value})
 }
 
 // impl rawhostcall.ProxyWASMHost
 func (h *httpHostEmulator) ProxyReplaceHeaderMapValue(mapType types.MapType, keyData *byte,
 	keySize int, valueData *byte, valueSize int) types.Status {
-	key := proxywasm.RawBytePtrToString(keyData, keySize)
-	value := proxywasm.RawBytePtrToString(valueData, valueSize)
+	// copied so that the modification is kept intact and visible to the subsequent reads
+	key := string(proxywasm.RawBytePtrToByteSlice(keyData, keySize))
+	value := string(proxywasm.RawBytePtrToByteSlice(valueData, valueSize))
 	active := proxywasm.VMStateGetActiveContextID()
 	stream := h.httpStreams[active]
+	if h.rejectsHeaderMutation(stream, mapType) {
+		return types.StatusBadArgument
+	}
 
 	switch mapType {
 	case types.MapTypeHttpRequestHeaders:
@@ -185,15 +409,23 @@ func (h *httpHostEmulator) ProxyReplaceHeaderMapValue(mapType types.MapType, key
 }
 
 // impl rawhostcall.ProxyWASMHost
+// replaceMapValue sets the value of the first occurrence of the key and drops the other ones as Envoy does,
+// so that exactly one value remains. The value is appended if the key is not present.
 func replaceMapValue(base [][2]string, key, value string) [][2]string {
-	for i, h := range base {
-		if h[0] == key {
-			h[1] = value
-			base[i] = h
-			return base
+	ret := make([][2]string, 0, len(base)+1)
+	var replaced bool
+	for _, h := range base {
+		if h[0] != key {
+			ret = append(ret, h)
+		} else if !replaced {
+			ret = append(ret, [2]string{key, value})
+			replaced = true
 		}
 	}
-	return append(base, [2]string{key, value})
+	if !replaced {
+		ret = append(ret, [2]string{key, value})
+	}
+	return ret
 }
 
 // impl rawhostcall.ProxyWASMHost
@@ -201,6 +433,9 @@ func (h *httpHostEmulator) ProxyRemoveHeaderMapValue(mapType types.MapType, keyD
 	key := proxywasm.RawBytePtrToString(keyData, keySize)
 	active := proxywasm.VMStateGetActiveContextID()
 	stream := h.httpStreams[active]
+	if h.rejectsHeaderMutation(stream, mapType) {
+		return types.StatusBadArgument
+	}
 
 	switch mapType {
 	case types.MapTypeHttpRequestHeaders:
@@ -217,17 +452,15 @@ func (h *httpHostEmulator) ProxyRemoveHeaderMapValue(mapType types.MapType, keyD
 	return types.StatusOK
 }
 
+// removeHeaderMapValue removes all the occurrences of the key.
 func removeHeaderMapValue(base [][2]string, key string) [][2]string {
-	for i, h := range base {
-		if h[0] == key {
-			if len(base)-1 == i {
-				return base[:i]
-			} else {
-				return append(base[:i], base[i+1:]...)
-			}
+	ret := make([][2]string, 0, len(base))
+	for _, h := range base {
+		if h[0] != key {
+			ret = append(ret, h)
 		}
 	}
-	return base
+	return ret
 }
 
 // impl rawhostcall.ProxyWASMHost: delegated from hostEmulator
@@ -260,6 +493,9 @@ func (h *httpHostEmulator) ProxySetHeaderMapPairs(mapType types.MapType, mapData
 	m := proxywasm.DeserializeMap(proxywasm.RawBytePtrToByteSlice(mapData, mapSize))
 	active := proxywasm.VMStateGetActiveContextID()
 	stream := h.httpStreams[active]
+	if h.rejectsHeaderMutation(stream, mapType) {
+		return types.StatusBadArgument
+	}
 
 	switch mapType {
 	case types.MapTypeHttpRequestHeaders:
@@ -277,10 +513,32 @@ func (h *httpHostEmulator) ProxySetHeaderMapPairs(mapType types.MapType, mapData
 }
 
 // impl rawhostcall.ProxyWASMHost
-func (h *httpHostEmulator) ProxyContinueStream(types.StreamType) types.Status {
+func (h *httpHostEmulator) ProxyContinueStream(streamType types.StreamType) types.Status {
 	active := proxywasm.VMStateGetActiveContextID()
 	stream := h.httpStreams[active]
 	stream.action = types.ActionContinue
+	switch streamType {
+	case types.StreamTypeRequest:
+		stream.requestResumed = true
+		if stream.inBodyCallback {
+			break
+		}
+		if stream.requestBodyBuffered {
+			stream.requestBodyBuffered = false
+			stream.forwardedRequestBodyChunks = append(stream.forwardedRequestBodyChunks, stream.requestBody)
+		}
+		stream.recordAction(PhaseRequestResumed)
+	case types.StreamTypeResponse:
+		stream.responseResumed = true
+		if stream.inBodyCallback {
+			break
+		}
+		if stream.responseBodyBuffered {
+			stream.responseBodyBuffered = false
+			stream.forwardedResponseBodyChunks = append(stream.forwardedResponseBodyChunks, stream.responseBody)
+		}
+		stream.recordAction(PhaseResponseResumed)
+	}
 	return types.StatusOK
 }
 
@@ -293,13 +551,44 @@ func (h *httpHostEmulator) ProxySendLocalResponse(statusCode uint32,
 	stream.sentLocalResponse = &LocalHttpResponse{
 		StatusCode:       statusCode,
 		StatusCodeDetail: proxywasm.RawBytePtrToString(statusCodeDetailData, statusCodeDetailsSize),
-		Data:             proxywasm.RawBytePtrToByteSlice(bodyData, bodySize),
+		Data:             append([]byte{}, proxywasm.RawBytePtrToByteSlice(bodyData, bodySize)...),
 		Headers:          proxywasm.DeserializeMap(proxywasm.RawBytePtrToByteSlice(headersData, headersSize)),
 		GRPCStatus:       grpcStatus,
 	}
 	return types.StatusOK
 }
 
+// shortCircuited returns true if the local response has been sent on the stream, in which case
+// Envoy stops the filter chain so neither the rest of the request nor the upstream response reaches the plugin.
+func (cs *httpStreamState) shortCircuited(contextID uint32) bool {
+	if cs.sentLocalResponse == nil {
+		return false
+	}
+	log.Printf("callback skipped on context %d as the local response has been sent", contextID)
+	return true
+}
+
+// impl HostEmulator
+func (h *httpHostEmulator) SetAuthorityRoutes(routes map[string]string) {
+	h.authorityRoutes = routes
+}
+
+// resolveRoute returns the route for the current :authority of the given http context, which
+// emulates Envoy re-selecting the route after the plugin modifies the request headers.
+func (h *httpHostEmulator) resolveRoute(contextID uint32) (string, bool) {
+	stream, ok := h.httpStreams[contextID]
+	if !ok {
+		return "", false
+	}
+	for _, kv := range stream.requestHeaders {
+		if kv[0] == ":authority" {
+			route, ok := h.authorityRoutes[kv[1]]
+			return route, ok && route != ""
+		}
+	}
+	return "", false
+}
+
 // impl HostEmulator
 func (h *httpHostEmulator) HttpFilterInitContext() (contextID uint32) {
 	contextID = getNextContextID()
@@ -313,6 +602,15 @@ func (h *httpHostEmulator) HttpFilterPutRequestHeaders(contextID uint32, headers
 	h.HttpFilterPutRequestHeadersEndOfStream(contextID, headers, false)
 }
 
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterPutRequestHeadersN(contextID uint32, n int) {
+	headers := make([][2]string, n)
+	for i := range headers {
+		headers[i] = [2]string{"x-synthetic-" + strconv.Itoa(i), "value-" + strconv.Itoa(i)}
+	}
+	h.HttpFilterPutRequestHeaders(contextID, headers)
+}
+
 // impl HostEmulator
 func (h *httpHostEmulator) HttpFilterGetRequestHeaders(contextID uint32) (headers [][2]string) {
 	cs, ok := h.httpStreams[contextID]
@@ -333,16 +631,63 @@ func (h *httpHostEmulator) HttpFilterGetResponseHeaders(contextID uint32) (heade
 	return cs.responseHeaders
 }
 
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterGetResponseHeaderCount(contextID uint32) int {
+	cs, ok := h.httpStreams[contextID]
+	if !ok {
+		log.Fatalf("invalid context id: %d", contextID)
+	}
+
+	return len(cs.responseHeaders)
+}
+
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterGetOriginalResponseHeaders(contextID uint32) [][2]string {
+	cs, ok := h.httpStreams[contextID]
+	if !ok {
+		log.Fatalf("invalid context id: %d", contextID)
+	}
+
+	return cs.originalResponseHeaders
+}
+
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterGetRawRequestHeaderBytes(contextID uint32) []byte {
+	cs, ok := h.httpStreams[contextID]
+	if !ok {
+		log.Fatalf("invalid context id: %d", contextID)
+	}
+
+	return proxywasm.SerializeMap(cs.requestHeaders)
+}
+
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterGetRawResponseHeaderBytes(contextID uint32) []byte {
+	cs, ok := h.httpStreams[contextID]
+	if !ok {
+		log.Fatalf("invalid context id: %d", contextID)
+	}
+
+	return proxywasm.SerializeMap(cs.responseHeaders)
+}
+
 // impl HostEmulator
 func (h *httpHostEmulator) HttpFilterPutRequestHeadersEndOfStream(contextID uint32, headers [][2]string, endOfStream bool) {
 	cs, ok := h.httpStreams[contextID]
 	if !ok {
 		log.Fatalf("invalid context id: %d", contextID)
 	}
+	if cs.shortCircuited(contextID) {
+		return
+	}
 
-	cs.requestHeaders = headers
+	cs.requestHeaders = h.normalizeHeaders(headers)
+	cs.requestSnapshot.Headers = cloneHeaders(headers)
+	cs.phase = PhaseRequestHeaders
 	cs.action = proxywasm.ProxyOnRequestHeaders(contextID,
 		len(headers), endOfStream)
+	cs.phase = ""
+	cs.recordAction(PhaseRequestHeaders)
 }
 
 // impl HostEmulator
@@ -356,11 +701,18 @@ func (h *httpHostEmulator) HttpFilterPutResponseHeadersEndOfStream(contextID uin
 	if !ok {
 		log.Fatalf("invalid context id: %d", contextID)
 	}
+	if cs.shortCircuited(contextID) {
+		return
+	}
 
-	cs.responseHeaders = headers
+	cs.responseHeaders = h.normalizeHeaders(headers)
+	cs.originalResponseHeaders = cloneHeaders(cs.responseHeaders)
 
+	cs.phase = PhaseResponseHeaders
 	cs.action = proxywasm.ProxyOnResponseHeaders(contextID,
 		len(headers), endOfStream)
+	cs.phase = ""
+	cs.recordAction(PhaseResponseHeaders)
 }
 
 // impl HostEmulator
@@ -369,9 +721,37 @@ func (h *httpHostEmulator) HttpFilterPutRequestTrailers(contextID uint32, header
 	if !ok {
 		log.Fatalf("invalid context id: %d", contextID)
 	}
+	if cs.shortCircuited(contextID) {
+		return
+	}
 
-	cs.requestTrailers = headers
-	cs.action = proxywasm.ProxyOnRequestTrailers(contextID, len(headers))
+	// trailers added by the plugin in the former phases are kept
+	cs.requestTrailers = append(h.normalizeHeaders(headers), cs.requestTrailers...)
+	cs.requestSnapshot.Trailers = cloneHeaders(headers)
+	cs.phase = PhaseRequestTrailers
+	cs.action = proxywasm.ProxyOnRequestTrailers(contextID, len(cs.requestTrailers))
+	cs.phase = ""
+	cs.recordAction(PhaseRequestTrailers)
+}
+
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterSetRequestTrailers(contextID uint32, trailers [][2]string) {
+	cs, ok := h.httpStreams[contextID]
+	if !ok {
+		log.Fatalf("invalid context id: %d", contextID)
+	}
+
+	cs.requestTrailers = h.normalizeHeaders(trailers)
+}
+
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterGetRequestTrailers(contextID uint32) [][2]string {
+	cs, ok := h.httpStreams[contextID]
+	if !ok {
+		log.Fatalf("invalid context id: %d", contextID)
+	}
+
+	return cs.requestTrailers
 }
 
 // impl HostEmulator
@@ -380,9 +760,26 @@ func (h *httpHostEmulator) HttpFilterPutResponseTrailers(contextID uint32, heade
 	if !ok {
 		log.Fatalf("invalid context id: %d", contextID)
 	}
+	if cs.shortCircuited(contextID) {
+		return
+	}
+
+	// trailers added by the plugin in the former phases are kept
+	cs.responseTrailers = append(h.normalizeHeaders(headers), cs.responseTrailers...)
+	cs.phase = PhaseResponseTrailers
+	cs.action = proxywasm.ProxyOnResponseTrailers(contextID, len(cs.responseTrailers))
+	cs.phase = ""
+	cs.recordAction(PhaseResponseTrailers)
+}
+
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterGetResponseTrailers(contextID uint32) [][2]string {
+	cs, ok := h.httpStreams[contextID]
+	if !ok {
+		log.Fatalf("invalid context id: %d", contextID)
+	}
 
-	cs.responseTrailers = headers
-	cs.action = proxywasm.ProxyOnResponseTrailers(contextID, len(headers))
+	return cs.responseTrailers
 }
 
 // impl HostEmulator
@@ -396,10 +793,42 @@ func (h *httpHostEmulator) HttpFilterPutRequestBodyEndOfStream(contextID uint32,
 	if !ok {
 		log.Fatalf("invalid context id: %d", contextID)
 	}
+	if cs.shortCircuited(contextID) {
+		return
+	}
+
+	cs.requestSnapshot.Body = append(cs.requestSnapshot.Body, body...)
+	if cs.requestBodyBuffered {
+		buffered := make([]byte, 0, len(cs.requestBody)+len(body))
+		buffered = append(buffered, cs.requestBody...)
+		cs.requestBody = append(buffered, body...)
+	} else {
+		cs.requestBody = body
+	}
 
-	cs.requestBody = body
+	cs.requestResumed = false
+	cs.inBodyCallback = true
+	cs.phase = PhaseRequestBody
 	cs.action = proxywasm.ProxyOnRequestBody(contextID,
-		len(body), endOfStream)
+		len(cs.requestBody), endOfStream)
+	cs.phase = ""
+	cs.inBodyCallback = false
+	// the action returned by the plugin is recorded before overridden by the resume in the callback
+	cs.recordAction(PhaseRequestBody)
+	if cs.requestResumed {
+		cs.action = types.ActionContinue
+		cs.recordAction(PhaseRequestResumed)
+	}
+
+	switch cs.action {
+	case types.ActionPause:
+		cs.requestBodyBuffered = true
+	case types.ActionContinue:
+		cs.requestBodyBuffered = false
+		cs.forwardedRequestBodyChunks = append(cs.forwardedRequestBodyChunks, cs.requestBody)
+	default:
+		log.Fatalf("invalid action type: %d", cs.action)
+	}
 }
 
 // impl HostEmulator
@@ -412,20 +841,67 @@ func (h *httpHostEmulator) HttpFilterGetRequestBody(contextID uint32) []byte {
 	return cs.requestBody
 }
 
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterGetForwardedRequestBodyChunks(contextID uint32) [][]byte {
+	cs, ok := h.httpStreams[contextID]
+	if !ok {
+		log.Fatalf("invalid context id: %d", contextID)
+	}
+
+	return cs.forwardedRequestBodyChunks
+}
+
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterGetForwardedRequestBody(contextID uint32) []byte {
+	return joinChunks(h.HttpFilterGetForwardedRequestBodyChunks(contextID))
+}
+
 // impl HostEmulator
 func (h *httpHostEmulator) HttpFilterPutResponseBody(contextID uint32, body []byte) {
 	h.HttpFilterPutResponseBodyEndOfStream(contextID, body, false)
 }
 
+// impl HostEmulator
 func (h *httpHostEmulator) HttpFilterPutResponseBodyEndOfStream(contextID uint32, body []byte, endOfStream bool) {
 	cs, ok := h.httpStreams[contextID]
 	if !ok {
 		log.Fatalf("invalid context id: %d", contextID)
 	}
+	if cs.shortCircuited(contextID) {
+		return
+	}
 
-	cs.responseBody = body
+	if cs.responseBodyBuffered {
+		buffered := make([]byte, 0, len(cs.responseBody)+len(body))
+		buffered = append(buffered, cs.responseBody...)
+		cs.responseBody = append(buffered, body...)
+	} else {
+		cs.responseBody = body
+	}
+
+	cs.responseResumed = false
+	cs.inBodyCallback = true
+	cs.phase = PhaseResponseBody
 	cs.action = proxywasm.ProxyOnResponseBody(contextID,
-		len(body), endOfStream)
+		len(cs.responseBody), endOfStream)
+	cs.phase = ""
+	cs.inBodyCallback = false
+	// the action returned by the plugin is recorded before overridden by the resume in the callback
+	cs.recordAction(PhaseResponseBody)
+	if cs.responseResumed {
+		cs.action = types.ActionContinue
+		cs.recordAction(PhaseResponseResumed)
+	}
+
+	switch cs.action {
+	case types.ActionPause:
+		cs.responseBodyBuffered = true
+	case types.ActionContinue:
+		cs.responseBodyBuffered = false
+		cs.forwardedResponseBodyChunks = append(cs.forwardedResponseBodyChunks, cs.responseBody)
+	default:
+		log.Fatalf("invalid action type: %d", cs.action)
+	}
 }
 
 // impl HostEmulator
@@ -438,15 +914,51 @@ func (h *httpHostEmulator) HttpFilterGetResponseBody(contextID uint32) []byte {
 	return cs.responseBody
 }
 
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterGetForwardedResponseBodyChunks(contextID uint32) [][]byte {
+	cs, ok := h.httpStreams[contextID]
+	if !ok {
+		log.Fatalf("invalid context id: %d", contextID)
+	}
+
+	return cs.forwardedResponseBodyChunks
+}
+
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterGetForwardedResponseBody(contextID uint32) []byte {
+	return joinChunks(h.HttpFilterGetForwardedResponseBodyChunks(contextID))
+}
+
+func joinChunks(chunks [][]byte) (ret []byte) {
+	for _, chunk := range chunks {
+		ret = append(ret, chunk...)
+	}
+	return
+}
+
 // impl HostEmulator
 func (h *httpHostEmulator) HttpFilterCompleteHttpStream(contextID uint32) {
+	if h.lifecycles.deleted(contextID) {
+		log.Printf("context %d has already been deleted", contextID)
+		return
+	}
+
 	// https://github.com/envoyproxy/envoy/blob/867b9e23d2e48350bd1b0d1fbc392a8355f20e35/include/envoy/http/filter.h#L542-L553
 	// https://github.com/envoyproxy/envoy/blob/867b9e23d2e48350bd1b0d1fbc392a8355f20e35/source/extensions/common/wasm/context.cc#L1463-L1482
 	proxywasm.ProxyOnLog(contextID)
 
 	// https://github.com/envoyproxy/envoy/blob/867b9e23d2e48350bd1b0d1fbc392a8355f20e35/source/extensions/common/wasm/context.cc#L1491-L1497
-	proxywasm.ProxyOnDone(contextID)
-	proxywasm.ProxyOnDelete(contextID)
+	h.lifecycles.onDone(contextID)
+	h.lifecycles.onDelete(contextID)
+}
+
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterGetStreamDoneCount(contextID uint32) int {
+	if _, ok := h.httpStreams[contextID]; !ok {
+		log.Fatalf("invalid context id: %d", contextID)
+	}
+
+	return h.lifecycles.get(contextID).onDoneCount
 }
 
 // impl HostEmulator
@@ -458,6 +970,85 @@ func (h *httpHostEmulator) HttpFilterGetCurrentStreamAction(contextID uint32) ty
 	return stream.action
 }
 
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterGetRequestSnapshot(contextID uint32) RequestSnapshot {
+	cs, ok := h.httpStreams[contextID]
+	if !ok {
+		log.Fatalf("invalid context id: %d", contextID)
+	}
+
+	return cs.requestSnapshot
+}
+
+// impl HostEmulator
+func (h *httpHostEmulator) ReplayRequest(snapshot RequestSnapshot) ReplayResult {
+	contextID := h.HttpFilterInitContext()
+	hasBody, hasTrailers := len(snapshot.Body) > 0, len(snapshot.Trailers) > 0
+
+	h.HttpFilterPutRequestHeadersEndOfStream(contextID, cloneHeaders(snapshot.Headers), !hasBody && !hasTrailers)
+	if hasBody {
+		body := make([]byte, len(snapshot.Body))
+		copy(body, snapshot.Body)
+		h.HttpFilterPutRequestBodyEndOfStream(contextID, body, !hasTrailers)
+	}
+	if hasTrailers {
+		h.HttpFilterPutRequestTrailers(contextID, cloneHeaders(snapshot.Trailers))
+	}
+
+	cs := h.httpStreams[contextID]
+	ret := ReplayResult{
+		Headers:       cs.requestHeaders,
+		Trailers:      cs.requestTrailers,
+		Action:        cs.action,
+		LocalResponse: cs.sentLocalResponse,
+		Actions:       cs.actions,
+	}
+	ret.Body = joinChunks(cs.forwardedRequestBodyChunks)
+
+	h.HttpFilterCompleteHttpStream(contextID)
+	return ret
+}
+
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterSendResponse(contextID uint32, response HttpResponse) ResponseResult {
+	hasBody, hasTrailers := len(response.BodyChunks) > 0, len(response.Trailers) > 0
+
+	h.HttpFilterPutResponseHeadersEndOfStream(contextID, response.Headers, !hasBody && !hasTrailers)
+	for i, chunk := range response.BodyChunks {
+		h.HttpFilterPutResponseBodyEndOfStream(contextID, chunk, i == len(response.BodyChunks)-1 && !hasTrailers)
+	}
+	if hasTrailers {
+		h.HttpFilterPutResponseTrailers(contextID, response.Trailers)
+	}
+
+	cs := h.httpStreams[contextID]
+	ret := ResponseResult{
+		Headers:       cs.responseHeaders,
+		Body:          joinChunks(cs.forwardedResponseBodyChunks),
+		Trailers:      cs.responseTrailers,
+		Action:        cs.action,
+		LocalResponse: cs.sentLocalResponse,
+		Actions:       cs.actions,
+	}
+
+	h.HttpFilterCompleteHttpStream(contextID)
+	return ret
+}
+
+// impl HostEmulator
+func (h *httpHostEmulator) HttpFilterGetActions(contextID uint32) []PhaseAction {
+	cs, ok := h.httpStreams[contextID]
+	if !ok {
+		log.Fatalf("invalid context id: %d", contextID)
+	}
+
+	return cs.actions
+}
+
+func (cs *httpStreamState) recordAction(phase HttpPhase) {
+	cs.actions = append(cs.actions, PhaseAction{Phase: phase, Action: cs.action})
+}
+
 // impl HostEmulator
 func (h *httpHostEmulator) HttpFilterGetSentLocalResponse(contextID uint32) *LocalHttpResponse {
 	return h.httpStreams[contextID].sentLocalResponse
@@ -0,0 +1,2471 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxytest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+type upperCaseResponseBodyContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *upperCaseResponseBodyContext) OnHttpResponseBody(bodySize int, endOfStream bool) types.Action {
+	body, err := proxywasm.GetHttpResponseBody(0, bodySize)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get response body: %v", err)
+		return types.ActionContinue
+	}
+
+	if err := proxywasm.SetHttpResponseBody(bytes.ToUpper(body)); err != nil {
+		proxywasm.LogCriticalf("failed to set response body: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_StreamingResponseBody(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &upperCaseResponseBodyContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	chunks := []string{"hello ", "streaming ", "world"}
+	for i, chunk := range chunks {
+		host.HttpFilterPutResponseBodyEndOfStream(id, []byte(chunk), i == len(chunks)-1)
+		require.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+	}
+
+	forwarded := host.HttpFilterGetForwardedResponseBodyChunks(id)
+	require.Len(t, forwarded, 3)
+	assert.Equal(t, "HELLO ", string(forwarded[0]))
+	assert.Equal(t, "STREAMING ", string(forwarded[1]))
+	assert.Equal(t, "WORLD", string(forwarded[2]))
+	assert.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+}
+
+type gunzipRequestBodyContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *gunzipRequestBodyContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.Action {
+	if !endOfStream {
+		return types.ActionPause
+	}
+
+	encoding, err := proxywasm.GetHttpRequestHeader("content-encoding")
+	if err != nil || encoding != "gzip" {
+		return types.ActionContinue
+	}
+
+	body, err := proxywasm.GetHttpRequestBody(0, bodySize)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get request body: %v", err)
+		return types.ActionContinue
+	}
+
+	r, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		proxywasm.LogCriticalf("failed to read gzipped body: %v", err)
+		return types.ActionContinue
+	}
+	plain, err := ioutil.ReadAll(r)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to decompress body: %v", err)
+		return types.ActionContinue
+	}
+
+	if err := proxywasm.SetHttpRequestBody(plain); err != nil {
+		proxywasm.LogCriticalf("failed to set request body: %v", err)
+	}
+	if err := proxywasm.RemoveHttpRequestHeader("content-encoding"); err != nil {
+		proxywasm.LogCriticalf("failed to remove content-encoding: %v", err)
+	}
+	if err := proxywasm.SetHttpRequestHeader("content-length", strconv.Itoa(len(plain))); err != nil {
+		proxywasm.LogCriticalf("failed to set content-length: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_CompressedRequestBody(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &gunzipRequestBodyContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	plain := []byte(`{"message": "hello compressed world"}`)
+	var compressed bytes.Buffer
+	w := gzip.NewWriter(&compressed)
+	_, err := w.Write(plain)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	headers := [][2]string{
+		{"content-type", "application/json"},
+		{"content-encoding", "gzip"},
+		{"content-length", strconv.Itoa(compressed.Len())},
+	}
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, headers)
+	host.HttpFilterPutRequestBodyEndOfStream(id, compressed.Bytes(), true)
+
+	assert.Equal(t, plain, host.HttpFilterGetRequestBody(id))
+	assert.Equal(t, [][2]string{
+		{"content-type", "application/json"},
+		{"content-length", strconv.Itoa(len(plain))},
+	}, host.HttpFilterGetRequestHeaders(id))
+	assert.Equal(t, "gzip", headers[1][1], "seeded headers must not be mutated")
+	assert.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+}
+
+type grpcDenyContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *grpcDenyContext) OnHttpRequestHeaders(int, bool) types.Action {
+	proxywasm.SendHttpResponseWithGrpcStatus(403, [][2]string{{"content-type", "application/grpc"}},
+		"", types.GrpcStatusPermissionDenied)
+	return types.ActionPause
+}
+
+func TestHttpFilter_LocalResponseWithGrpcStatus(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &grpcDenyContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{"content-type", "application/grpc"}})
+
+	res := host.HttpFilterGetSentLocalResponse(id)
+	require.NotNil(t, res)
+	assert.Equal(t, uint32(403), res.StatusCode)
+	assert.Equal(t, types.GrpcStatusPermissionDenied, types.GrpcStatus(res.GRPCStatus))
+	assert.Equal(t, "PermissionDenied", types.GrpcStatus(res.GRPCStatus).String())
+}
+
+type traceContextPropagationContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *traceContextPropagationContext) OnHttpRequestHeaders(int, bool) types.Action {
+	traceID, err := proxywasm.GetTraceID()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get trace id: %v", err)
+		return types.ActionContinue
+	}
+
+	if _, err := proxywasm.DispatchHttpCall("authz", [][2]string{
+		{":method", "GET"}, {":path", "/check"}, {":authority", "authz"}, {"x-b3-traceid", traceID},
+	}, "", nil, 1000, func(int, int, int) {}); err != nil {
+		proxywasm.LogCriticalf("failed to dispatch http call: %v", err)
+	}
+	return types.ActionPause
+}
+
+func TestHttpFilter_GetTraceID(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		headers [][2]string
+		exp     string
+	}{
+		{
+			name:    "traceparent",
+			headers: [][2]string{{"traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"}},
+			exp:     "0af7651916cd43dd8448eb211c80319c",
+		},
+		{
+			name:    "b3",
+			headers: [][2]string{{"x-b3-traceid", "80f198ee56343ba864fe8b2a57d3eff7"}},
+			exp:     "80f198ee56343ba864fe8b2a57d3eff7",
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opt := NewEmulatorOption().
+				WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &traceContextPropagationContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutRequestHeaders(id, c.headers)
+
+			require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+			attrs := host.GetCalloutAttributesFromContext(id)
+			require.Len(t, attrs, 1)
+			assert.Contains(t, attrs[0].Headers, [2]string{"x-b3-traceid", c.exp})
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		opt := NewEmulatorOption().
+			WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &traceContextPropagationContext{} })
+		host := NewHostEmulator(opt)
+		defer host.Done()
+
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestHeaders(id, [][2]string{{"traceparent", "invalid"}})
+
+		assert.Equal(t, []string{"failed to get trace id: invalid traceparent header: invalid"},
+			host.GetLogs(types.LogLevelCritical))
+		assert.Len(t, host.GetCalloutAttributesFromContext(id), 0)
+	})
+}
+
+type promoteHeaderToTrailerContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *promoteHeaderToTrailerContext) OnHttpResponseHeaders(int, bool) types.Action {
+	checksum, err := proxywasm.GetHttpResponseHeader("x-checksum")
+	if err != nil {
+		return types.ActionContinue
+	}
+
+	if err := proxywasm.RemoveHttpResponseHeader("x-checksum"); err != nil {
+		proxywasm.LogCriticalf("failed to remove header: %v", err)
+	}
+	if err := proxywasm.AddHttpResponseTrailer("x-checksum", checksum); err != nil {
+		proxywasm.LogCriticalf("failed to add trailer: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_AddResponseTrailersOnHeaders(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &promoteHeaderToTrailerContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "200"}, {"x-checksum", "abcd"}})
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, [][2]string{{":status", "200"}}, host.HttpFilterGetResponseHeaders(id))
+	assert.Equal(t, [][2]string{{"x-checksum", "abcd"}}, host.HttpFilterGetResponseTrailers(id))
+
+	host.HttpFilterPutResponseTrailers(id, [][2]string{{"grpc-status", "0"}})
+	assert.Equal(t, [][2]string{{"grpc-status", "0"}, {"x-checksum", "abcd"}}, host.HttpFilterGetResponseTrailers(id))
+}
+
+type wholeBodyContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *wholeBodyContext) OnHttpRequestBody(_ int, endOfStream bool) types.Action {
+	if !endOfStream {
+		return types.ActionPause
+	}
+
+	body, err := proxywasm.GetWholeHttpRequestBody()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get request body: %v", err)
+		return types.ActionContinue
+	}
+	proxywasm.LogInfof("request body: %s", string(body))
+	return types.ActionContinue
+}
+
+func (ctx *wholeBodyContext) OnHttpResponseBody(_ int, endOfStream bool) types.Action {
+	if !endOfStream {
+		return types.ActionPause
+	}
+
+	body, err := proxywasm.GetWholeHttpResponseBody()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get response body: %v", err)
+		return types.ActionContinue
+	}
+	proxywasm.LogInfof("response body: %s", string(body))
+	return types.ActionContinue
+}
+
+func TestHttpFilter_GetWholeBody(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &wholeBodyContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestBodyEndOfStream(id, []byte("hello request"), true)
+	host.HttpFilterPutResponseBodyEndOfStream(id, []byte("hello "), false)
+	host.HttpFilterPutResponseBodyEndOfStream(id, []byte("response"), true)
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{"request body: hello request", "response body: hello response"},
+		host.GetLogs(types.LogLevelInfo))
+}
+
+type headerKeyLoggingContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *headerKeyLoggingContext) OnHttpRequestHeaders(int, bool) types.Action {
+	headers, err := proxywasm.GetHttpRequestHeaders()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get request headers: %v", err)
+		return types.ActionContinue
+	}
+	for _, h := range headers {
+		proxywasm.LogInfo(h[0])
+	}
+
+	if _, err := proxywasm.GetHttpRequestHeader("x-request-id"); err != nil {
+		proxywasm.LogWarnf("x-request-id not found: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_SetHeaderNormalization(t *testing.T) {
+	headers := [][2]string{{":authority", "example.com"}, {"X-Request-ID", "abcd"}, {"Content-Type", "text/plain"}}
+	for _, c := range []struct {
+		name     string
+		mode     HeaderNormalization
+		expKeys  []string
+		expWarns int
+	}{
+		{name: "none", mode: HeaderNormalizationNone, expKeys: []string{":authority", "X-Request-ID", "Content-Type"}, expWarns: 1},
+		{name: "lowercase", mode: HeaderNormalizationLowercase, expKeys: []string{":authority", "x-request-id", "content-type"}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opt := NewEmulatorOption().
+				WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &headerKeyLoggingContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			host.SetHeaderNormalization(c.mode)
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutRequestHeaders(id, headers)
+
+			assert.Equal(t, c.expKeys, host.GetLogs(types.LogLevelInfo))
+			assert.Len(t, host.GetLogs(types.LogLevelWarn), c.expWarns)
+			assert.Equal(t, "X-Request-ID", headers[1][0], "seeded headers must not be mutated")
+		})
+	}
+}
+
+type addHeaderContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *addHeaderContext) OnHttpRequestHeaders(int, bool) types.Action {
+	if err := proxywasm.AddHttpRequestHeader("x-wasm", "1"); err != nil {
+		proxywasm.LogCriticalf("failed to add header: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_GetRawHeaderBytes(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &addHeaderContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{":path", "/"}})
+	host.HttpFilterPutResponseHeaders(id, nil)
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []byte{
+		2, 0, 0, 0, // number of pairs
+		5, 0, 0, 0, 1, 0, 0, 0, // sizes of ":path" and "/"
+		6, 0, 0, 0, 1, 0, 0, 0, // sizes of "x-wasm" and "1"
+		':', 'p', 'a', 't', 'h', 0, '/', 0,
+		'x', '-', 'w', 'a', 's', 'm', 0, '1', 0,
+	}, host.HttpFilterGetRawRequestHeaderBytes(id))
+	assert.Equal(t, []byte{0, 0, 0, 0}, host.HttpFilterGetRawResponseHeaderBytes(id))
+}
+
+type padRequestBodyContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *padRequestBodyContext) OnHttpRequestBody(bodySize int, _ bool) types.Action {
+	body, err := proxywasm.GetHttpRequestBody(0, bodySize)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get request body: %v", err)
+		return types.ActionContinue
+	}
+
+	if err := proxywasm.SetHttpRequestBody(append(body, bytes.Repeat([]byte{' '}, 8)...)); err != nil {
+		proxywasm.LogCriticalf("failed to set request body: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_BodyBufferLimit(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		opt    *EmulatorOption
+		body   []byte
+		exp    []byte
+		expErr bool
+	}{
+		{
+			name: "not strict",
+			opt:  NewEmulatorOption().WithBodyBufferLimit(10),
+			body: []byte("abcdefgh"),
+			exp:  []byte("abcdefgh        "),
+		},
+		{
+			name: "within limit",
+			opt:  NewEmulatorOption().WithStrictMode().WithBodyBufferLimit(16),
+			body: []byte("abcdefgh"),
+			exp:  []byte("abcdefgh        "),
+		},
+		{
+			name:   "beyond limit",
+			opt:    NewEmulatorOption().WithStrictMode().WithBodyBufferLimit(10),
+			body:   []byte("abcdefgh"),
+			exp:    []byte("abcdefgh"),
+			expErr: true,
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opt := c.opt.WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &padRequestBodyContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutRequestBody(id, c.body)
+
+			assert.Equal(t, c.exp, host.HttpFilterGetRequestBody(id))
+			if c.expErr {
+				assert.Equal(t, []string{"failed to set request body: error status returned by host: bad argument"},
+					host.GetLogs(types.LogLevelCritical))
+			} else {
+				assert.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+			}
+		})
+	}
+}
+
+type responseBodySizeContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *responseBodySizeContext) OnHttpResponseHeaders(int, bool) types.Action {
+	if size, err := proxywasm.GetHttpResponseBodySize(); err == nil {
+		proxywasm.LogInfof("response body size on headers: %d", size)
+	}
+	return types.ActionContinue
+}
+
+func (ctx *responseBodySizeContext) OnHttpResponseBody(_ int, endOfStream bool) types.Action {
+	if !endOfStream {
+		return types.ActionPause
+	}
+
+	size, err := proxywasm.GetHttpResponseBodySize()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get response body size: %v", err)
+		return types.ActionContinue
+	}
+	proxywasm.LogInfof("response body size on body: %d", size)
+	return types.ActionContinue
+}
+
+func TestHttpFilter_GetHttpResponseBodySize(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		headers [][2]string
+		exp     []string
+	}{
+		{
+			name:    "content-length",
+			headers: [][2]string{{":status", "200"}, {"content-length", "11"}},
+			exp:     []string{"response body size on headers: 11", "response body size on body: 11"},
+		},
+		{
+			name:    "chunked",
+			headers: [][2]string{{":status", "200"}, {"transfer-encoding", "chunked"}},
+			exp:     []string{"response body size on body: 11"},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opt := NewEmulatorOption().
+				WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &responseBodySizeContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutResponseHeaders(id, c.headers)
+			host.HttpFilterPutResponseBodyEndOfStream(id, []byte("hello "), false)
+			host.HttpFilterPutResponseBodyEndOfStream(id, []byte("world"), true)
+
+			require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+			assert.Equal(t, c.exp, host.GetLogs(types.LogLevelInfo))
+		})
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		opt := NewEmulatorOption().
+			WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &responseBodySizeContext{} })
+		host := NewHostEmulator(opt)
+		defer host.Done()
+
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "200"}, {"content-length", "-1"}})
+		host.HttpFilterPutResponseBodyEndOfStream(id, []byte("hello"), true)
+
+		assert.Equal(t, []string{"failed to get response body size: invalid content-length header: -1"},
+			host.GetLogs(types.LogLevelCritical))
+	})
+}
+
+type loopingBodyReaderContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *loopingBodyReaderContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.Action {
+	if !endOfStream {
+		return types.ActionPause
+	}
+
+	var body []byte
+	for len(body) < bodySize {
+		chunk, err := proxywasm.GetHttpRequestBody(len(body), bodySize-len(body))
+		if err != nil {
+			proxywasm.LogCriticalf("failed to get request body: %v", err)
+			return types.ActionContinue
+		}
+		body = append(body, chunk...)
+		proxywasm.LogDebugf("read %d bytes", len(chunk))
+	}
+	proxywasm.LogInfof("request body: %s", string(body))
+	return types.ActionContinue
+}
+
+func TestHttpFilter_PartialBufferReads(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &loopingBodyReaderContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	host.SetPartialBufferReads(true)
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestBodyEndOfStream(id, []byte("0123456789"), true)
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{"read 5 bytes", "read 3 bytes", "read 1 bytes", "read 1 bytes"},
+		host.GetLogs(types.LogLevelDebug))
+	assert.Equal(t, []string{"request body: 0123456789"}, host.GetLogs(types.LogLevelInfo))
+}
+
+type jsonOnlyContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *jsonOnlyContext) OnHttpResponseHeaders(int, bool) types.Action {
+	contentType, err := proxywasm.GetHttpResponseContentType()
+	if err == types.ErrorStatusNotFound || (err == nil && contentType != "application/json") {
+		proxywasm.LogDebugf("skipped: %q", contentType)
+		return types.ActionContinue
+	} else if err != nil {
+		proxywasm.LogCriticalf("failed to get content-type: %v", err)
+		return types.ActionContinue
+	}
+
+	if err := proxywasm.SetHttpResponseHeader("x-json-processed", "true"); err != nil {
+		proxywasm.LogCriticalf("failed to set header: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_GetHttpResponseContentType(t *testing.T) {
+	for _, c := range []struct {
+		name        string
+		contentType string
+		processed   bool
+	}{
+		{name: "json", contentType: "application/json", processed: true},
+		{name: "json with charset", contentType: "Application/JSON; charset=utf-8", processed: true},
+		{name: "html", contentType: "text/html; charset=utf-8"},
+		{name: "absent"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opt := NewEmulatorOption().
+				WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &jsonOnlyContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			headers := [][2]string{{":status", "200"}}
+			if c.contentType != "" {
+				headers = append(headers, [2]string{"content-type", c.contentType})
+			}
+
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutResponseHeaders(id, headers)
+
+			require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+			if c.processed {
+				assert.Contains(t, host.HttpFilterGetResponseHeaders(id), [2]string{"x-json-processed", "true"})
+			} else {
+				assert.Equal(t, headers, host.HttpFilterGetResponseHeaders(id))
+				assert.Len(t, host.GetLogs(types.LogLevelDebug), 1)
+			}
+			assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+		})
+	}
+}
+
+type streamDoneCountingContext struct {
+	proxywasm.DefaultHttpContext
+	done *int
+}
+
+func (ctx *streamDoneCountingContext) OnHttpStreamDone() {
+	*ctx.done++
+}
+
+func TestHttpFilter_GetStreamDoneCount(t *testing.T) {
+	var done int
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &streamDoneCountingContext{done: &done} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{":method", "POST"}})
+	host.HttpFilterPutRequestBodyEndOfStream(id, []byte("request"), true)
+	host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "200"}})
+	host.HttpFilterPutResponseBodyEndOfStream(id, []byte("response"), true)
+	assert.Equal(t, 0, host.HttpFilterGetStreamDoneCount(id))
+
+	host.HttpFilterCompleteHttpStream(id)
+	assert.Equal(t, 1, host.HttpFilterGetStreamDoneCount(id))
+	assert.Equal(t, 1, done)
+
+	// counted when completed via CompleteContext as well, and only once
+	id = host.HttpFilterInitContext()
+	host.CompleteContext(id)
+	host.HttpFilterCompleteHttpStream(id)
+	assert.Equal(t, 1, host.HttpFilterGetStreamDoneCount(id))
+	assert.Equal(t, 2, done)
+}
+
+type typedFilterStateContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *typedFilterStateContext) OnHttpRequestHeaders(int, bool) types.Action {
+	tenant, err := proxywasm.GetHttpRequestHeader("x-tenant")
+	if err != nil {
+		return types.ActionContinue
+	}
+
+	// google.protobuf.StringValue{value: tenant}
+	value := append([]byte{0x0a, byte(len(tenant))}, tenant...)
+	if err := proxywasm.SetTypedFilterState("tenant",
+		"type.googleapis.com/google.protobuf.StringValue", value); err != nil {
+		proxywasm.LogCriticalf("failed to set filter state: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func (ctx *typedFilterStateContext) OnHttpResponseHeaders(int, bool) types.Action {
+	typeURL, value, err := proxywasm.GetTypedFilterState("tenant")
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get filter state: %v", err)
+		return types.ActionContinue
+	}
+	proxywasm.LogInfof("%s: %q", typeURL, string(value))
+	return types.ActionContinue
+}
+
+func TestHttpFilter_TypedFilterState(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &typedFilterStateContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{"x-tenant", "acme"}})
+	host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "200"}})
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{`type.googleapis.com/google.protobuf.StringValue: "\n\x04acme"`},
+		host.GetLogs(types.LogLevelInfo))
+
+	typeURL, value, ok := host.GetTypedFilterState("tenant")
+	require.True(t, ok)
+	assert.Equal(t, "type.googleapis.com/google.protobuf.StringValue", typeURL)
+	assert.Equal(t, []byte("\n\x04acme"), value)
+
+	_, _, ok = host.GetTypedFilterState("unknown")
+	assert.False(t, ok)
+}
+
+func TestHttpFilter_SeedTypedFilterState(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &typedFilterStateContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	// set by a preceding filter for the requests without x-tenant
+	host.SetTypedFilterState("tenant", "type.googleapis.com/google.protobuf.StringValue", []byte("\n\x05other"))
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, nil)
+	host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "200"}})
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{`type.googleapis.com/google.protobuf.StringValue: "\n\x05other"`},
+		host.GetLogs(types.LogLevelInfo))
+}
+
+type headerScanningContext struct {
+	proxywasm.DefaultHttpContext
+	found int
+}
+
+func (ctx *headerScanningContext) OnHttpRequestHeaders(int, bool) types.Action {
+	headers, err := proxywasm.GetHttpRequestHeaders()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get request headers: %v", err)
+		return types.ActionContinue
+	}
+	for _, h := range headers {
+		if strings.HasPrefix(h[0], "x-synthetic-") {
+			ctx.found++
+		}
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_PutRequestHeadersN(t *testing.T) {
+	ctx := &headerScanningContext{}
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return ctx })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeadersN(id, 100)
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, 100, ctx.found)
+	headers := host.HttpFilterGetRequestHeaders(id)
+	require.Len(t, headers, 100)
+	assert.Equal(t, [2]string{"x-synthetic-99", "value-99"}, headers[99])
+}
+
+func BenchmarkHttpFilter_PutRequestHeadersN(b *testing.B) {
+	for _, n := range []int{10, 100, 1000} {
+		b.Run(fmt.Sprintf("headers=%d", n), func(b *testing.B) {
+			opt := NewEmulatorOption().
+				WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &headerScanningContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				id := host.HttpFilterInitContext()
+				host.HttpFilterPutRequestHeadersN(id, n)
+				host.HttpFilterCompleteHttpStream(id)
+			}
+		})
+	}
+}
+
+type queryParameterContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *queryParameterContext) OnHttpRequestHeaders(int, bool) types.Action {
+	params, err := proxywasm.GetHttpRequestQueryParameters()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get query parameters: %v", err)
+		return types.ActionContinue
+	}
+	proxywasm.LogInfof("tags: %v", params["tag"])
+
+	for _, name := range []string{"q", "empty", "missing"} {
+		value, ok, err := proxywasm.GetHttpRequestQueryParameter(name)
+		if err != nil {
+			proxywasm.LogCriticalf("failed to get query parameter: %v", err)
+			return types.ActionContinue
+		}
+		proxywasm.LogInfof("%s: %q (%t)", name, value, ok)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_GetHttpRequestQueryParameters(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		path string
+		exp  []string
+	}{
+		{
+			name: "encoded and repeated",
+			path: "/search?q=hello%20world%26more&tag=a&tag=b+c&empty=#fragment",
+			exp:  []string{"tags: [a b c]", `q: "hello world&more" (true)`, `empty: "" (true)`, `missing: "" (false)`},
+		},
+		{
+			name: "no query",
+			path: "/search",
+			exp:  []string{"tags: []", `q: "" (false)`, `empty: "" (false)`, `missing: "" (false)`},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opt := NewEmulatorOption().
+				WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &queryParameterContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutRequestHeaders(id, [][2]string{{":path", c.path}})
+
+			require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+			assert.Equal(t, c.exp, host.GetLogs(types.LogLevelInfo))
+		})
+	}
+
+	t.Run("invalid escape", func(t *testing.T) {
+		opt := NewEmulatorOption().
+			WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &queryParameterContext{} })
+		host := NewHostEmulator(opt)
+		defer host.Done()
+
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestHeaders(id, [][2]string{{":path", "/search?q=%zz"}})
+
+		assert.Equal(t, []string{`failed to get query parameters: invalid URL escape "%zz"`},
+			host.GetLogs(types.LogLevelCritical))
+	})
+}
+
+type localReplyContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *localReplyContext) OnHttpRequestHeaders(int, bool) types.Action {
+	proxywasm.SendHttpResponse(403, [][2]string{{"content-type", "text/plain"}}, "denied")
+	return types.ActionPause
+}
+
+func (ctx *localReplyContext) OnHttpResponseHeaders(int, bool) types.Action {
+	proxywasm.LogInfo("response headers")
+	return types.ActionContinue
+}
+
+func (ctx *localReplyContext) OnHttpResponseBody(int, bool) types.Action {
+	proxywasm.LogInfo("response body")
+	return types.ActionContinue
+}
+
+func TestHttpFilter_LocalReplySkipsUpstreamResponse(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &localReplyContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{":path", "/admin"}})
+	require.Equal(t, types.ActionPause, host.HttpFilterGetCurrentStreamAction(id))
+
+	host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "200"}})
+	host.HttpFilterPutResponseBodyEndOfStream(id, []byte("upstream"), true)
+	host.HttpFilterPutResponseTrailers(id, nil)
+
+	assert.Len(t, host.GetLogs(types.LogLevelInfo), 0)
+	assert.Nil(t, host.HttpFilterGetResponseBody(id))
+	res := host.HttpFilterGetSentLocalResponse(id)
+	require.NotNil(t, res)
+	assert.Equal(t, uint32(403), res.StatusCode)
+	assert.Equal(t, []byte("denied"), res.Data)
+}
+
+type setCookieContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *setCookieContext) OnHttpResponseHeaders(int, bool) types.Action {
+	for _, cookie := range []string{"session=abc; HttpOnly", "theme=dark; Path=/"} {
+		if err := proxywasm.AddHttpResponseHeader("set-cookie", cookie); err != nil {
+			proxywasm.LogCriticalf("failed to add set-cookie: %v", err)
+		}
+	}
+
+	headers, err := proxywasm.GetHttpResponseHeaders()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get response headers: %v", err)
+		return types.ActionContinue
+	}
+	for _, h := range headers {
+		if h[0] == "set-cookie" {
+			proxywasm.LogInfo(h[1])
+		}
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_AddMultipleSetCookies(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &setCookieContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "200"}, {"set-cookie", "upstream=1"}})
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{"upstream=1", "session=abc; HttpOnly", "theme=dark; Path=/"}, host.GetLogs(types.LogLevelInfo))
+	assert.Equal(t, [][2]string{
+		{":status", "200"},
+		{"set-cookie", "upstream=1"},
+		{"set-cookie", "session=abc; HttpOnly"},
+		{"set-cookie", "theme=dark; Path=/"},
+	}, host.HttpFilterGetResponseHeaders(id))
+}
+
+type securityHeadersContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *securityHeadersContext) OnHttpResponseHeaders(int, bool) types.Action {
+	for _, err := range []error{
+		proxywasm.RemoveHttpResponseHeader("server"),
+		proxywasm.SetHttpResponseHeader("x-frame-options", "DENY"),
+		proxywasm.AddHttpResponseHeader("strict-transport-security", "max-age=31536000"),
+	} {
+		if err != nil {
+			proxywasm.LogCriticalf("failed to rewrite response headers: %v", err)
+		}
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_GetOriginalResponseHeaders(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &securityHeadersContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutResponseHeaders(id, [][2]string{
+		{":status", "200"}, {"server", "envoy"}, {"x-frame-options", "SAMEORIGIN"},
+	})
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, [][2]string{
+		{":status", "200"}, {"server", "envoy"}, {"x-frame-options", "SAMEORIGIN"},
+	}, host.HttpFilterGetOriginalResponseHeaders(id))
+	assert.Equal(t, [][2]string{
+		{":status", "200"}, {"x-frame-options", "DENY"}, {"strict-transport-security", "max-age=31536000"},
+	}, host.HttpFilterGetResponseHeaders(id))
+}
+
+type resumeOnBodyContext struct {
+	proxywasm.DefaultHttpContext
+	chunks int
+}
+
+func (ctx *resumeOnBodyContext) OnHttpRequestHeaders(int, bool) types.Action {
+	return types.ActionPause
+}
+
+func (ctx *resumeOnBodyContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.Action {
+	ctx.chunks++
+	proxywasm.LogInfof("chunk %d: body size %d", ctx.chunks, bodySize)
+	if ctx.chunks != 2 {
+		if ctx.chunks < 2 {
+			return types.ActionPause
+		}
+		return types.ActionContinue
+	}
+
+	// resume the request paused at headers once enough body is buffered
+	if err := proxywasm.ResumeHttpRequest(); err != nil {
+		proxywasm.LogCriticalf("failed to resume request: %v", err)
+	}
+	return types.ActionPause
+}
+
+func TestHttpFilter_ResumeOnRequestBody(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &resumeOnBodyContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{":method", "POST"}})
+	require.Equal(t, types.ActionPause, host.HttpFilterGetCurrentStreamAction(id))
+
+	host.HttpFilterPutRequestBodyEndOfStream(id, []byte("aaa"), false)
+	require.Equal(t, types.ActionPause, host.HttpFilterGetCurrentStreamAction(id))
+	assert.Len(t, host.HttpFilterGetForwardedRequestBodyChunks(id), 0)
+
+	host.HttpFilterPutRequestBodyEndOfStream(id, []byte("bbb"), false)
+	require.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+
+	host.HttpFilterPutRequestBodyEndOfStream(id, []byte("cc"), true)
+	require.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{"chunk 1: body size 3", "chunk 2: body size 6", "chunk 3: body size 2"},
+		host.GetLogs(types.LogLevelInfo))
+	forwarded := host.HttpFilterGetForwardedRequestBodyChunks(id)
+	require.Len(t, forwarded, 2)
+	assert.Equal(t, "aaabbb", string(forwarded[0]))
+	assert.Equal(t, "cc", string(forwarded[1]))
+	// the pause returned along with the resume is recorded as is
+	assert.Equal(t, []PhaseAction{
+		{Phase: PhaseRequestHeaders, Action: types.ActionPause},
+		{Phase: PhaseRequestBody, Action: types.ActionPause},
+		{Phase: PhaseRequestBody, Action: types.ActionPause},
+		{Phase: PhaseRequestResumed, Action: types.ActionContinue},
+		{Phase: PhaseRequestBody, Action: types.ActionContinue},
+	}, host.HttpFilterGetActions(id))
+}
+
+type stopIterationContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *stopIterationContext) OnHttpRequestHeaders(int, bool) types.Action {
+	if _, err := proxywasm.GetHttpRequestHeader("authorization"); err == nil {
+		return types.ActionContinue
+	}
+
+	// stop the iteration until the token is fetched
+	if _, err := proxywasm.DispatchHttpCall("token-server", [][2]string{
+		{":method", "GET"}, {":path", "/token"}, {":authority", "token-server"},
+	}, "", nil, 1000, func(int, int, int) {
+		if err := proxywasm.SetHttpRequestHeader("authorization", "Bearer token"); err != nil {
+			proxywasm.LogCriticalf("failed to set authorization: %v", err)
+		}
+		if err := proxywasm.ResumeHttpRequest(); err != nil {
+			proxywasm.LogCriticalf("failed to resume request: %v", err)
+		}
+	}); err != nil {
+		proxywasm.LogCriticalf("failed to dispatch http call: %v", err)
+		return types.ActionContinue
+	}
+	return types.ActionPause
+}
+
+func TestHttpFilter_StopIteration(t *testing.T) {
+	t.Run("continue", func(t *testing.T) {
+		opt := NewEmulatorOption().
+			WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &stopIterationContext{} })
+		host := NewHostEmulator(opt)
+		defer host.Done()
+
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestHeaders(id, [][2]string{{"authorization", "Bearer given"}})
+
+		assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+		assert.Len(t, host.GetCalloutAttributesFromContext(id), 0)
+	})
+
+	t.Run("stop iteration", func(t *testing.T) {
+		opt := NewEmulatorOption().
+			WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &stopIterationContext{} })
+		host := NewHostEmulator(opt)
+		defer host.Done()
+
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestHeaders(id, nil)
+		assert.Equal(t, types.ActionPause, host.HttpFilterGetCurrentStreamAction(id))
+
+		attrs := host.GetCalloutAttributesFromContext(id)
+		require.Len(t, attrs, 1)
+		host.PutCalloutResponse(attrs[0].CalloutID, [][2]string{{":status", "200"}}, nil, nil)
+
+		require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+		assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+		assert.Equal(t, [][2]string{{"authorization", "Bearer token"}}, host.HttpFilterGetRequestHeaders(id))
+	})
+}
+
+type calloutBodyContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *calloutBodyContext) OnHttpRequestHeaders(int, bool) types.Action {
+	if _, err := proxywasm.DispatchHttpCall("policy-server", [][2]string{
+		{":method", "GET"}, {":path", "/policy"}, {":authority", "policy-server"},
+	}, "", nil, 1000, func(_, bodySize, _ int) {
+		headers, err := proxywasm.GetHttpCallResponseHeaders()
+		if err != nil {
+			proxywasm.LogCriticalf("failed to get response headers: %v", err)
+			return
+		}
+		var contentLength string
+		for _, h := range headers {
+			if h[0] == "content-length" {
+				contentLength = h[1]
+			}
+		}
+		// the body is incomplete if the host truncated it to its buffer limit
+		if contentLength != strconv.Itoa(bodySize) {
+			if status := proxywasm.SendHttpResponse(502, nil, "incomplete policy"); status != types.StatusOK {
+				proxywasm.LogCriticalf("failed to send local response: %v", status)
+			}
+			return
+		}
+		if err := proxywasm.ResumeHttpRequest(); err != nil {
+			proxywasm.LogCriticalf("failed to resume request: %v", err)
+		}
+	}); err != nil {
+		proxywasm.LogCriticalf("failed to dispatch http call: %v", err)
+		return types.ActionContinue
+	}
+	return types.ActionPause
+}
+
+func TestHttpFilter_CalloutBodyLimit(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		limit     int
+		truncated bool
+	}{
+		{name: "unlimited", limit: 0, truncated: false},
+		{name: "within limit", limit: 5, truncated: false},
+		{name: "truncated", limit: 4, truncated: true},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			opt := NewEmulatorOption().
+				WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &calloutBodyContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+			host.SetCalloutBodyLimit(c.limit)
+
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutRequestHeaders(id, nil)
+			attrs := host.GetCalloutAttributesFromContext(id)
+			require.Len(t, attrs, 1)
+
+			host.PutCalloutResponse(attrs[0].CalloutID,
+				[][2]string{{":status", "200"}, {"content-length", "5"}}, nil, []byte("allow"))
+			require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+			assert.Equal(t, c.truncated, host.IsCalloutBodyTruncated(attrs[0].CalloutID))
+
+			if c.truncated {
+				res := host.HttpFilterGetSentLocalResponse(id)
+				require.NotNil(t, res)
+				assert.Equal(t, uint32(502), res.StatusCode)
+			} else {
+				assert.Nil(t, host.HttpFilterGetSentLocalResponse(id))
+				assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+			}
+
+			host.Reset()
+			assert.False(t, host.IsCalloutBodyTruncated(attrs[0].CalloutID))
+		})
+	}
+}
+
+type signingContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *signingContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.Action {
+	if !endOfStream {
+		return types.ActionPause
+	}
+
+	body, err := proxywasm.GetHttpRequestBody(0, bodySize)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get request body: %v", err)
+		return types.ActionContinue
+	}
+	if err := proxywasm.SetHttpRequestHeader("x-body-signature", fmt.Sprintf("%x", sha256.Sum256(body))); err != nil {
+		proxywasm.LogCriticalf("failed to set signature: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_ReplayRequest(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &signingContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{":method", "POST"}, {":path", "/orders"}})
+	host.HttpFilterPutRequestBody(id, []byte("item=1"))
+	host.HttpFilterPutRequestBodyEndOfStream(id, []byte("&count=2"), true)
+	host.HttpFilterCompleteHttpStream(id)
+
+	snapshot := host.HttpFilterGetRequestSnapshot(id)
+	assert.Equal(t, RequestSnapshot{
+		Headers: [][2]string{{":method", "POST"}, {":path", "/orders"}},
+		Body:    []byte("item=1&count=2"),
+	}, snapshot)
+
+	first := host.ReplayRequest(snapshot)
+	second := host.ReplayRequest(snapshot)
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, first, second)
+
+	assert.Equal(t, types.ActionContinue, first.Action)
+	assert.Equal(t, []byte("item=1&count=2"), first.Body)
+	assert.Equal(t, host.HttpFilterGetRequestHeaders(id), first.Headers)
+	assert.Contains(t, first.Headers, [2]string{"x-body-signature", fmt.Sprintf("%x", sha256.Sum256([]byte("item=1&count=2")))})
+	assert.Nil(t, first.LocalResponse)
+}
+
+type redactingContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *redactingContext) OnHttpRequestBody(bodySize int, endOfStream bool) types.Action {
+	if !endOfStream {
+		// buffer the entire body
+		return types.ActionPause
+	}
+
+	body, err := proxywasm.GetHttpRequestBody(0, bodySize)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get request body: %v", err)
+		return types.ActionContinue
+	}
+	if _, err := proxywasm.DispatchHttpCall("redactor", [][2]string{
+		{":method", "POST"}, {":path", "/redact"}, {":authority", "redactor"},
+	}, string(body), nil, 1000, func(_, bodySize, _ int) {
+		redacted, err := proxywasm.GetHttpCallResponseBody(0, bodySize)
+		if err != nil {
+			proxywasm.LogCriticalf("failed to get response body: %v", err)
+			return
+		}
+		if err := proxywasm.SetHttpRequestBody(redacted); err != nil {
+			proxywasm.LogCriticalf("failed to set request body: %v", err)
+			return
+		}
+		if err := proxywasm.ResumeHttpRequest(); err != nil {
+			proxywasm.LogCriticalf("failed to resume request: %v", err)
+		}
+	}); err != nil {
+		proxywasm.LogCriticalf("failed to dispatch http call: %v", err)
+		return types.ActionContinue
+	}
+	return types.ActionPause
+}
+
+func TestHttpFilter_GetForwardedRequestBody(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &redactingContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, nil)
+	host.HttpFilterPutRequestBody(id, []byte("card=4111"))
+	host.HttpFilterPutRequestBodyEndOfStream(id, []byte("1111&name=foo"), true)
+
+	// the entire body is buffered while waiting for the callout
+	assert.Equal(t, types.ActionPause, host.HttpFilterGetCurrentStreamAction(id))
+	assert.Equal(t, []byte("card=41111111&name=foo"), host.HttpFilterGetRequestBody(id))
+	assert.Len(t, host.HttpFilterGetForwardedRequestBody(id), 0)
+
+	attrs := host.GetCalloutAttributesFromContext(id)
+	require.Len(t, attrs, 1)
+	assert.Equal(t, []byte("card=41111111&name=foo"), attrs[0].Body)
+	host.PutCalloutResponse(attrs[0].CalloutID, [][2]string{{":status", "200"}}, nil, []byte("card=****&name=foo"))
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+	assert.Equal(t, []byte("card=****&name=foo"), host.HttpFilterGetForwardedRequestBody(id))
+	assert.Equal(t, [][]byte{[]byte("card=****&name=foo")}, host.HttpFilterGetForwardedRequestBodyChunks(id))
+	// the snapshot keeps the seeded body
+	assert.Equal(t, []byte("card=41111111&name=foo"), host.HttpFilterGetRequestSnapshot(id).Body)
+}
+
+type authorityRewriteContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *authorityRewriteContext) OnHttpRequestHeaders(int, bool) types.Action {
+	before, err := proxywasm.GetRouteName()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get route name: %v", err)
+		return types.ActionContinue
+	}
+
+	if err := proxywasm.SetHttpRequestHeader(":authority", "canary.example.com"); err != nil {
+		proxywasm.LogCriticalf("failed to set authority: %v", err)
+		return types.ActionContinue
+	}
+
+	after, err := proxywasm.GetRouteName()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get route name: %v", err)
+		return types.ActionContinue
+	}
+	proxywasm.LogInfof("rerouted from %s to %s", before, after)
+	return types.ActionContinue
+}
+
+func TestHttpFilter_SetAuthorityRoutes(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &authorityRewriteContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	host.SetAuthorityRoutes(map[string]string{
+		"example.com":        "stable",
+		"canary.example.com": "canary",
+	})
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{":authority", "example.com"}})
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{"rerouted from stable to canary"}, host.GetLogs(types.LogLevelInfo))
+
+	t.Run("fallback to property", func(t *testing.T) {
+		host.Reset()
+		host.SetProperty([]string{"xds", "route_name"}, []byte("default"))
+
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestHeaders(id, [][2]string{{":authority", "unknown.example.com"}})
+
+		require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+		assert.Equal(t, []string{"rerouted from default to canary"}, host.GetLogs(types.LogLevelInfo))
+	})
+}
+
+type bufferingUntilEndContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *bufferingUntilEndContext) OnHttpRequestHeaders(_ int, endOfStream bool) types.Action {
+	if endOfStream {
+		return types.ActionContinue
+	}
+	// wait for the body to decide whether to continue
+	return types.ActionPause
+}
+
+func (ctx *bufferingUntilEndContext) OnHttpRequestBody(_ int, endOfStream bool) types.Action {
+	if !endOfStream {
+		return types.ActionPause
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_GetActions(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &bufferingUntilEndContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{":method", "POST"}})
+	host.HttpFilterPutRequestBody(id, []byte("first"))
+	host.HttpFilterPutRequestBodyEndOfStream(id, []byte("second"), true)
+	host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "200"}})
+
+	require.Equal(t, []PhaseAction{
+		{Phase: PhaseRequestHeaders, Action: types.ActionPause},
+		{Phase: PhaseRequestBody, Action: types.ActionPause},
+		{Phase: PhaseRequestBody, Action: types.ActionContinue},
+		{Phase: PhaseResponseHeaders, Action: types.ActionContinue},
+	}, host.HttpFilterGetActions(id))
+
+	// replayed in a single body chunk
+	res := host.ReplayRequest(host.HttpFilterGetRequestSnapshot(id))
+	require.Equal(t, []PhaseAction{
+		{Phase: PhaseRequestHeaders, Action: types.ActionPause},
+		{Phase: PhaseRequestBody, Action: types.ActionContinue},
+	}, res.Actions)
+}
+
+type prefixStripContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *prefixStripContext) OnHttpRequestHeaders(int, bool) types.Action {
+	path, err := proxywasm.GetHttpRequestPath()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get path: %v", err)
+		return types.ActionContinue
+	}
+
+	// the stripped path is built in a buffer reused for the other requests
+	buf := []byte(strings.TrimPrefix(path, "/api"))
+	if err := proxywasm.SetHttpRequestPath(*(*string)(unsafe.Pointer(&buf))); err != nil {
+		proxywasm.LogCriticalf("failed to set path: %v", err)
+		return types.ActionContinue
+	}
+	copy(buf, "/xxxxxxxx")
+
+	stripped, err := proxywasm.GetHttpRequestPath()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get path: %v", err)
+		return types.ActionContinue
+	}
+	version, _, err := proxywasm.GetHttpRequestQueryParameter("version")
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get query parameter: %v", err)
+		return types.ActionContinue
+	}
+	proxywasm.LogInfof("path: %s, version: %s", stripped, version)
+	return types.ActionContinue
+}
+
+func TestHttpFilter_SetHttpRequestPath(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &prefixStripContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{":method", "GET"}, {":path", "/api/users?version=2"}})
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{"path: /users?version=2, version: 2"}, host.GetLogs(types.LogLevelInfo))
+	assert.Equal(t, [][2]string{{":method", "GET"}, {":path", "/users?version=2"}}, host.HttpFilterGetRequestHeaders(id))
+}
+
+type grpcStatusContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *grpcStatusContext) logGrpcStatus() {
+	status, err := proxywasm.GetGrpcStatus()
+	if err != nil {
+		proxywasm.LogWarnf("failed to get grpc status: %v", err)
+		return
+	}
+	proxywasm.LogInfof("grpc status: %s", status)
+}
+
+func (ctx *grpcStatusContext) OnHttpResponseHeaders(_ int, endOfStream bool) types.Action {
+	if endOfStream {
+		// trailers-only response
+		ctx.logGrpcStatus()
+	}
+	return types.ActionContinue
+}
+
+func (ctx *grpcStatusContext) OnHttpResponseTrailers(int) types.Action {
+	ctx.logGrpcStatus()
+	return types.ActionContinue
+}
+
+func TestHttpFilter_GetGrpcStatus(t *testing.T) {
+	for _, c := range []struct {
+		name              string
+		headers, trailers [][2]string
+		exp               []string
+	}{
+		{
+			name:     "trailers",
+			headers:  [][2]string{{":status", "200"}, {"content-type", "application/grpc"}},
+			trailers: [][2]string{{"grpc-status", "5"}, {"grpc-message", "not found"}},
+			exp:      []string{"grpc status: NotFound"},
+		},
+		{
+			name:    "trailers-only",
+			headers: [][2]string{{":status", "200"}, {"content-type", "application/grpc"}, {"grpc-status", "7"}},
+			exp:     []string{"grpc status: PermissionDenied"},
+		},
+		{
+			name:     "trailers take precedence",
+			headers:  [][2]string{{":status", "200"}, {"grpc-status", "0"}},
+			trailers: [][2]string{{"grpc-status", "14"}},
+			exp:      []string{"grpc status: Unavailable"},
+		},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			opt := NewEmulatorOption().
+				WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &grpcStatusContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutRequestHeaders(id, [][2]string{{":method", "POST"}})
+			host.HttpFilterPutResponseHeadersEndOfStream(id, c.headers, c.trailers == nil)
+			if c.trailers != nil {
+				host.HttpFilterPutResponseTrailers(id, c.trailers)
+			}
+
+			require.Len(t, host.GetLogs(types.LogLevelWarn), 0)
+			assert.Equal(t, c.exp, host.GetLogs(types.LogLevelInfo))
+		})
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		opt := NewEmulatorOption().
+			WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &grpcStatusContext{} })
+		host := NewHostEmulator(opt)
+		defer host.Done()
+
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutResponseHeadersEndOfStream(id, [][2]string{{":status", "503"}}, true)
+		assert.Equal(t, []string{"failed to get grpc status: error status returned by host: not found"},
+			host.GetLogs(types.LogLevelWarn))
+	})
+}
+
+type cacheStatusContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *cacheStatusContext) OnHttpResponseHeaders(int, bool) types.Action {
+	status, err := proxywasm.GetHttpResponseHeader(":status")
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get status: %v", err)
+		return types.ActionContinue
+	}
+	if status == "200" {
+		if err := proxywasm.AddHttpResponseHeader("x-cacheable", "true"); err != nil {
+			proxywasm.LogCriticalf("failed to add header: %v", err)
+		}
+	}
+	return types.ActionContinue
+}
+
+func (ctx *cacheStatusContext) OnHttpResponseBody(bodySize int, endOfStream bool) types.Action {
+	if !endOfStream {
+		return types.ActionPause
+	}
+
+	// the header added in the headers phase is read back in the body phase
+	if _, err := proxywasm.GetHttpResponseHeader("x-cacheable"); err != nil {
+		proxywasm.LogInfof("not cached: %v", err)
+		return types.ActionContinue
+	}
+	body, err := proxywasm.GetHttpResponseBody(0, bodySize)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get body: %v", err)
+		return types.ActionContinue
+	}
+	if err := proxywasm.SetSharedData("cache", body, 0); err != nil {
+		proxywasm.LogCriticalf("failed to set shared data: %v", err)
+	}
+	proxywasm.LogInfo("cached")
+	return types.ActionContinue
+}
+
+func TestHttpFilter_ReadResponseHeadersInBodyPhase(t *testing.T) {
+	for _, c := range []struct {
+		status string
+		exp    []string
+	}{
+		{status: "200", exp: []string{"cached"}},
+		{status: "500", exp: []string{"not cached: error status returned by host: not found"}},
+	} {
+		c := c
+		t.Run(c.status, func(t *testing.T) {
+			opt := NewEmulatorOption().
+				WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &cacheStatusContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", c.status}})
+			host.HttpFilterPutResponseBody(id, []byte("hello "))
+			host.HttpFilterPutResponseBodyEndOfStream(id, []byte("world"), true)
+
+			require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+			assert.Equal(t, c.exp, host.GetLogs(types.LogLevelInfo))
+			if c.status == "200" {
+				cached, _, err := proxywasm.GetSharedData("cache")
+				require.NoError(t, err)
+				assert.Equal(t, []byte("hello world"), cached)
+				assert.Equal(t, [][2]string{{":status", "200"}, {"x-cacheable", "true"}}, host.HttpFilterGetResponseHeaders(id))
+			}
+		})
+	}
+}
+
+type requestTrailersContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *requestTrailersContext) OnHttpRequestTrailers(int) types.Action {
+	trailers, err := proxywasm.GetHttpRequestTrailers()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get request trailers: %v", err)
+		return types.ActionContinue
+	}
+	for _, t := range trailers {
+		proxywasm.LogInfof("%s: %s", t[0], t[1])
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_SetRequestTrailers(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &requestTrailersContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{":method", "POST"}})
+	host.HttpFilterPutRequestBody(id, []byte("data"))
+
+	// added by the prior filter
+	host.HttpFilterSetRequestTrailers(id, [][2]string{{"x-checksum", "abcd"}})
+	assert.Len(t, host.GetLogs(types.LogLevelInfo), 0)
+
+	host.HttpFilterPutRequestTrailers(id, [][2]string{{"x-client-trailer", "1"}})
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{"x-client-trailer: 1", "x-checksum: abcd"}, host.GetLogs(types.LogLevelInfo))
+}
+
+type degenerateInputContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *degenerateInputContext) read(phase string, getMap func() ([][2]string, error),
+	getValue func(string) (string, error), getBody func(int, int) ([]byte, error)) {
+	if getMap != nil {
+		m, err := getMap()
+		if err != nil {
+			proxywasm.LogCriticalf("%s: failed to get map: %v", phase, err)
+		}
+		v, err := getValue("x-empty")
+		if err != nil && err != types.ErrorStatusNotFound {
+			proxywasm.LogCriticalf("%s: failed to get value: %v", phase, err)
+		}
+		proxywasm.LogInfof("%s: %d pairs, x-empty=%q", phase, len(m), v)
+	}
+	if getBody != nil {
+		body, err := getBody(0, 1024)
+		if err != nil {
+			proxywasm.LogCriticalf("%s: failed to get body: %v", phase, err)
+		}
+		proxywasm.LogInfof("%s: %d bytes", phase, len(body))
+	}
+}
+
+func (ctx *degenerateInputContext) OnHttpRequestHeaders(int, bool) types.Action {
+	ctx.read("request headers", proxywasm.GetHttpRequestHeaders, proxywasm.GetHttpRequestHeader, nil)
+	return types.ActionContinue
+}
+
+func (ctx *degenerateInputContext) OnHttpRequestBody(int, bool) types.Action {
+	ctx.read("request body", nil, nil, proxywasm.GetHttpRequestBody)
+	return types.ActionContinue
+}
+
+func (ctx *degenerateInputContext) OnHttpRequestTrailers(int) types.Action {
+	ctx.read("request trailers", proxywasm.GetHttpRequestTrailers, proxywasm.GetHttpRequestTrailer, nil)
+	return types.ActionContinue
+}
+
+func (ctx *degenerateInputContext) OnHttpResponseHeaders(int, bool) types.Action {
+	ctx.read("response headers", proxywasm.GetHttpResponseHeaders, proxywasm.GetHttpResponseHeader, nil)
+	return types.ActionContinue
+}
+
+func (ctx *degenerateInputContext) OnHttpResponseBody(int, bool) types.Action {
+	ctx.read("response body", nil, nil, proxywasm.GetHttpResponseBody)
+	return types.ActionContinue
+}
+
+func (ctx *degenerateInputContext) OnHttpResponseTrailers(int) types.Action {
+	ctx.read("response trailers", proxywasm.GetHttpResponseTrailers, proxywasm.GetHttpResponseTrailer, nil)
+	return types.ActionContinue
+}
+
+func TestHttpFilter_DegenerateInputs(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		headers  [][2]string
+		body     []byte
+		trailers [][2]string
+		expValue string
+		expPairs int
+	}{
+		{name: "nil"},
+		{name: "empty", headers: [][2]string{}, body: []byte{}, trailers: [][2]string{}},
+		{name: "empty value", headers: [][2]string{{"x-empty", ""}}, body: []byte{}, trailers: [][2]string{{"x-empty", ""}},
+			expPairs: 1},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			opt := NewEmulatorOption().
+				WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &degenerateInputContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			id := host.HttpFilterInitContext()
+			require.NotPanics(t, func() {
+				host.HttpFilterPutRequestHeaders(id, c.headers)
+				assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+				host.HttpFilterPutRequestBody(id, c.body)
+				assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+				host.HttpFilterPutRequestTrailers(id, c.trailers)
+				assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+				host.HttpFilterPutResponseHeaders(id, c.headers)
+				assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+				host.HttpFilterPutResponseBody(id, c.body)
+				assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+				host.HttpFilterPutResponseTrailers(id, c.trailers)
+				assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+				host.HttpFilterCompleteHttpStream(id)
+			})
+
+			assert.Len(t, host.GetLogs(types.LogLevelCritical), 0, host.GetLogs(types.LogLevelCritical))
+			assert.Equal(t, []string{
+				fmt.Sprintf("request headers: %d pairs, x-empty=\"\"", c.expPairs),
+				"request body: 0 bytes",
+				fmt.Sprintf("request trailers: %d pairs, x-empty=\"\"", c.expPairs),
+				fmt.Sprintf("response headers: %d pairs, x-empty=\"\"", c.expPairs),
+				"response body: 0 bytes",
+				fmt.Sprintf("response trailers: %d pairs, x-empty=\"\"", c.expPairs),
+			}, host.GetLogs(types.LogLevelInfo))
+		})
+	}
+}
+
+type responseHeaderLimitContext struct {
+	proxywasm.DefaultHttpContext
+	max int
+}
+
+func (ctx *responseHeaderLimitContext) OnHttpResponseHeaders(numHeaders int, _ bool) types.Action {
+	if numHeaders <= ctx.max {
+		return types.ActionContinue
+	}
+
+	headers, err := proxywasm.GetHttpResponseHeaders()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get response headers: %v", err)
+		return types.ActionContinue
+	}
+	for _, h := range headers[ctx.max:] {
+		if err := proxywasm.RemoveHttpResponseHeader(h[0]); err != nil {
+			proxywasm.LogCriticalf("failed to remove response header: %v", err)
+		}
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_GetResponseHeaderCount(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &responseHeaderLimitContext{max: 3} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	for _, c := range []struct {
+		name    string
+		headers [][2]string
+		exp     int
+	}{
+		{name: "under limit", headers: [][2]string{{":status", "200"}, {"x-a", "1"}}, exp: 2},
+		{name: "over limit", headers: [][2]string{
+			{":status", "200"}, {"x-a", "1"}, {"x-b", "2"}, {"x-c", "3"}, {"x-d", "4"},
+		}, exp: 3},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutResponseHeaders(id, c.headers)
+			require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+			assert.Equal(t, c.exp, host.HttpFilterGetResponseHeaderCount(id))
+			assert.Len(t, host.HttpFilterGetOriginalResponseHeaders(id), len(c.headers))
+		})
+	}
+}
+
+type upstreamLatencyContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *upstreamLatencyContext) OnHttpResponseHeaders(int, bool) types.Action {
+	d, err := proxywasm.GetDurationProperty([]string{"response", "duration"})
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get response duration: %v", err)
+		return types.ActionContinue
+	}
+	if err := proxywasm.AddHttpResponseHeader("x-upstream-latency", strconv.FormatInt(d.Milliseconds(), 10)); err != nil {
+		proxywasm.LogCriticalf("failed to add response header: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_SetDurationProperty(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &upstreamLatencyContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	t.Run("seeded", func(t *testing.T) {
+		host.SetDurationProperty([]string{"response", "duration"}, 1234567*time.Microsecond)
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "200"}})
+		require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+		assert.Equal(t, [][2]string{{":status", "200"}, {"x-upstream-latency", "1234"}}, host.HttpFilterGetResponseHeaders(id))
+	})
+
+	t.Run("invalid encoding", func(t *testing.T) {
+		host.SetProperty([]string{"response", "duration"}, []byte("1234ms"))
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "200"}})
+		assert.Equal(t, []string{"failed to get response duration: response.duration: invalid size of integer property: 6"},
+			host.GetLogs(types.LogLevelCritical))
+	})
+}
+
+type responseFlowContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *responseFlowContext) OnHttpResponseHeaders(int, bool) types.Action {
+	if err := proxywasm.AddHttpResponseHeader("x-filtered", "true"); err != nil {
+		proxywasm.LogCriticalf("failed to add response header: %v", err)
+	}
+	if err := proxywasm.RemoveHttpResponseHeader("content-length"); err != nil {
+		proxywasm.LogCriticalf("failed to remove response header: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func (ctx *responseFlowContext) OnHttpResponseBody(_ int, endOfStream bool) types.Action {
+	if !endOfStream {
+		return types.ActionPause
+	}
+	body, err := proxywasm.GetHttpResponseBody(0, math.MaxInt32)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get response body: %v", err)
+		return types.ActionContinue
+	}
+	if err := proxywasm.SetHttpResponseBody(bytes.ToUpper(body)); err != nil {
+		proxywasm.LogCriticalf("failed to set response body: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func (ctx *responseFlowContext) OnHttpResponseTrailers(int) types.Action {
+	if err := proxywasm.SetHttpResponseTrailer("grpc-message", "done"); err != nil {
+		proxywasm.LogCriticalf("failed to set response trailer: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_ResponseFlow(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &responseFlowContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "200"}, {"content-length", "11"}})
+	assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+	assert.Equal(t, [][2]string{{":status", "200"}, {"x-filtered", "true"}}, host.HttpFilterGetResponseHeaders(id))
+
+	host.HttpFilterPutResponseBodyEndOfStream(id, []byte("hello "), false)
+	assert.Equal(t, types.ActionPause, host.HttpFilterGetCurrentStreamAction(id))
+	assert.Len(t, host.HttpFilterGetForwardedResponseBody(id), 0)
+
+	host.HttpFilterPutResponseBodyEndOfStream(id, []byte("world"), true)
+	assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+	assert.Equal(t, []byte("HELLO WORLD"), host.HttpFilterGetForwardedResponseBody(id))
+
+	host.HttpFilterPutResponseTrailers(id, [][2]string{{"grpc-status", "0"}, {"grpc-message", "ok"}})
+	assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+	assert.Equal(t, [][2]string{{"grpc-status", "0"}, {"grpc-message", "done"}}, host.HttpFilterGetResponseTrailers(id))
+
+	host.HttpFilterCompleteHttpStream(id)
+	assert.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+}
+
+type duplicatedHeaderContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *duplicatedHeaderContext) OnHttpRequestHeaders(int, bool) types.Action {
+	for _, err := range []error{
+		proxywasm.AddHttpRequestHeader("x-tag", "b"),
+		proxywasm.AddHttpRequestHeader("x-forwarded-for", "10.0.0.2"),
+		proxywasm.SetHttpRequestHeader("x-tag", "c"),
+		proxywasm.RemoveHttpRequestHeader("x-forwarded-for"),
+	} {
+		if err != nil {
+			proxywasm.LogCriticalf("failed to modify request headers: %v", err)
+		}
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_DuplicatedHeaders(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &duplicatedHeaderContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{
+		{":path", "/"}, {"x-tag", "a"}, {"x-forwarded-for", "10.0.0.1"}, {"accept", "*/*"},
+	})
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+
+	// the duplicated x-tag is collapsed into one and all the x-forwarded-for are removed
+	assert.Equal(t, [][2]string{{":path", "/"}, {"x-tag", "c"}, {"accept", "*/*"}}, host.HttpFilterGetRequestHeaders(id))
+}
+
+type protocolContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *protocolContext) OnHttpRequestHeaders(int, bool) types.Action {
+	protocol, err := proxywasm.GetHttpRequestProtocol()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get request protocol: %v", err)
+		return types.ActionContinue
+	}
+
+	var key string
+	switch protocol {
+	case "HTTP/2":
+		key = ":authority"
+	default:
+		key = "host"
+	}
+	authority, err := proxywasm.GetHttpRequestHeader(key)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get %s: %v", key, err)
+		return types.ActionContinue
+	}
+	proxywasm.LogInfof("%s %s", protocol, authority)
+	return types.ActionContinue
+}
+
+func TestHttpFilter_SetHttpRequestProtocol(t *testing.T) {
+	for _, c := range []struct {
+		protocol string
+		headers  [][2]string
+	}{
+		{protocol: "HTTP/1.1", headers: [][2]string{{"host", "example.com"}}},
+		{protocol: "HTTP/2", headers: [][2]string{{":authority", "example.com"}}},
+	} {
+		c := c
+		t.Run(c.protocol, func(t *testing.T) {
+			opt := NewEmulatorOption().
+				WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &protocolContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			host.SetHttpRequestProtocol(c.protocol)
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutRequestHeaders(id, c.headers)
+
+			require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+			assert.Equal(t, []string{c.protocol + " example.com"}, host.GetLogs(types.LogLevelInfo))
+		})
+	}
+}
+
+type authorizingContext struct {
+	proxywasm.DefaultHttpContext
+	authorized bool
+}
+
+func (ctx *authorizingContext) OnHttpRequestHeaders(int, bool) types.Action {
+	if _, err := proxywasm.DispatchHttpCall("authz", [][2]string{
+		{":method", "GET"}, {":path", "/check"}, {":authority", "authz"},
+	}, "", nil, 1000, func(int, int, int) {
+		ctx.authorized = true
+		if err := proxywasm.ResumeHttpRequest(); err != nil {
+			proxywasm.LogCriticalf("failed to resume request: %v", err)
+		}
+	}); err != nil {
+		proxywasm.LogCriticalf("failed to dispatch http call: %v", err)
+		return types.ActionContinue
+	}
+	return types.ActionPause
+}
+
+func (ctx *authorizingContext) OnHttpRequestBody(int, bool) types.Action {
+	if !ctx.authorized {
+		return types.ActionPause
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_ResumeHttpRequest(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &authorizingContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{":method", "POST"}})
+	assert.Equal(t, types.ActionPause, host.HttpFilterGetCurrentStreamAction(id))
+	host.HttpFilterPutRequestBodyEndOfStream(id, []byte("payload"), false)
+	assert.Equal(t, types.ActionPause, host.HttpFilterGetCurrentStreamAction(id))
+	assert.Len(t, host.HttpFilterGetForwardedRequestBody(id), 0)
+
+	attrs := host.GetCalloutAttributesFromContext(id)
+	require.Len(t, attrs, 1)
+	host.PutCalloutResponse(attrs[0].CalloutID, [][2]string{{":status", "200"}}, nil, nil)
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+
+	// the body buffered during the pause is flushed on resume
+	assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+	assert.Equal(t, []byte("payload"), host.HttpFilterGetForwardedRequestBody(id))
+	assert.Equal(t, []PhaseAction{
+		{Phase: PhaseRequestHeaders, Action: types.ActionPause},
+		{Phase: PhaseRequestBody, Action: types.ActionPause},
+		{Phase: PhaseRequestResumed, Action: types.ActionContinue},
+	}, host.HttpFilterGetActions(id))
+
+	host.HttpFilterPutRequestBodyEndOfStream(id, []byte("rest"), true)
+	assert.Equal(t, []byte("payloadrest"), host.HttpFilterGetForwardedRequestBody(id))
+}
+
+type rateLimitContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *rateLimitContext) OnHttpRequestHeaders(int, bool) types.Action {
+	proxywasm.SendHttpResponse(429, [][2]string{{"retry-after", "30"}}, "too many requests")
+	return types.ActionPause
+}
+
+func (ctx *rateLimitContext) OnHttpRequestBody(int, bool) types.Action {
+	proxywasm.LogInfo("request body")
+	return types.ActionContinue
+}
+
+func (ctx *rateLimitContext) OnHttpRequestTrailers(int) types.Action {
+	proxywasm.LogInfo("request trailers")
+	return types.ActionContinue
+}
+
+func (ctx *rateLimitContext) OnHttpResponseHeaders(int, bool) types.Action {
+	proxywasm.LogInfo("response headers")
+	return types.ActionContinue
+}
+
+func TestHttpFilter_LocalResponseShortCircuit(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &rateLimitContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	assert.Nil(t, host.HttpFilterGetSentLocalResponse(id))
+
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{":method", "POST"}})
+	host.HttpFilterPutRequestBody(id, []byte("body"))
+	host.HttpFilterPutRequestTrailers(id, [][2]string{{"x-trailer", "1"}})
+	host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "200"}})
+	host.HttpFilterCompleteHttpStream(id)
+
+	res := host.HttpFilterGetSentLocalResponse(id)
+	require.NotNil(t, res)
+	assert.Equal(t, uint32(429), res.StatusCode)
+	assert.Equal(t, [][2]string{{"retry-after", "30"}}, res.Headers)
+	assert.Equal(t, []byte("too many requests"), res.Data)
+	assert.Equal(t, int32(-1), res.GRPCStatus)
+
+	assert.Len(t, host.GetLogs(types.LogLevelInfo), 0)
+	assert.Equal(t, []PhaseAction{{Phase: PhaseRequestHeaders, Action: types.ActionPause}}, host.HttpFilterGetActions(id))
+	assert.Equal(t, 1, host.HttpFilterGetStreamDoneCount(id))
+}
+
+type webSocketSkippingContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *webSocketSkippingContext) OnHttpRequestHeaders(int, bool) types.Action {
+	upgrade, err := proxywasm.IsWebSocketUpgrade()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to check websocket upgrade: %v", err)
+		return types.ActionContinue
+	}
+	if upgrade {
+		proxywasm.LogInfo("skipped")
+		return types.ActionContinue
+	}
+	if err := proxywasm.AddHttpRequestHeader("x-filtered", "true"); err != nil {
+		proxywasm.LogCriticalf("failed to add request header: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_IsWebSocketUpgrade(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		headers [][2]string
+		skipped bool
+	}{
+		{name: "websocket", headers: [][2]string{{"connection", "keep-alive, Upgrade"}, {"upgrade", "WebSocket"}}, skipped: true},
+		{name: "h2c", headers: [][2]string{{"connection", "Upgrade, HTTP2-Settings"}, {"upgrade", "h2c"}}},
+		{name: "no connection", headers: [][2]string{{"upgrade", "websocket"}}},
+		{name: "plain", headers: [][2]string{{":method", "GET"}}},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			opt := NewEmulatorOption().
+				WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &webSocketSkippingContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutRequestHeaders(id, c.headers)
+			require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+
+			headers := host.HttpFilterGetRequestHeaders(id)
+			if c.skipped {
+				assert.Equal(t, []string{"skipped"}, host.GetLogs(types.LogLevelInfo))
+				// the upgrade headers are passed through as-is
+				assert.Equal(t, c.headers, headers)
+			} else {
+				assert.Len(t, host.GetLogs(types.LogLevelInfo), 0)
+				assert.Equal(t, [2]string{"x-filtered", "true"}, headers[len(headers)-1])
+			}
+		})
+	}
+}
+
+type pathRecordingContext struct {
+	proxywasm.DefaultHttpContext
+	path string
+}
+
+func (ctx *pathRecordingContext) OnHttpRequestHeaders(int, bool) types.Action {
+	path, err := proxywasm.GetHttpRequestHeader(":path")
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get :path: %v", err)
+	}
+	ctx.path = path
+	return types.ActionContinue
+}
+
+func (ctx *pathRecordingContext) OnHttpRequestBody(bodySize int, _ bool) types.Action {
+	body, err := proxywasm.GetHttpRequestBody(0, bodySize)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get body: %v", err)
+	}
+	proxywasm.LogInfof("%s: %s", ctx.path, body)
+	return types.ActionContinue
+}
+
+func (ctx *pathRecordingContext) OnHttpResponseHeaders(int, bool) types.Action {
+	if err := proxywasm.SetHttpResponseHeader("x-path", ctx.path); err != nil {
+		proxywasm.LogCriticalf("failed to set x-path: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_ConcurrentStreams(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &pathRecordingContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	first := host.HttpFilterInitContext()
+	second := host.HttpFilterInitContext()
+	require.NotEqual(t, first, second)
+
+	// interleave the phases of the two streams
+	host.HttpFilterPutRequestHeaders(first, [][2]string{{":path", "/first"}, {"x-first", "1"}})
+	host.HttpFilterPutRequestHeaders(second, [][2]string{{":path", "/second"}})
+	host.HttpFilterPutRequestBody(second, []byte("second body"))
+	host.HttpFilterPutRequestBody(first, []byte("first body"))
+	host.HttpFilterPutResponseHeaders(second, [][2]string{{":status", "200"}})
+	host.HttpFilterPutResponseHeaders(first, [][2]string{{":status", "404"}})
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+
+	assert.Equal(t, [][2]string{{":path", "/first"}, {"x-first", "1"}}, host.HttpFilterGetRequestHeaders(first))
+	assert.Equal(t, [][2]string{{":path", "/second"}}, host.HttpFilterGetRequestHeaders(second))
+	assert.Equal(t, []byte("first body"), host.HttpFilterGetRequestBody(first))
+	assert.Equal(t, []byte("second body"), host.HttpFilterGetRequestBody(second))
+	assert.Equal(t, [][2]string{{":status", "404"}, {"x-path", "/first"}}, host.HttpFilterGetResponseHeaders(first))
+	assert.Equal(t, [][2]string{{":status", "200"}, {"x-path", "/second"}}, host.HttpFilterGetResponseHeaders(second))
+	assert.Equal(t, []string{"/second: second body", "/first: first body"}, host.GetLogs(types.LogLevelInfo))
+
+	// completing one stream leaves the other intact
+	host.HttpFilterCompleteHttpStream(first)
+	assert.Equal(t, [][2]string{{":path", "/second"}}, host.HttpFilterGetRequestHeaders(second))
+}
+
+type earlyResponseHeaderContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *earlyResponseHeaderContext) OnHttpRequestHeaders(int, bool) types.Action {
+	if err := proxywasm.SetHttpResponseHeader("x-request-id", "abc"); err != nil {
+		proxywasm.LogWarnf("failed to set response header: %v", err)
+	}
+	if err := proxywasm.AddHttpRequestHeader("x-request-id", "abc"); err != nil {
+		proxywasm.LogCriticalf("failed to add request header: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_HeaderMutationOutOfPhase(t *testing.T) {
+	for _, c := range []struct {
+		name     string
+		opt      *EmulatorOption
+		warnings []string
+	}{
+		{
+			name: "not strict",
+			opt:  NewEmulatorOption(),
+		},
+		{
+			name:     "strict",
+			opt:      NewEmulatorOption().WithStrictMode(),
+			warnings: []string{"failed to set response header: error status returned by host: bad argument"},
+		},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			opt := c.opt.WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext {
+				return &earlyResponseHeaderContext{}
+			})
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutRequestHeaders(id, nil)
+			require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+			assert.Equal(t, c.warnings, host.GetLogs(types.LogLevelWarn))
+			// the request headers can be modified in the request phase even in the strict mode
+			assert.Equal(t, [][2]string{{"x-request-id", "abc"}}, host.HttpFilterGetRequestHeaders(id))
+
+			// the response headers set by test code replace the ones set in the request phase
+			host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "200"}})
+			assert.Equal(t, [][2]string{{":status", "200"}}, host.HttpFilterGetResponseHeaders(id))
+		})
+	}
+}
+
+type bodyRewritingContext struct {
+	proxywasm.DefaultHttpContext
+	mutate func() error
+}
+
+func (ctx *bodyRewritingContext) OnHttpRequestBody(int, bool) types.Action {
+	if err := ctx.mutate(); err != nil {
+		proxywasm.LogWarnf("failed to mutate body: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_MutateRequestBody(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		body   string
+		mutate func() error
+		exp    string
+	}{
+		{
+			name:   "append",
+			body:   "hello",
+			mutate: func() error { return proxywasm.AppendHttpRequestBody([]byte(" world")) },
+			exp:    "hello world",
+		},
+		{
+			name:   "append to empty",
+			body:   "",
+			mutate: func() error { return proxywasm.AppendHttpRequestBody([]byte("world")) },
+			exp:    "world",
+		},
+		{
+			name:   "prepend",
+			body:   "world",
+			mutate: func() error { return proxywasm.PrependHttpRequestBody([]byte("hello ")) },
+			exp:    "hello world",
+		},
+		{
+			name:   "replace with shorter",
+			body:   "hello world",
+			mutate: func() error { return proxywasm.SetHttpRequestBody([]byte("bye")) },
+			exp:    "bye",
+		},
+		{
+			name:   "replace with empty",
+			body:   "hello",
+			mutate: func() error { return proxywasm.SetHttpRequestBody(nil) },
+			exp:    "",
+		},
+		{
+			name: "multiple",
+			body: "b",
+			mutate: func() error {
+				if err := proxywasm.AppendHttpRequestBody([]byte("c")); err != nil {
+					return err
+				}
+				return proxywasm.PrependHttpRequestBody([]byte("a"))
+			},
+			exp: "abc",
+		},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			opt := NewEmulatorOption().WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext {
+				return &bodyRewritingContext{mutate: c.mutate}
+			})
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutRequestBodyEndOfStream(id, []byte(c.body), true)
+			require.Len(t, host.GetLogs(types.LogLevelWarn), 0)
+			assert.Equal(t, c.exp, string(host.HttpFilterGetRequestBody(id)))
+			assert.Equal(t, c.exp, string(host.HttpFilterGetForwardedRequestBody(id)))
+		})
+	}
+
+	t.Run("over the limit in strict mode", func(t *testing.T) {
+		opt := NewEmulatorOption().WithStrictMode().WithBodyBufferLimit(8).
+			WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext {
+				return &bodyRewritingContext{mutate: func() error {
+					return proxywasm.AppendHttpRequestBody([]byte(" world"))
+				}}
+			})
+		host := NewHostEmulator(opt)
+		defer host.Done()
+
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestBodyEndOfStream(id, []byte("hello"), true)
+		assert.Equal(t, []string{"failed to mutate body: error status returned by host: bad argument"},
+			host.GetLogs(types.LogLevelWarn))
+		assert.Equal(t, "hello", string(host.HttpFilterGetRequestBody(id)))
+	})
+}
+
+type clusterLoggingContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *clusterLoggingContext) OnHttpResponseHeaders(int, bool) types.Action {
+	cluster, err := proxywasm.GetUpstreamClusterName()
+	if err != nil {
+		proxywasm.LogWarnf("failed to get upstream cluster: %v", err)
+		return types.ActionContinue
+	}
+	status, err := proxywasm.GetHttpResponseHeader(":status")
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get :status: %v", err)
+		return types.ActionContinue
+	}
+	proxywasm.LogInfof("cluster=%s status=%s", cluster, status)
+	return types.ActionContinue
+}
+
+func TestHttpFilter_SetUpstreamClusterName(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &clusterLoggingContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "503"}})
+	// not routed yet
+	assert.Equal(t, []string{"failed to get upstream cluster: error status returned by host: not found"},
+		host.GetLogs(types.LogLevelWarn))
+
+	host.SetUpstreamClusterName("outbound|80||backend.default.svc.cluster.local")
+	id = host.HttpFilterInitContext()
+	host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "200"}})
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{"cluster=outbound|80||backend.default.svc.cluster.local status=200"},
+		host.GetLogs(types.LogLevelInfo))
+}
+
+type redactingResponseContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *redactingResponseContext) OnHttpResponseHeaders(int, bool) types.Action {
+	if err := proxywasm.RemoveHttpResponseHeader("content-length"); err != nil {
+		proxywasm.LogCriticalf("failed to remove content-length: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func (ctx *redactingResponseContext) OnHttpResponseBody(_ int, endOfStream bool) types.Action {
+	if !endOfStream {
+		return types.ActionPause
+	}
+
+	body, err := proxywasm.GetWholeHttpResponseBody()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get response body: %v", err)
+		return types.ActionContinue
+	}
+	redacted := strings.ReplaceAll(string(body), "secret", "******")
+	if err := proxywasm.SetHttpResponseBody([]byte(redacted)); err != nil {
+		proxywasm.LogCriticalf("failed to set response body: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func (ctx *redactingResponseContext) OnHttpResponseTrailers(int) types.Action {
+	if err := proxywasm.AddHttpResponseTrailer("x-redacted", "true"); err != nil {
+		proxywasm.LogCriticalf("failed to add trailer: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_SendResponse(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &redactingResponseContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeadersEndOfStream(id, [][2]string{{":path", "/token"}}, true)
+	res := host.HttpFilterSendResponse(id, HttpResponse{
+		Headers:    [][2]string{{":status", "200"}, {"content-length", "17"}},
+		BodyChunks: [][]byte{[]byte("token: sec"), []byte("ret, ok")},
+	})
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, [][2]string{{":status", "200"}}, res.Headers)
+	assert.Equal(t, "token: ******, ok", string(res.Body))
+	assert.Equal(t, types.ActionContinue, res.Action)
+	assert.Nil(t, res.LocalResponse)
+	assert.Equal(t, []PhaseAction{
+		{Phase: PhaseRequestHeaders, Action: types.ActionContinue},
+		{Phase: PhaseResponseHeaders, Action: types.ActionContinue},
+		{Phase: PhaseResponseBody, Action: types.ActionPause},
+		{Phase: PhaseResponseBody, Action: types.ActionContinue},
+	}, res.Actions)
+	assert.Equal(t, 1, host.HttpFilterGetStreamDoneCount(id))
+
+	t.Run("trailers", func(t *testing.T) {
+		id := host.HttpFilterInitContext()
+		res := host.HttpFilterSendResponse(id, HttpResponse{
+			Headers:  [][2]string{{":status", "200"}},
+			Trailers: [][2]string{{"grpc-status", "0"}},
+		})
+		require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+		assert.Equal(t, [][2]string{{"grpc-status", "0"}, {"x-redacted", "true"}}, res.Trailers)
+		assert.Equal(t, []PhaseAction{
+			{Phase: PhaseResponseHeaders, Action: types.ActionContinue},
+			{Phase: PhaseResponseTrailers, Action: types.ActionContinue},
+		}, res.Actions)
+		assert.Equal(t, 1, host.HttpFilterGetStreamDoneCount(id))
+	})
+}
+
+type requestSizeContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *requestSizeContext) OnHttpRequestBody(bodySize int, _ bool) types.Action {
+	total, err := proxywasm.GetRequestSize()
+	if err != nil {
+		proxywasm.LogWarnf("failed to get request size: %v", err)
+		return types.ActionContinue
+	}
+	proxywasm.LogInfof("buffered %d of %d bytes", bodySize, total)
+	return types.ActionContinue
+}
+
+func TestHttpFilter_SetRequestTotalSize(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &requestSizeContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestBody(id, []byte("first chunk"))
+	assert.Equal(t, []string{"failed to get request size: error status returned by host: not found"},
+		host.GetLogs(types.LogLevelWarn))
+
+	// the size counted by the host differs from the body buffered so far
+	host.SetRequestTotalSize(4096)
+	host.HttpFilterPutRequestBody(id, []byte("second chunk"))
+	assert.Equal(t, []string{"buffered 12 of 4096 bytes"}, host.GetLogs(types.LogLevelInfo))
+}
+
+// largeHeaderContext echoes the oversized request header into the response headers.
+type largeHeaderContext struct {
+	proxywasm.DefaultHttpContext
+}
+
+func (ctx *largeHeaderContext) OnHttpRequestHeaders(int, bool) types.Action {
+	value, err := proxywasm.GetHttpRequestHeader("x-large")
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get request header: %v", err)
+		return types.ActionContinue
+	}
+	headers, err := proxywasm.GetHttpRequestHeaders()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get request headers: %v", err)
+		return types.ActionContinue
+	}
+	proxywasm.LogInfof("value: %d bytes, headers: %d", len(value), len(headers))
+	if err := proxywasm.SetHttpRequestHeader("x-large", value+"!"); err != nil {
+		proxywasm.LogCriticalf("failed to set request header: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHttpFilter_LargeHeaderValue(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &largeHeaderContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	large := strings.Repeat("0123456789abcdef", 1024*1024/16)
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{"x-before", "a"}, {"x-large", large}, {"x-after", "b"}})
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{"value: 1048576 bytes, headers: 3"}, host.GetLogs(types.LogLevelInfo))
+
+	headers := host.HttpFilterGetRequestHeaders(id)
+	require.Len(t, headers, 3)
+	assert.Equal(t, [2]string{"x-before", "a"}, headers[0])
+	assert.True(t, headers[1][1] == large+"!", "large header value is truncated or corrupted")
+	assert.Equal(t, [2]string{"x-after", "b"}, headers[2])
+}
@@ -0,0 +1,109 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxytest
+
+import (
+	"log"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// contextLifecycle tracks the teardown of a context.
+type contextLifecycle struct {
+	// onDoneCount is the number of times proxy_on_done has been called on the context, which is at most one.
+	onDoneCount int
+	// done is set when the context returns true from proxy_on_done or calls proxy_done afterwards.
+	done        bool
+	deleteCount int
+}
+
+// contextLifecycles is shared by the emulators so that proxy_on_done and proxy_on_delete are called
+// at most once per context, whichever of CompleteContext, HttpFilterCompleteHttpStream,
+// NetworkFilterCompleteConnection and FinishVM tears down the context.
+type contextLifecycles map[uint32]*contextLifecycle // key: contextID
+
+func (ls contextLifecycles) get(contextID uint32) *contextLifecycle {
+	l, ok := ls[contextID]
+	if !ok {
+		l = &contextLifecycle{}
+		ls[contextID] = l
+	}
+	return l
+}
+
+func (ls contextLifecycles) deleted(contextID uint32) bool {
+	return ls.get(contextID).deleteCount > 0
+}
+
+// onDone calls proxy_on_done on the context unless it has been called already,
+// and returns whether the context is done.
+func (ls contextLifecycles) onDone(contextID uint32) bool {
+	l := ls.get(contextID)
+	if l.onDoneCount == 0 {
+		l.onDoneCount++
+		if proxywasm.ProxyOnDone(contextID) {
+			l.done = true
+		}
+	}
+	return l.done
+}
+
+// onDelete calls proxy_on_delete on the context unless it has been deleted already.
+func (ls contextLifecycles) onDelete(contextID uint32) {
+	l := ls.get(contextID)
+	if l.deleteCount > 0 {
+		return
+	}
+	proxywasm.ProxyOnDelete(contextID)
+	l.deleteCount++
+}
+
+func (ls contextLifecycles) reset() {
+	for id := range ls {
+		delete(ls, id)
+	}
+}
+
+// impl rawhostcall.ProxyWASMHost
+func (h *hostEmulator) ProxyDone() types.Status {
+	l := h.lifecycles.get(proxywasm.VMStateGetActiveContextID())
+	if l.done {
+		log.Printf("proxy_done called twice on context %d", proxywasm.VMStateGetActiveContextID())
+		return types.StatusBadArgument
+	}
+	l.done = true
+	return types.StatusOK
+}
+
+// impl HostEmulator
+func (h *hostEmulator) CompleteContext(contextID uint32) {
+	if h.lifecycles.deleted(contextID) {
+		log.Printf("context %d has already been deleted", contextID)
+		return
+	}
+
+	if !h.lifecycles.onDone(contextID) {
+		// the deletion is deferred till the plugin calls proxy_done
+		return
+	}
+	h.lifecycles.onDelete(contextID)
+	delete(h.streamStates, contextID)
+}
+
+// impl HostEmulator
+func (h *hostEmulator) GetContextDeleteCount(contextID uint32) int {
+	return h.lifecycles.get(contextID).deleteCount
+}
@@ -23,20 +23,47 @@ import (
 
 type networkHostEmulator struct {
 	streamStates map[uint32]*streamState
+	lifecycles   contextLifecycles
 }
 
 type streamState struct {
-	upstream, downstream []byte
+	upstream, downstream                   []byte
+	forwardedUpstream, forwardedDownstream []byte
+	upstreamClosed, downstreamClosed       bool
+	upstreamAction, downstreamAction       types.Action
+	// inDataCallback is true while OnUpstreamData or OnDownstreamData is running.
+	inDataCallback bool
 }
 
-func newNetworkHostEmulator() *networkHostEmulator {
+// ConnectionState is the state of a connection handled by the network filter.
+type ConnectionState struct {
+	// BufferedUpstream and BufferedDownstream are the data buffered as the plugin paused the iteration.
+	BufferedUpstream, BufferedDownstream []byte
+	// ForwardedUpstream and ForwardedDownstream are the data passed through the plugin so far.
+	ForwardedUpstream, ForwardedDownstream []byte
+	UpstreamClosed, DownstreamClosed       bool
+	// UpstreamAction and DownstreamAction are the actions returned by the last OnUpstreamData and OnDownstreamData.
+	UpstreamAction, DownstreamAction types.Action
+}
+
+func newNetworkHostEmulator(lifecycles contextLifecycles) *networkHostEmulator {
 	host := &networkHostEmulator{
 		streamStates: map[uint32]*streamState{},
+		lifecycles:   lifecycles,
 	}
 
 	return host
 }
 
+// reset drops all the network streams and returns their context ids
+func (n *networkHostEmulator) reset() (contextIDs []uint32) {
+	for id := range n.streamStates {
+		contextIDs = append(contextIDs, id)
+	}
+	n.streamStates = map[uint32]*streamState{}
+	return
+}
+
 // impl rawhostcall.ProxyWASMHost: delegated from hostEmulator
 func (n *networkHostEmulator) networkHostEmulatorProxyGetBufferBytes(bt types.BufferType, start int, maxSize int,
 	returnBufferData **byte, returnBufferSize *int) types.Status {
@@ -53,6 +80,13 @@ func (n *networkHostEmulator) networkHostEmulatorProxyGetBufferBytes(bt types.Bu
 		panic("unreachable: maybe a bug in this host emulation or SDK")
 	}
 
+	if len(buf) == 0 && start == 0 && stream.inDataCallback {
+		// an empty chunk, e.g. the one with end_of_stream, is read as empty in the data callback
+		*returnBufferData = &emptyBuffer[0]
+		*returnBufferSize = 0
+		return types.StatusOK
+	}
+
 	if start >= len(buf) {
 		log.Printf("start index out of range: %d (start) >= %d ", start, len(buf))
 		return types.StatusBadArgument
@@ -67,8 +101,30 @@ func (n *networkHostEmulator) networkHostEmulatorProxyGetBufferBytes(bt types.Bu
 	return types.StatusOK
 }
 
+// impl rawhostcall.ProxyWASMHost: delegated from hostEmulator
+func (n *networkHostEmulator) networkHostEmulatorProxySetBufferBytes(bt types.BufferType, start int, maxSize int,
+	bufferData *byte, bufferSize int) types.Status {
+	active := proxywasm.VMStateGetActiveContextID()
+	stream := n.streamStates[active]
+	data := proxywasm.RawBytePtrToByteSlice(bufferData, bufferSize)
+	switch bt {
+	case types.BufferTypeUpstreamData:
+		stream.upstream = spliceBuffer(stream.upstream, start, maxSize, data)
+	case types.BufferTypeDownstreamData:
+		stream.downstream = spliceBuffer(stream.downstream, start, maxSize, data)
+	default:
+		panic("unreachable: maybe a bug in this host emulation or SDK")
+	}
+	return types.StatusOK
+}
+
 // impl HostEmulator
 func (n *networkHostEmulator) NetworkFilterPutUpstreamData(contextID uint32, data []byte) {
+	n.NetworkFilterPutUpstreamDataEndOfStream(contextID, data, false)
+}
+
+// impl HostEmulator
+func (n *networkHostEmulator) NetworkFilterPutUpstreamDataEndOfStream(contextID uint32, data []byte, endOfStream bool) {
 	stream, ok := n.streamStates[contextID]
 	if !ok {
 		log.Fatalf("invalid context id: %d", contextID)
@@ -78,11 +134,15 @@ func (n *networkHostEmulator) NetworkFilterPutUpstreamData(contextID uint32, dat
 		stream.upstream = append(stream.upstream, data...)
 	}
 
-	action := proxywasm.ProxyOnUpstreamData(contextID, len(stream.upstream), false)
+	stream.inDataCallback = true
+	action := proxywasm.ProxyOnUpstreamData(contextID, len(stream.upstream), endOfStream)
+	stream.inDataCallback = false
+	stream.upstreamAction = action
 	switch action {
 	case types.ActionPause:
 		return
 	case types.ActionContinue:
+		stream.forwardedUpstream = append(stream.forwardedUpstream, stream.upstream...)
 		stream.upstream = []byte{}
 	default:
 		log.Fatalf("invalid action type: %d", action)
@@ -91,6 +151,11 @@ func (n *networkHostEmulator) NetworkFilterPutUpstreamData(contextID uint32, dat
 
 // impl HostEmulator
 func (n *networkHostEmulator) NetworkFilterPutDownstreamData(contextID uint32, data []byte) {
+	n.NetworkFilterPutDownstreamDataEndOfStream(contextID, data, false)
+}
+
+// impl HostEmulator
+func (n *networkHostEmulator) NetworkFilterPutDownstreamDataEndOfStream(contextID uint32, data []byte, endOfStream bool) {
 	stream, ok := n.streamStates[contextID]
 	if !ok {
 		log.Fatalf("invalid context id: %d", contextID)
@@ -99,11 +164,15 @@ func (n *networkHostEmulator) NetworkFilterPutDownstreamData(contextID uint32, d
 		stream.downstream = append(stream.downstream, data...)
 	}
 
-	action := proxywasm.ProxyOnDownstreamData(contextID, len(stream.downstream), false)
+	stream.inDataCallback = true
+	action := proxywasm.ProxyOnDownstreamData(contextID, len(stream.downstream), endOfStream)
+	stream.inDataCallback = false
+	stream.downstreamAction = action
 	switch action {
 	case types.ActionPause:
 		return
 	case types.ActionContinue:
+		stream.forwardedDownstream = append(stream.forwardedDownstream, stream.downstream...)
 		stream.downstream = []byte{}
 	default:
 		log.Fatalf("invalid action type: %d", action)
@@ -114,26 +183,57 @@ func (n *networkHostEmulator) NetworkFilterPutDownstreamData(contextID uint32, d
 func (n *networkHostEmulator) NetworkFilterInitConnection() (contextID uint32) {
 	contextID = getNextContextID()
 	proxywasm.ProxyOnContextCreate(contextID, RootContextID)
-	proxywasm.ProxyOnNewConnection(contextID)
+	// created before OnNewConnection so that the plugin can call the host in it
 	n.streamStates[contextID] = &streamState{}
+	proxywasm.ProxyOnNewConnection(contextID)
 	return
 }
 
 // impl HostEmulator
 func (n *networkHostEmulator) NetworkFilterCloseUpstreamConnection(contextID uint32) {
+	if stream, ok := n.streamStates[contextID]; ok {
+		stream.upstreamClosed = true
+	}
 	proxywasm.ProxyOnUpstreamConnectionClose(contextID, types.PeerTypeLocal) // peerType will be removed in the next ABI
 }
 
 // impl HostEmulator
 func (n *networkHostEmulator) NetworkFilterCloseDownstreamConnection(contextID uint32) {
+	if stream, ok := n.streamStates[contextID]; ok {
+		stream.downstreamClosed = true
+	}
 	proxywasm.ProxyOnDownstreamConnectionClose(contextID, types.PeerTypeLocal) // peerType will be removed in the next ABI
 }
 
 // impl HostEmulator
 func (n *networkHostEmulator) NetworkFilterCompleteConnection(contextID uint32) {
+	if n.lifecycles.deleted(contextID) {
+		log.Printf("context %d has already been deleted", contextID)
+		return
+	}
+
 	// https://github.com/envoyproxy/envoy/blob/867b9e23d2e48350bd1b0d1fbc392a8355f20e35/source/extensions/common/wasm/context.cc#L169-L171
-	proxywasm.ProxyOnDone(contextID)
+	n.lifecycles.onDone(contextID)
 	proxywasm.ProxyOnLog(contextID)
-	proxywasm.ProxyOnDelete(contextID)
+	n.lifecycles.onDelete(contextID)
 	delete(n.streamStates, contextID)
 }
+
+// impl HostEmulator
+func (n *networkHostEmulator) NetworkFilterGetConnectionState(contextID uint32) ConnectionState {
+	stream, ok := n.streamStates[contextID]
+	if !ok {
+		log.Fatalf("invalid context id: %d", contextID)
+	}
+
+	return ConnectionState{
+		BufferedUpstream:    stream.upstream,
+		BufferedDownstream:  stream.downstream,
+		ForwardedUpstream:   stream.forwardedUpstream,
+		ForwardedDownstream: stream.forwardedDownstream,
+		UpstreamClosed:      stream.upstreamClosed,
+		DownstreamClosed:    stream.downstreamClosed,
+		UpstreamAction:      stream.upstreamAction,
+		DownstreamAction:    stream.downstreamAction,
+	}
+}
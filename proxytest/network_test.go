@@ -0,0 +1,156 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxytest
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// handshakeStreamContext holds the upstream data until the downstream sends the handshake on the same connection.
+type handshakeStreamContext struct {
+	proxywasm.DefaultStreamContext
+	user string
+}
+
+func (ctx *handshakeStreamContext) OnDownstreamData(dataSize int, _ bool) types.Action {
+	if ctx.user != "" {
+		return types.ActionContinue
+	}
+	data, err := proxywasm.GetDownStreamData(0, dataSize)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get downstream data: %v", err)
+		return types.ActionContinue
+	}
+	if strings.HasPrefix(string(data), "HELLO ") {
+		ctx.user = strings.TrimSpace(strings.TrimPrefix(string(data), "HELLO "))
+	}
+	return types.ActionContinue
+}
+
+func (ctx *handshakeStreamContext) OnUpstreamData(dataSize int, _ bool) types.Action {
+	if ctx.user == "" {
+		return types.ActionPause
+	}
+	proxywasm.LogInfof("%d bytes to %s", dataSize, ctx.user)
+	return types.ActionContinue
+}
+
+func TestNetworkFilter_GetConnectionState(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewStreamContext(func(uint32, uint32) proxywasm.StreamContext { return &handshakeStreamContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	alice := host.NetworkFilterInitConnection()
+	other := host.NetworkFilterInitConnection()
+
+	// the upstream data is held until the handshake on each connection
+	host.NetworkFilterPutUpstreamData(alice, []byte("welcome"))
+	host.NetworkFilterPutUpstreamData(other, []byte("welcome"))
+	host.NetworkFilterPutDownstreamData(alice, []byte("HELLO alice\n"))
+	host.NetworkFilterPutUpstreamData(alice, []byte("!"))
+	host.NetworkFilterPutUpstreamData(other, []byte("!"))
+	host.NetworkFilterCloseDownstreamConnection(other)
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{"8 bytes to alice"}, host.GetLogs(types.LogLevelInfo))
+	assert.Equal(t, ConnectionState{
+		BufferedUpstream:    []byte{},
+		BufferedDownstream:  []byte{},
+		ForwardedUpstream:   []byte("welcome!"),
+		ForwardedDownstream: []byte("HELLO alice\n"),
+	}, host.NetworkFilterGetConnectionState(alice))
+	assert.Equal(t, ConnectionState{
+		BufferedUpstream: []byte("welcome!"),
+		DownstreamClosed: true,
+		UpstreamAction:   types.ActionPause,
+	}, host.NetworkFilterGetConnectionState(other))
+}
+
+// lineStreamContext forwards the downstream data line by line in upper case and greets on new connections.
+type lineStreamContext struct {
+	proxywasm.DefaultStreamContext
+}
+
+func (ctx *lineStreamContext) OnNewConnection() types.Action {
+	proxywasm.LogInfo("new connection")
+	return types.ActionContinue
+}
+
+func (ctx *lineStreamContext) OnDownstreamData(dataSize int, endOfStream bool) types.Action {
+	data, err := proxywasm.GetDownStreamData(0, dataSize)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get downstream data: %v", err)
+		return types.ActionContinue
+	}
+	if !endOfStream && !strings.HasSuffix(string(data), "\n") {
+		return types.ActionPause
+	}
+	if err := proxywasm.SetDownstreamData([]byte(strings.ToUpper(string(data)))); err != nil {
+		proxywasm.LogCriticalf("failed to set downstream data: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func (ctx *lineStreamContext) OnUpstreamData(dataSize int, _ bool) types.Action {
+	// drops the upstream data
+	if err := proxywasm.SetUpstreamData(nil); err != nil {
+		proxywasm.LogCriticalf("failed to set upstream data: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestNetworkFilter_MutateData(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewStreamContext(func(uint32, uint32) proxywasm.StreamContext { return &lineStreamContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.NetworkFilterInitConnection()
+	assert.Equal(t, []string{"new connection"}, host.GetLogs(types.LogLevelInfo))
+
+	host.NetworkFilterPutDownstreamData(id, []byte("hel"))
+	state := host.NetworkFilterGetConnectionState(id)
+	assert.Equal(t, types.ActionPause, state.DownstreamAction)
+	assert.Equal(t, []byte("hel"), state.BufferedDownstream)
+
+	host.NetworkFilterPutDownstreamData(id, []byte("lo\n"))
+	state = host.NetworkFilterGetConnectionState(id)
+	assert.Equal(t, types.ActionContinue, state.DownstreamAction)
+	assert.Equal(t, []byte("HELLO\n"), state.ForwardedDownstream)
+
+	// an empty chunk is read as empty data
+	host.NetworkFilterPutDownstreamData(id, nil)
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+
+	// the rest is forwarded at the end of the stream without the line break
+	host.NetworkFilterPutDownstreamDataEndOfStream(id, []byte("bye"), true)
+	host.NetworkFilterPutUpstreamDataEndOfStream(id, []byte("ignored"), true)
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, ConnectionState{
+		BufferedUpstream:    []byte{},
+		BufferedDownstream:  []byte{},
+		ForwardedDownstream: []byte("HELLO\nBYE"),
+		UpstreamAction:      types.ActionContinue,
+		DownstreamAction:    types.ActionContinue,
+	}, host.NetworkFilterGetConnectionState(id))
+}
@@ -1,16 +1,27 @@
 package proxytest
 
-import "github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+import (
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/rawhostcall"
+)
 
 type EmulatorOption struct {
 	pluginConfiguration, vmConfiguration []byte
 	newRootContext                       func(uint32) proxywasm.RootContext
 	newStreamContext                     func(uint32, uint32) proxywasm.StreamContext
 	newHttpContext                       func(uint32, uint32) proxywasm.HttpContext
+	hostWrapper                          func(rawhostcall.ProxyWASMHost) rawhostcall.ProxyWASMHost
+	strictMode                           bool
+	fatalLogPanics                       bool
+	bodyBufferLimit                      int
+	allocationMeasurement                bool
 }
 
+// defaultBodyBufferLimit is the same as the default per-connection buffer limit of Envoy.
+const defaultBodyBufferLimit = 1024 * 1024
+
 func NewEmulatorOption() *EmulatorOption {
-	return &EmulatorOption{}
+	return &EmulatorOption{bodyBufferLimit: defaultBodyBufferLimit}
 }
 
 func (o *EmulatorOption) WithNewRootContext(f func(uint32) proxywasm.RootContext) *EmulatorOption {
@@ -28,12 +39,74 @@ func (o *EmulatorOption) WithNewStreamContext(f func(uint32, uint32) proxywasm.S
 	return o
 }
 
+// WithPluginConfiguration sets the plugin configuration, whose size is given to OnPluginStart by StartPlugin
+// and which is returned by GetPluginConfiguration.
 func (o *EmulatorOption) WithPluginConfiguration(data []byte) *EmulatorOption {
 	o.pluginConfiguration = data
 	return o
 }
 
+// WithVMConfiguration sets the VM configuration, whose size is given to OnVMStart by StartVM
+// and which is returned by GetVMConfiguration.
 func (o *EmulatorOption) WithVMConfiguration(data []byte) *EmulatorOption {
 	o.vmConfiguration = data
 	return o
 }
+
+// WithHostWrapper sets the function to wrap the emulated host before it is registered.
+// This can be used to override individual host calls by embedding the given host
+// in a struct which implements only the methods of interest, e.g.
+//
+//	type slowHost struct{ rawhostcall.ProxyWASMHost }
+//
+//	func (h slowHost) ProxyGetSharedData(keyData *byte, keySize int, returnValueData **byte,
+//		returnValueSize *int, returnCas *uint32) types.Status {
+//		time.Sleep(time.Second)
+//		return h.ProxyWASMHost.ProxyGetSharedData(keyData, keySize, returnValueData, returnValueSize, returnCas)
+//	}
+//
+//	opt := proxytest.NewEmulatorOption().WithHostWrapper(func(h rawhostcall.ProxyWASMHost) rawhostcall.ProxyWASMHost {
+//		return slowHost{h}
+//	})
+func (o *EmulatorOption) WithHostWrapper(f func(rawhostcall.ProxyWASMHost) rawhostcall.ProxyWASMHost) *EmulatorOption {
+	o.hostWrapper = f
+	return o
+}
+
+// WithStrictMode makes the emulator reject operations which the real host would reject
+// though they are allowed by default for convenience of testing.
+// Currently, the following operations fail with types.ErrorStatusBadArgument:
+//   - replacing an http body beyond the buffer limit
+//   - modifying the response headers or trailers in the request phases, and vice versa
+func (o *EmulatorOption) WithStrictMode() *EmulatorOption {
+	o.strictMode = true
+	return o
+}
+
+// WithFatalLogPanics makes the plugin's critical log, which is the fatal one in Envoy, abort the execution
+// by panicking with FatalLogPanicValue(message) after the message is recorded, so that the tests can
+// catch it with require.PanicsWithValue. By default critical logs are only recorded.
+func (o *EmulatorOption) WithFatalLogPanics() *EmulatorOption {
+	o.fatalLogPanics = true
+	return o
+}
+
+// FatalLogPanicValue returns the value the emulator panics with on the critical log of the message
+// when WithFatalLogPanics is set, which is "proxy_critical_log: " followed by the message.
+func FatalLogPanicValue(message string) string {
+	return "proxy_critical_log: " + message
+}
+
+// WithAllocationMeasurement enables HostEmulator.MeasureAllocations by wrapping the plugin's http contexts
+// so that the allocations in their callbacks are measured. Otherwise the contexts are not wrapped.
+func (o *EmulatorOption) WithAllocationMeasurement() *EmulatorOption {
+	o.allocationMeasurement = true
+	return o
+}
+
+// WithBodyBufferLimit sets the limit in bytes on http bodies enforced in the strict mode,
+// which corresponds to max_request_bytes of the Envoy's buffer filter. Defaults to 1MiB.
+func (o *EmulatorOption) WithBodyBufferLimit(limit int) *EmulatorOption {
+	o.bodyBufferLimit = limit
+	return o
+}
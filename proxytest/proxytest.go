@@ -3,6 +3,8 @@ package proxytest
 import (
 	"log"
 	"sync"
+	"testing"
+	"time"
 
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/rawhostcall"
@@ -11,48 +13,282 @@ import (
 
 type HostEmulator interface {
 	Done()
+	Reset()
+	// Snapshot takes a deep copy of the VM-scoped state of the emulator, i.e. logs, the tick count and period,
+	// shared queues, shared data, properties and metrics, which is brought back by Restore. This allows
+	// exploring many callback sequences from a common baseline without re-running expensive setup.
+	// Note that http/stream contexts and pending callouts are not captured, since the contexts held
+	// by the plugin cannot be copied.
+	Snapshot() *EmulatorState
+	// Restore brings back the state taken by Snapshot. All http/stream contexts, pending http callouts,
+	// gRPC calls and streams are discarded as Reset does, so create new contexts after Restore.
+	Restore(state *EmulatorState)
 
 	// Root
 	StartVM()
+	// StartPlugin calls OnPluginStart. If it returns false, the plugin is treated as not started, and the metrics,
+	// queues and the tick period registered in it are discarded as Envoy discards the VM. Logs and shared data,
+	// which is shared across VMs, are kept.
 	StartPlugin()
+	// IsPluginStarted returns true if OnPluginStart returned true in the last StartPlugin.
+	IsPluginStarted() bool
+	// CompleteContext tears down the context: OnVMDone, OnHttpStreamDone or OnStreamDone is called,
+	// and then the context is deleted. If the root context returns false from OnVMDone, the deletion is
+	// deferred until the plugin calls proxywasm.FinishVMContext and CompleteContext is called again.
+	// A deleted context is never deleted again, including by HttpFilterCompleteHttpStream
+	// and NetworkFilterCompleteConnection which share the same teardown record.
+	CompleteContext(contextID uint32)
+	// GetContextDeleteCount returns how many times the context has been deleted by CompleteContext,
+	// HttpFilterCompleteHttpStream, NetworkFilterCompleteConnection or Reset.
+	GetContextDeleteCount(contextID uint32) int
 	FinishVM()
 
 	GetCalloutAttributesFromContext(contextID uint32) []HttpCalloutAttribute
-	PutCalloutResponse(contextID uint32, headers, trailers [][2]string, body []byte)
+	// PutCalloutResponse delivers the response of the given callout to the plugin, which invokes the callback
+	// passed to proxywasm.DispatchHttpCall. The response is rejected if the callout is not pending,
+	// i.e. it has not been dispatched yet, its response has already been delivered or it has been abandoned.
+	PutCalloutResponse(calloutID uint32, headers, trailers [][2]string, body []byte)
+	// AbandonPendingHttpCalls emulates Envoy dropping the callouts in flight when the plugin is torn down:
+	// the responses of the pending callouts are never delivered, so their callbacks never run.
+	AbandonPendingHttpCalls()
+	// SetCalloutBodyLimit emulates the buffer limit of the host on callout responses:
+	// the bodies passed to PutCalloutResponse are truncated to the given number of bytes.
+	// Zero, the default, means unlimited.
+	SetCalloutBodyLimit(limit int)
+	// IsCalloutBodyTruncated returns true if the body of the callout response was truncated
+	// due to the limit set by SetCalloutBodyLimit.
+	IsCalloutBodyTruncated(calloutID uint32) bool
+	// GetGrpcCalloutAttributesFromContext returns the gRPC calls dispatched by proxywasm.DispatchGrpcCall
+	// in the given context.
+	GetGrpcCalloutAttributesFromContext(contextID uint32) []GrpcCalloutAttribute
+	// PutGrpcCallResponse delivers the response of the given gRPC call to the plugin, which invokes the callback
+	// passed to proxywasm.DispatchGrpcCall. A non-OK status closes the call with the status without the message.
+	// The response is rejected if the call is not pending, e.g. it has been cancelled.
+	PutGrpcCallResponse(calloutID uint32, status types.GrpcStatus, message []byte)
+	// GetGrpcStreamAttributesFromContext returns the gRPC streams opened by proxywasm.OpenGrpcStream
+	// in the given context, including the messages sent by the plugin.
+	GetGrpcStreamAttributesFromContext(contextID uint32) []GrpcStreamAttribute
+	// PutGrpcStreamMessage delivers the message on the gRPC stream to the plugin,
+	// which invokes the message callback passed to proxywasm.OpenGrpcStream.
+	PutGrpcStreamMessage(streamID uint32, message []byte)
+	// PutGrpcStreamClose closes the gRPC stream from the remote with the given status,
+	// which invokes the close callback passed to proxywasm.OpenGrpcStream.
+	PutGrpcStreamClose(streamID uint32, status types.GrpcStatus)
+	// GetCalloutResponseHeaders returns the headers of the response delivered to the callout by PutCalloutResponse,
+	// which the plugin reads by proxywasm.GetHttpCallResponseHeaders in the callback.
+	GetCalloutResponseHeaders(calloutID uint32) [][2]string
 
+	// SetPartialBufferReads makes the emulator return only the first half of the requested bytes
+	// on reading buffers except configurations, as the real hosts may return fewer bytes than requested.
+	SetPartialBufferReads(partial bool)
+
+	// GetLogs returns the messages logged at the given level. It panics on an invalid level.
 	GetLogs(level types.LogLevel) []string
+	// GetLogsE is the same as GetLogs except that it returns an error on an invalid level.
+	GetLogsE(level types.LogLevel) ([]string, error)
+	// GetLogsAtOrAbove returns the messages logged at the given level or more severe ones,
+	// grouped by level from the given one up to LogLevelCritical. It panics on an invalid level.
+	GetLogsAtOrAbove(level types.LogLevel) []string
+	// GetAllLogs returns the messages logged at all the levels in the order of logging.
+	GetAllLogs() []LogEntry
+	// AssertMaxLogs fails the test if the plugin has logged more than n lines in total across all the levels
+	// since the emulator was created or last reset, which helps keeping plugins from logging on every request.
+	AssertMaxLogs(t testing.TB, n int) bool
+	// SetValidateLogUTF8 makes the emulator panic when the plugin logs a message containing invalid UTF-8.
+	SetValidateLogUTF8(validate bool)
+	// GetTickPeriod returns the period set by the latest call to SetTickPeriodMilliSeconds.
 	GetTickPeriod() uint32
+	TickEnabled() bool
+	// Tick calls OnTick of the root context once. It does nothing but logging a warning
+	// if the tick period has not been set by the plugin.
 	Tick()
+	// TickMultiple calls Tick n times.
+	TickMultiple(n int)
+	// TickState returns the current tick period, whether the tick is enabled and
+	// how many times Tick has been called.
+	TickState() (periodMs uint32, enabled bool, fireCount int)
 	GetQueueSize(queueID uint32) int
+	// GetQueue returns the items in the shared queue in order without dequeuing them.
+	GetQueue(queueID uint32) [][]byte
+	// RegisterSharedQueueForVM registers the shared queue owned by another VM, which can be resolved
+	// by proxywasm.ResolveSharedQueue with the given vm_id and name. Registering the same queue again
+	// returns the same id. OnQueueReady is not called on enqueues to the queues of other VMs
+	// since the other VM is notified instead.
+	RegisterSharedQueueForVM(vmID, name string) uint32
+	// GetRegisteredQueues returns the names of the shared queues registered by the plugin.
+	GetRegisteredQueues() []string
+	// GetSharedData returns a copy of the shared data of the given key and its current cas, which starts at 1
+	// on the first write of the key and is incremented on every successful write. As in Envoy, writes with cas 0
+	// are unconditional while the others fail with types.ErrorStatusCasMismatch unless the cas matches.
+	GetSharedData(key string) (value []byte, cas uint32, found bool)
+	// AssertSharedData fails the test if the shared data of the given key is not exactly the expected bytes,
+	// reporting the offset of the first difference.
+	AssertSharedData(t testing.TB, key string, expected []byte) bool
+	GetDefinedMetrics() []MetricDefinition
+	// GetMetricID returns the id of the metric defined with the given name.
+	GetMetricID(name string) (uint32, bool)
+	// GetMetricByID returns the value of the metric with the given id.
+	GetMetricByID(id uint32) (uint64, bool)
+	// GetCounterMetric returns the value of the counter with the given name. An error is returned
+	// if the metric is not defined or is not a counter. So are GetGaugeMetric and GetHistogramMetric.
+	GetCounterMetric(name string) (uint64, error)
+	GetGaugeMetric(name string) (uint64, error)
+	// AssertGaugeNonNegative fails the test if the gauge of the given name is negative as a signed value,
+	// e.g. when it has been decremented more than incremented.
+	AssertGaugeNonNegative(t testing.TB, name string) bool
+	GetHistogramMetric(name string) (uint64, error)
+	// GetHistogramValues returns all the values recorded to the histogram of the given id in order,
+	// while GetHistogramMetric and proxywasm.MetricHistogram.Get return only the last one.
+	GetHistogramValues(metricID uint32) []uint64
+	GetMetricSnapshot() MetricSnapshot
+	// GetMetricDelta returns the changes of the metric values since the given snapshot.
+	// Metrics which have not changed are omitted.
+	GetMetricDelta(before MetricSnapshot) map[string]int64
+	// SetProperty sets the property returned by proxywasm.GetProperty with the same path.
+	SetProperty(path []string, value []byte)
+	// GetProperty returns a copy of the property of the given path, including the ones set by the plugin
+	// through proxywasm.SetProperty with the serialized path.
+	GetProperty(path []string) ([]byte, bool)
+	// SetAuthorityRoutes sets the mapping from the :authority of requests to the route names,
+	// which is used by proxywasm.GetRouteName, so that the route changes as the plugin rewrites :authority.
+	// For the authorities not in the mapping, the "xds.route_name" property set by SetProperty is returned.
+	SetAuthorityRoutes(routes map[string]string)
+	// SetTrafficDirection sets the "listener_direction" property returned by proxywasm.GetTrafficDirection.
+	SetTrafficDirection(direction types.TrafficDirection)
+	// SetHttpRequestProtocol sets the "request.protocol" property returned by proxywasm.GetHttpRequestProtocol,
+	// e.g. "HTTP/1.1" or "HTTP/2".
+	SetHttpRequestProtocol(protocol string)
+	// SetUpstreamClusterName sets the "xds.cluster_name" property returned by proxywasm.GetUpstreamClusterName.
+	SetUpstreamClusterName(name string)
+	// SetRequestTotalSize sets the "request.total_size" property returned by proxywasm.GetRequestSize.
+	SetRequestTotalSize(size int64)
+	// SetDurationProperty sets the duration attribute of the given path such as "response.duration",
+	// which is read by proxywasm.GetDurationProperty.
+	SetDurationProperty(path []string, d time.Duration)
+	// SetTypedFilterState seeds the filter state of the given key returned by proxywasm.GetTypedFilterState,
+	// e.g. as if it were set by another filter earlier in the chain.
+	SetTypedFilterState(key, typeURL string, value []byte)
+	// GetTypedFilterState returns the type URL and a copy of the value of the filter state
+	// set by the plugin through proxywasm.SetTypedFilterState or seeded by SetTypedFilterState.
+	// Note that Envoy does not expose filter state to access logs as %DYNAMIC_METADATA%; it is only
+	// reachable via %FILTER_STATE% for the types which can be serialized, e.g. google.protobuf.StringValue.
+	GetTypedFilterState(key string) (typeURL string, value []byte, ok bool)
+	// RegisterForeignFunction registers the function called by proxywasm.CallForeignFunction with the given name.
+	// The error returned by the function is surfaced to the plugin as types.ErrorInternalFailure,
+	// and calling an unregistered function results in types.ErrorStatusNotFound.
+	RegisterForeignFunction(name string, f func(param []byte) ([]byte, error))
+	// CallOnForeignFunction invokes RootContext.OnForeignFunction with the given data,
+	// which emulates the completion of an asynchronous foreign function.
+	CallOnForeignFunction(funcID uint32, data []byte)
 
 	// network
 	NetworkFilterInitConnection() (contextID uint32)
 	NetworkFilterPutUpstreamData(contextID uint32, data []byte)
+	NetworkFilterPutUpstreamDataEndOfStream(contextID uint32, data []byte, endOfStream bool)
 	NetworkFilterPutDownstreamData(contextID uint32, data []byte)
+	NetworkFilterPutDownstreamDataEndOfStream(contextID uint32, data []byte, endOfStream bool)
 	NetworkFilterCloseUpstreamConnection(contextID uint32)
 	NetworkFilterCloseDownstreamConnection(contextID uint32)
 	NetworkFilterCompleteConnection(contextID uint32)
+	// NetworkFilterGetConnectionState returns the state of the connection, which is kept per connection
+	// until NetworkFilterCompleteConnection is called.
+	NetworkFilterGetConnectionState(contextID uint32) ConnectionState
 
 	// http
+	// SetHeaderNormalization sets how the headers and trailers given to HttpFilterPut* are normalized.
+	SetHeaderNormalization(mode HeaderNormalization)
+	// HttpFilterInitContext creates a new http context and returns its id. Any number of streams can be
+	// driven concurrently, and each keeps its own headers, bodies, trailers and plugin context.
 	HttpFilterInitContext() (contextID uint32)
 	HttpFilterPutRequestHeaders(contextID uint32, headers [][2]string)
+	// HttpFilterPutRequestHeadersN calls OnHttpRequestHeaders with n synthetic headers
+	// named "x-synthetic-<i>", which is useful for benchmarking how plugins scale with the number of headers.
+	HttpFilterPutRequestHeadersN(contextID uint32, n int)
 	HttpFilterGetRequestHeaders(contextID uint32) (headers [][2]string)
 	HttpFilterPutRequestHeadersEndOfStream(contextID uint32, headers [][2]string, endOfStream bool)
+	// HttpFilterPutResponseHeaders calls OnHttpResponseHeaders with the given headers. The response phases
+	// are driven in the same way as the request ones: the returned action is available from
+	// HttpFilterGetCurrentStreamAction, and the response body is buffered while OnHttpResponseBody pauses.
 	HttpFilterPutResponseHeaders(contextID uint32, headers [][2]string)
+	// HttpFilterGetResponseHeaders returns the current response headers. The modifications made by the plugin
+	// are kept on the context, so they are also visible to the plugin in the later phases such as OnHttpResponseBody.
 	HttpFilterGetResponseHeaders(contextID uint32) (headers [][2]string)
+	// HttpFilterGetResponseHeaderCount returns the number of the current response headers.
+	HttpFilterGetResponseHeaderCount(contextID uint32) int
+	// HttpFilterGetOriginalResponseHeaders returns the response headers given to HttpFilterPutResponseHeaders*
+	// as they were before OnHttpResponseHeaders was called.
+	HttpFilterGetOriginalResponseHeaders(contextID uint32) [][2]string
+	// HttpFilterGetRawRequestHeaderBytes returns the request headers serialized in the format
+	// which is passed to plugins by proxy_get_header_map_pairs.
+	HttpFilterGetRawRequestHeaderBytes(contextID uint32) []byte
+	// HttpFilterGetRawResponseHeaderBytes is the same as HttpFilterGetRawRequestHeaderBytes for the response headers.
+	HttpFilterGetRawResponseHeaderBytes(contextID uint32) []byte
 	HttpFilterPutResponseHeadersEndOfStream(contextID uint32, headers [][2]string, endOfStream bool)
 	HttpFilterPutRequestTrailers(contextID uint32, headers [][2]string)
+	// HttpFilterSetRequestTrailers sets the request trailers without calling the plugin, which emulates
+	// the trailers added by the prior filters. They are passed to the plugin with the ones given to
+	// HttpFilterPutRequestTrailers, and are readable by the plugin in the former phases as well.
+	HttpFilterSetRequestTrailers(contextID uint32, trailers [][2]string)
+	HttpFilterGetRequestTrailers(contextID uint32) [][2]string
+	// HttpFilterPutResponseTrailers calls OnHttpResponseTrailers with the given trailers
+	// followed by the ones added by the plugin in the former phases.
 	HttpFilterPutResponseTrailers(contextID uint32, headers [][2]string)
+	HttpFilterGetResponseTrailers(contextID uint32) [][2]string
 	HttpFilterPutRequestBody(contextID uint32, body []byte)
 	HttpFilterPutRequestBodyEndOfStream(contextID uint32, body []byte, endOfStream bool)
+	// HttpFilterGetRequestBody returns the current request body including the mutations made by the plugin
+	// through proxywasm.SetHttpRequestBody, AppendHttpRequestBody and PrependHttpRequestBody.
 	HttpFilterGetRequestBody(contextID uint32) []byte
+	HttpFilterGetForwardedRequestBodyChunks(contextID uint32) [][]byte
+	// HttpFilterGetForwardedRequestBody returns the request body sent to the upstream so far,
+	// which doesn't include the body still buffered by the plugin. Use HttpFilterGetRequestBody
+	// for the current, possibly buffered, body.
+	HttpFilterGetForwardedRequestBody(contextID uint32) []byte
 	HttpFilterPutResponseBody(contextID uint32, body []byte)
 	HttpFilterPutResponseBodyEndOfStream(contextID uint32, body []byte, endOfStream bool)
 	HttpFilterGetResponseBody(contextID uint32) []byte
+	HttpFilterGetForwardedResponseBodyChunks(contextID uint32) [][]byte
+	// HttpFilterGetForwardedResponseBody is the same as HttpFilterGetForwardedRequestBody for the response body.
+	HttpFilterGetForwardedResponseBody(contextID uint32) []byte
 	HttpFilterCompleteHttpStream(contextID uint32)
+	// HttpFilterGetStreamDoneCount returns the number of times OnHttpStreamDone has been called on the context
+	// by HttpFilterCompleteHttpStream or CompleteContext.
+	HttpFilterGetStreamDoneCount(contextID uint32) int
 	HttpFilterGetCurrentStreamAction(contextID uint32) types.Action
+	// HttpFilterGetActions returns the actions returned by the plugin in each phase of the stream in order,
+	// so that the whole lifecycle can be asserted at once, e.g. request_headers -> Pause, request_body -> Continue.
+	HttpFilterGetActions(contextID uint32) []PhaseAction
+	// HttpFilterGetSentLocalResponse returns the local response sent by the plugin if any, or nil.
+	// Once the local response is sent, the rest of the request and the upstream response given to
+	// HttpFilterPut* are ignored as Envoy stops the filter chain, so the plugin is not called anymore.
 	HttpFilterGetSentLocalResponse(contextID uint32) *LocalHttpResponse
+	// HttpFilterGetRequestSnapshot returns the request given to the context by test code.
+	HttpFilterGetRequestSnapshot(contextID uint32) RequestSnapshot
+	// ReplayRequest drives the given request through a new http context till the end of the stream
+	// and returns the output of the plugin, which can be used to check the plugin behaves the same on retries.
+	ReplayRequest(snapshot RequestSnapshot) ReplayResult
+	// HttpFilterSendResponse drives the given response through the context, i.e. calls OnHttpResponseHeaders,
+	// OnHttpResponseBody for each chunk and OnHttpResponseTrailers, and then completes the stream.
+	// The returned result holds the response forwarded to the downstream before the completion.
+	HttpFilterSendResponse(contextID uint32, response HttpResponse) ResponseResult
 	CallOnLogForAccessLogger(requestHeaders, responseHeaders [][2]string)
+
+	// MeasureAllocations runs f repeatedly and returns the average allocations made by the plugin per run
+	// in the same manner as testing.AllocsPerRun. Only the allocations in the callbacks of http contexts
+	// are counted, so the ones made by the host emulator, e.g. in driving the callbacks and in host calls, are excluded.
+	// The emulator must be created with EmulatorOption.WithAllocationMeasurement.
+	MeasureAllocations(f func()) AllocationStats
+
+	// GetHostCalls returns a copy of the names of the host functions called by the plugin in order,
+	// e.g. "ProxyHttpCall" for proxywasm.DispatchHttpCall. Note that the calls made by test code
+	// through proxywasm functions are recorded as well, which can be cleared by ClearHostCalls.
+	GetHostCalls() []string
+	// ClearHostCalls clears the recorded host calls without resetting the other state,
+	// e.g. after seeding shared data through proxywasm functions in test code.
+	ClearHostCalls()
+	// AssertNotCalled fails the test if the plugin has called the host function with the given name,
+	// which is one of the methods of rawhostcall.ProxyWASMHost, e.g. "ProxyHttpCall".
+	AssertNotCalled(t testing.TB, name string) bool
 }
 
 const (
@@ -70,33 +306,78 @@ type hostEmulator struct {
 	*httpHostEmulator
 
 	effectiveContextID uint32
+	partialBufferReads bool
+
+	// hostCalls is the names of the host functions called by the plugin in order
+	hostCalls []string
+	meter     allocMeter
+
+	lifecycles contextLifecycles
+
+	// the VM state and the host seen by the plugin, which are switched by FilterChain
+	vmState  proxywasm.VMState
+	wasmHost rawhostcall.ProxyWASMHost
 }
 
+// NewHostEmulator creates a new emulator and registers it as the host of the plugin.
+// Emulators are exclusive to each other: the next one can be created only after Done is called.
+// VM-scoped state such as shared data, shared queues and metrics belongs to each emulator,
+// so multiple VM configurations can be tested in sequence without sharing the state.
 func NewHostEmulator(opt *EmulatorOption) HostEmulator {
-	root := newRootHostEmulator(opt.pluginConfiguration, opt.vmConfiguration)
-	network := newNetworkHostEmulator()
-	http := newHttpHostEmulator()
+	hostMux.Lock() // acquire the lock of host emulation
+	return newHostEmulator(opt)
+}
+
+// newHostEmulator creates the emulator of a plugin on a fresh VM state. The caller must hold hostMux.
+func newHostEmulator(opt *EmulatorOption) *hostEmulator {
+	lifecycles := contextLifecycles{}
+	root := newRootHostEmulator(opt.pluginConfiguration, opt.vmConfiguration, opt.fatalLogPanics, lifecycles)
+	network := newNetworkHostEmulator(lifecycles)
+	http := newHttpHostEmulator(opt.strictMode, opt.bodyBufferLimit, lifecycles)
 	emulator := &hostEmulator{
 		root,
 		network,
 		http,
 		0,
+		false,
+		nil,
+		allocMeter{enabled: opt.allocationMeasurement},
+		lifecycles,
+		proxywasm.VMState{},
+		nil,
 	}
 
-	hostMux.Lock() // acquire the lock of host emulation
-	rawhostcall.RegisterMockWASMHost(emulator)
+	var host rawhostcall.ProxyWASMHost = emulator
+	if opt.hostWrapper != nil {
+		host = opt.hostWrapper(emulator)
+	}
+	emulator.wasmHost = &tracingHost{ProxyWASMHost: host, calls: &emulator.hostCalls, meter: &emulator.meter}
+	rawhostcall.RegisterMockWASMHost(emulator.wasmHost)
 
 	// set up state
+	proxywasm.VMStateReset()
 	proxywasm.SetNewRootContext(opt.newRootContext)
 	proxywasm.SetNewStreamContext(opt.newStreamContext)
 	proxywasm.SetNewHttpContext(opt.newHttpContext)
+	if newHttpContext := opt.newHttpContext; newHttpContext != nil && opt.allocationMeasurement {
+		proxywasm.SetNewHttpContext(func(rootContextID, contextID uint32) proxywasm.HttpContext {
+			return &measuredHttpContext{HttpContext: newHttpContext(rootContextID, contextID), meter: &emulator.meter}
+		})
+	}
 
 	// create root context: TODO: support multiple root contexts
 	proxywasm.ProxyOnContextCreate(RootContextID, 0)
 
+	emulator.vmState = proxywasm.VMStateGet()
 	return emulator
 }
 
+// activate makes the plugin of this emulator the one invoked by the emulated host.
+func (h *hostEmulator) activate() {
+	rawhostcall.RegisterMockWASMHost(h.wasmHost)
+	proxywasm.VMStateSet(h.vmState)
+}
+
 func getNextContextID() (ret uint32) {
 	ret = nextContextID
 	nextContextID++
@@ -109,11 +390,52 @@ func (*hostEmulator) Done() {
 	defer proxywasm.VMStateReset()
 }
 
+// impl HostEmulator
+//
+// Reset clears the state recorded so far while keeping the root context, so that a plugin
+// started by StartVM/StartPlugin can be reused across test cases. Logs, metric values, the tick count,
+// queued items, shared data, pending callouts and the recorded callout responses, the host call trace and all http/stream contexts are cleared.
+// Metric definitions, queue registrations, the tick period, properties and configurations
+// are kept as plugins usually hold them in their root context.
+func (h *hostEmulator) Reset() {
+	for _, id := range h.httpHostEmulator.reset() {
+		h.lifecycles.onDelete(id)
+	}
+	for _, id := range h.networkHostEmulator.reset() {
+		h.lifecycles.onDelete(id)
+	}
+	h.rootHostEmulator.reset()
+	h.hostCalls = nil
+	h.lifecycles.reset()
+}
+
+// impl HostEmulator
+func (h *hostEmulator) SetPartialBufferReads(partial bool) {
+	h.partialBufferReads = partial
+}
+
 // impl rawhostcall.ProxyWASMHost
 func (h *hostEmulator) ProxyGetBufferBytes(bt types.BufferType, start int, maxSize int,
+	returnBufferData **byte, returnBufferSize *int) types.Status {
+	st := h.getBufferBytes(bt, start, maxSize, returnBufferData, returnBufferSize)
+	if st != types.StatusOK || !h.partialBufferReads {
+		return st
+	}
+
+	switch bt {
+	case types.BufferTypePluginConfiguration, types.BufferTypeVMConfiguration:
+	default:
+		// return the first half of the requested data
+		*returnBufferSize = (*returnBufferSize + 1) / 2
+	}
+	return st
+}
+
+func (h *hostEmulator) getBufferBytes(bt types.BufferType, start int, maxSize int,
 	returnBufferData **byte, returnBufferSize *int) types.Status {
 	switch bt {
-	case types.BufferTypePluginConfiguration, types.BufferTypeVMConfiguration, types.BufferTypeHttpCallResponseBody:
+	case types.BufferTypePluginConfiguration, types.BufferTypeVMConfiguration, types.BufferTypeHttpCallResponseBody,
+		types.BufferTypeCallData, types.BufferTypeGrpcReceiveBuffer:
 		return h.rootHostEmulatorProxyGetBufferBytes(bt, start, maxSize, returnBufferData, returnBufferSize)
 	case types.BufferTypeDownstreamData, types.BufferTypeUpstreamData:
 		return h.networkHostEmulatorProxyGetBufferBytes(bt, start, maxSize, returnBufferData, returnBufferSize)
@@ -128,8 +450,13 @@ func (h *hostEmulator) ProxySetBufferBytes(bt types.BufferType, start int, maxSi
 	switch bt {
 	case types.BufferTypeHttpRequestBody, types.BufferTypeHttpResponseBody:
 		return h.httpHostEmulatorProxySetBufferBytes(bt, start, maxSize, bufferData, bufferSize)
+	case types.BufferTypeDownstreamData, types.BufferTypeUpstreamData:
+		return h.networkHostEmulatorProxySetBufferBytes(bt, start, maxSize, bufferData, bufferSize)
 	default:
-		panic("unreachable: maybe a bug in this host emulation or SDK")
+		// Note that there's no buffer type for the request body of callouts in the ABI version 0.2.0,
+		// since the body is passed to proxy_http_call directly. Build the body before dispatching instead.
+		log.Printf("buffer type %d cannot be set", bt)
+		return types.StatusBadArgument
 	}
 }
 
@@ -163,27 +490,27 @@ func (h *hostEmulator) ProxyGetHeaderMapPairs(mapType types.MapType, returnValue
 	}
 }
 
-// impl rawhostcall.ProxyWASMHost
-func (h *hostEmulator) ProxySetEffectiveContext(contextID uint32) types.Status {
-	h.effectiveContextID = contextID
-	return types.StatusOK
-}
+var routeNamePropertyPath = string(proxywasm.SerializePropertyPath([]string{"xds", "route_name"}))
 
 // impl rawhostcall.ProxyWASMHost
-func (h *hostEmulator) ProxySetProperty(*byte, int, *byte, int) types.Status {
-	panic("unimplemented")
-}
-
-// impl rawhostcall.ProxyWASMHost
-func (h *hostEmulator) ProxyGetProperty(*byte, int, **byte, *int) types.Status {
-	log.Printf("ProxyGetProperty not implemented in the host emulator yet")
-	return 0
+func (h *hostEmulator) ProxyGetProperty(pathData *byte, pathSize int,
+	returnValueData **byte, returnValueSize *int) types.Status {
+	if proxywasm.RawBytePtrToString(pathData, pathSize) == routeNamePropertyPath {
+		// the route is resolved on every read so that it reflects the current :authority
+		if route, ok := h.httpHostEmulator.resolveRoute(proxywasm.VMStateGetActiveContextID()); ok {
+			ret := []byte(route)
+			*returnValueData = &ret[0]
+			*returnValueSize = len(ret)
+			return types.StatusOK
+		}
+	}
+	return h.rootHostEmulator.ProxyGetProperty(pathData, pathSize, returnValueData, returnValueSize)
 }
 
 // impl rawhostcall.ProxyWASMHost
-func (h *hostEmulator) ProxyResolveSharedQueue(vmIDData *byte, vmIDSize int, nameData *byte, nameSize int, returnID *uint32) types.Status {
-	log.Printf("ProxyResolveSharedQueue not implemented in the host emulator yet")
-	return 0
+func (h *hostEmulator) ProxySetEffectiveContext(contextID uint32) types.Status {
+	h.effectiveContextID = contextID
+	return types.StatusOK
 }
 
 // impl rawhostcall.ProxyWASMHost
@@ -191,9 +518,3 @@ func (h *hostEmulator) ProxyCloseStream(streamType types.StreamType) types.Statu
 	log.Printf("ProxyCloseStream not implemented in the host emulator yet")
 	return 0
 }
-
-// impl rawhostcall.ProxyWASMHost
-func (h *hostEmulator) ProxyDone() types.Status {
-	log.Printf("ProxyDone not implemented in the host emulator yet")
-	return 0
-}
@@ -0,0 +1,566 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxytest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/rawhostcall"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+type resetRootContext struct {
+	proxywasm.DefaultRootContext
+	pluginStarted int
+}
+
+var (
+	resetRequestCounter proxywasm.MetricCounter
+	resetQueueID        uint32
+)
+
+func (ctx *resetRootContext) OnPluginStart(int) bool {
+	ctx.pluginStarted++
+	var err error
+	if resetRequestCounter, err = proxywasm.DefineCounterMetric("requests_total"); err != nil {
+		return false
+	}
+	id, err := proxywasm.RegisterSharedQueue("events")
+	if err != nil {
+		return false
+	}
+	resetQueueID = id
+	return proxywasm.SetTickPeriodMilliSeconds(100) == nil
+}
+
+type resetHttpContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *resetHttpContext) OnHttpRequestHeaders(int, bool) types.Action {
+	resetRequestCounter.Increment(1)
+	_ = proxywasm.SetSharedData("last", []byte("request"), 0)
+	_, _ = proxywasm.DispatchHttpCall("cluster", [][2]string{{":method", "GET"}}, "", nil, 1000,
+		func(int, int, int) {})
+	_ = proxywasm.EnqueueSharedQueue(resetQueueID, []byte("event"))
+	proxywasm.LogInfo("request headers")
+	return types.ActionPause
+}
+
+func TestHostEmulator_Reset(t *testing.T) {
+	root := &resetRootContext{}
+	opt := NewEmulatorOption().
+		WithNewRootContext(func(uint32) proxywasm.RootContext { return root }).
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &resetHttpContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	host.StartPlugin()
+
+	for i := 0; i < 3; i++ {
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestHeaders(id, nil)
+
+		require.Len(t, host.GetLogs(types.LogLevelInfo), 1)
+		require.Len(t, host.GetCalloutAttributesFromContext(id), 1)
+		require.Equal(t, 1, host.GetQueueSize(resetQueueID))
+		require.Equal(t, uint64(1), resetRequestCounter.Get())
+		_, cas, err := proxywasm.GetSharedData("last")
+		require.NoError(t, err)
+		require.Equal(t, uint32(1), cas)
+
+		host.Reset()
+
+		assert.Len(t, host.GetLogs(types.LogLevelInfo), 0)
+		assert.Len(t, host.GetCalloutAttributesFromContext(id), 0)
+		assert.Equal(t, 0, host.GetQueueSize(resetQueueID))
+		assert.Equal(t, uint64(0), resetRequestCounter.Get())
+		_, _, err = proxywasm.GetSharedData("last")
+		assert.Equal(t, types.ErrorStatusNotFound, err)
+
+		// kept across resets
+		assert.Equal(t, uint32(100), host.GetTickPeriod())
+		assert.Len(t, host.GetDefinedMetrics(), 1)
+		assert.Equal(t, 1, root.pluginStarted)
+	}
+}
+
+type unavailableSharedDataHost struct {
+	rawhostcall.ProxyWASMHost
+	calls int
+}
+
+func (h *unavailableSharedDataHost) ProxyGetSharedData(*byte, int, **byte, *int, *uint32) types.Status {
+	h.calls++
+	return types.StatusNotFound
+}
+
+type sharedDataContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *sharedDataContext) OnHttpRequestHeaders(int, bool) types.Action {
+	if _, _, err := proxywasm.GetSharedData("config"); err != nil {
+		proxywasm.LogWarnf("failed to get shared data: %v", err)
+		return types.ActionContinue
+	}
+	proxywasm.LogInfo("shared data found")
+	return types.ActionContinue
+}
+
+func TestHostEmulator_WithHostWrapper(t *testing.T) {
+	wrapped := &unavailableSharedDataHost{}
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &sharedDataContext{} }).
+		WithHostWrapper(func(host rawhostcall.ProxyWASMHost) rawhostcall.ProxyWASMHost {
+			wrapped.ProxyWASMHost = host
+			return wrapped
+		})
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	require.NoError(t, proxywasm.SetSharedData("config", []byte("value"), 0))
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, nil)
+
+	// the overridden call is used while the others are delegated to the emulator.
+	assert.Equal(t, 1, wrapped.calls)
+	assert.Equal(t, []string{"failed to get shared data: error status returned by host: not found"},
+		host.GetLogs(types.LogLevelWarn))
+	assert.Len(t, host.GetLogs(types.LogLevelInfo), 0)
+}
+
+type tenantRootContext struct {
+	proxywasm.DefaultRootContext
+	tenant string
+}
+
+func (ctx *tenantRootContext) OnVMStart(vmConfigurationSize int) bool {
+	config, err := proxywasm.GetVMConfiguration(vmConfigurationSize)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get vm configuration: %v", err)
+		return false
+	}
+	ctx.tenant = string(config)
+
+	// the first VM of the tenant stores the tenant in the VM-scoped shared data
+	if _, _, err := proxywasm.GetSharedData("tenant"); err != types.ErrorStatusNotFound {
+		proxywasm.LogCriticalf("shared data already exists: %v", err)
+		return false
+	}
+	if err := proxywasm.SetSharedData("tenant", config, 0); err != nil {
+		proxywasm.LogCriticalf("failed to set shared data: %v", err)
+		return false
+	}
+
+	counter, err := proxywasm.DefineCounterMetric("vm_starts_" + ctx.tenant)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to define metric: %v", err)
+		return false
+	}
+	counter.Increment(1)
+	return true
+}
+
+type tenantHttpContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *tenantHttpContext) OnHttpRequestHeaders(int, bool) types.Action {
+	tenant, _, err := proxywasm.GetSharedData("tenant")
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get shared data: %v", err)
+		return types.ActionContinue
+	}
+	if err := proxywasm.SetHttpRequestHeader("x-tenant", string(tenant)); err != nil {
+		proxywasm.LogCriticalf("failed to set header: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestHostEmulator_MultipleVMConfigurations(t *testing.T) {
+	run := func(t *testing.T, tenant string) {
+		opt := NewEmulatorOption().
+			WithVMConfiguration([]byte(tenant)).
+			WithNewRootContext(func(uint32) proxywasm.RootContext { return &tenantRootContext{} }).
+			WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &tenantHttpContext{} })
+		host := NewHostEmulator(opt)
+		defer host.Done()
+
+		host.StartVM()
+
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestHeaders(id, nil)
+
+		require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+		assert.Equal(t, [][2]string{{"x-tenant", tenant}}, host.HttpFilterGetRequestHeaders(id))
+		// metrics defined by the other tenant's VM are not visible
+		assert.Equal(t, MetricSnapshot{"vm_starts_" + tenant: 1}, host.GetMetricSnapshot())
+	}
+
+	run(t, "acme")
+	run(t, "globex")
+	// the same configuration starts with a clean state again
+	run(t, "acme")
+}
+
+type cachingContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *cachingContext) OnHttpRequestHeaders(int, bool) types.Action {
+	path, err := proxywasm.GetHttpRequestHeader(":path")
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get path: %v", err)
+		return types.ActionContinue
+	}
+
+	if cached, _, err := proxywasm.GetSharedData("cache:" + path); err == nil {
+		if status := proxywasm.SendHttpResponse(200, nil, string(cached)); status != types.StatusOK {
+			proxywasm.LogCriticalf("failed to send cached response: %v", status)
+		}
+		return types.ActionPause
+	}
+
+	if _, err := proxywasm.DispatchHttpCall("origin", [][2]string{
+		{":method", "GET"}, {":path", path}, {":authority", "origin"},
+	}, "", nil, 1000, func(int, int, int) {}); err != nil {
+		proxywasm.LogCriticalf("failed to dispatch http call: %v", err)
+		return types.ActionContinue
+	}
+	return types.ActionPause
+}
+
+func TestHostEmulator_AssertNotCalled(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &cachingContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	t.Run("cache hit", func(t *testing.T) {
+		host.Reset()
+		require.NoError(t, proxywasm.SetSharedData("cache:/cached", []byte("hello"), 0))
+		// the seeding by the test is not a call made by the plugin
+		assert.Equal(t, []string{"ProxySetSharedData"}, host.GetHostCalls())
+		host.ClearHostCalls()
+
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestHeaders(id, [][2]string{{":path", "/cached"}})
+
+		require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+		host.AssertNotCalled(t, "ProxyHttpCall")
+		host.AssertNotCalled(t, "ProxySetSharedData")
+		calls := host.GetHostCalls()
+		assert.Contains(t, calls, "ProxySendLocalResponse")
+
+		// the returned calls are a copy
+		calls[0] = "ProxyHttpCall"
+		host.AssertNotCalled(t, "ProxyHttpCall")
+	})
+
+	t.Run("cache miss", func(t *testing.T) {
+		host.Reset()
+
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestHeaders(id, [][2]string{{":path", "/uncached"}})
+
+		require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+		assert.Equal(t, []string{"ProxyGetHeaderMapValue", "ProxyGetSharedData", "ProxyHttpCall"}, host.GetHostCalls())
+
+		mock := &testing.T{}
+		assert.False(t, host.AssertNotCalled(mock, "ProxyHttpCall"))
+		assert.True(t, mock.Failed())
+	})
+
+	t.Run("unknown function", func(t *testing.T) {
+		mock := &testing.T{}
+		assert.False(t, host.AssertNotCalled(mock, "ProxyHTTPCall"))
+		assert.True(t, mock.Failed())
+	})
+}
+
+var allocatingContextSink []byte
+
+type allocatingContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *allocatingContext) OnHttpRequestHeaders(int, bool) types.Action {
+	allocatingContextSink = make([]byte, 1024)
+	// the allocations in the host emulator are not counted
+	proxywasm.LogInfo("allocated")
+	return types.ActionContinue
+}
+
+func TestHostEmulator_MeasureAllocations(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &allocatingContext{} }).
+		WithAllocationMeasurement()
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	stats := host.MeasureAllocations(func() {
+		host.HttpFilterPutRequestHeaders(id, [][2]string{{":path", "/"}})
+	})
+	assert.Equal(t, AllocationStats{Allocs: 1, Bytes: 1024}, stats)
+}
+
+func TestHostEmulator_SetBufferBytesUnsupported(t *testing.T) {
+	host := NewHostEmulator(NewEmulatorOption())
+	defer host.Done()
+
+	data := []byte("body")
+	for _, bt := range []types.BufferType{
+		types.BufferTypeHttpCallResponseBody,
+		types.BufferTypePluginConfiguration,
+		types.BufferTypeVMConfiguration,
+	} {
+		assert.Equal(t, types.StatusBadArgument, rawhostcall.ProxySetBufferBytes(bt, 0, len(data), &data[0], len(data)))
+	}
+}
+
+type snapshotContext struct {
+	proxywasm.DefaultHttpContext
+	counter proxywasm.MetricCounter
+}
+
+func (ctx *snapshotContext) OnHttpRequestHeaders(int, bool) types.Action {
+	ctx.counter.Increment(1)
+	path, err := proxywasm.GetHttpRequestHeader(":path")
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get :path: %v", err)
+		return types.ActionContinue
+	}
+	if _, cas, err := proxywasm.GetSharedData("last"); err == nil || err == types.ErrorStatusNotFound {
+		if err := proxywasm.SetSharedData("last", []byte(path), cas); err != nil {
+			proxywasm.LogCriticalf("failed to set shared data: %v", err)
+		}
+	}
+	proxywasm.LogInfof("path: %s", path)
+	return types.ActionContinue
+}
+
+func TestHostEmulator_SnapshotRestore(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext {
+			c, err := proxywasm.DefineCounterMetric("requests")
+			if err != nil {
+				proxywasm.LogCriticalf("failed to define metric: %v", err)
+			}
+			return &snapshotContext{counter: c}
+		})
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	// baseline
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{":path", "/setup"}})
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	baseline := host.Snapshot()
+
+	for _, path := range []string{"/a", "/b"} {
+		path := path
+		t.Run(path, func(t *testing.T) {
+			host.Restore(baseline)
+
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutRequestHeaders(id, [][2]string{{":path", path}})
+			require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+
+			assert.Equal(t, []string{"path: /setup", "path: " + path}, host.GetLogs(types.LogLevelInfo))
+			requests, err := host.GetCounterMetric("requests")
+			require.NoError(t, err)
+			assert.Equal(t, uint64(2), requests)
+			last, cas, found := host.GetSharedData("last")
+			require.True(t, found)
+			assert.Equal(t, path, string(last))
+			assert.Equal(t, uint32(2), cas)
+		})
+	}
+
+	host.Restore(baseline)
+	last, _, _ := host.GetSharedData("last")
+	assert.Equal(t, "/setup", string(last))
+	assert.Equal(t, []string{"path: /setup"}, host.GetLogs(types.LogLevelInfo))
+}
+
+func TestHostEmulator_SnapshotRestoreCallouts(t *testing.T) {
+	var responses []int
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext {
+			return &calloutCountingContext{responses: &responses}
+		})
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	baseline := host.Snapshot()
+
+	require.NoError(t, proxywasm.SetTickPeriodMilliSeconds(1000))
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, nil)
+	attrs := host.GetCalloutAttributesFromContext(id)
+	require.Len(t, attrs, 1)
+
+	// the callout dispatched after the snapshot is discarded along with its context
+	host.Restore(baseline)
+	assert.Equal(t, uint32(0), host.GetTickPeriod())
+	assert.Len(t, host.GetCalloutAttributesFromContext(id), 0)
+	host.PutCalloutResponse(attrs[0].CalloutID, [][2]string{{":status", "200"}}, nil, nil)
+	assert.Len(t, responses, 0)
+
+	// new contexts work on the restored state
+	id = host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, nil)
+	attrs = host.GetCalloutAttributesFromContext(id)
+	require.Len(t, attrs, 1)
+	host.PutCalloutResponse(attrs[0].CalloutID, [][2]string{{":status", "200"}}, nil, []byte("ok"))
+	assert.Equal(t, []int{2}, responses)
+}
+
+func TestHostEmulator_SnapshotRestoreForeignQueues(t *testing.T) {
+	host := NewHostEmulator(NewEmulatorOption())
+	defer host.Done()
+
+	// the queue registered by another VM is resolved to the same id by this VM
+	audit := host.RegisterSharedQueueForVM("audit_vm", "audit")
+	resolved, err := proxywasm.ResolveSharedQueue("audit_vm", "audit")
+	require.NoError(t, err)
+	assert.Equal(t, audit, resolved)
+	baseline := host.Snapshot()
+
+	host.RegisterSharedQueueForVM("metrics_vm", "metrics")
+	_, err = proxywasm.ResolveSharedQueue("metrics_vm", "metrics")
+	require.NoError(t, err)
+
+	host.Restore(baseline)
+	resolved, err = proxywasm.ResolveSharedQueue("audit_vm", "audit")
+	require.NoError(t, err)
+	assert.Equal(t, audit, resolved)
+	_, err = proxywasm.ResolveSharedQueue("metrics_vm", "metrics")
+	assert.Equal(t, types.ErrorStatusNotFound, err)
+
+	// the restored foreign queue keeps accepting enqueues
+	require.NoError(t, proxywasm.EnqueueSharedQueue(audit, []byte("event")))
+	assert.Equal(t, [][]byte{[]byte("event")}, host.GetQueue(audit))
+}
+
+type drainingRootContext struct {
+	proxywasm.DefaultRootContext
+	pending int
+}
+
+func (ctx *drainingRootContext) OnVMDone() bool {
+	proxywasm.LogInfo("draining")
+	if err := proxywasm.SetTickPeriodMilliSeconds(100); err != nil {
+		proxywasm.LogCriticalf("failed to set tick period: %v", err)
+	}
+	return ctx.pending == 0
+}
+
+func (ctx *drainingRootContext) OnTick() {
+	ctx.pending--
+	if ctx.pending > 0 {
+		return
+	}
+	proxywasm.FinishVMContext()
+	// the second call is rejected
+	proxywasm.LogInfof("proxy_done: %v", rawhostcall.ProxyDone())
+}
+
+type completingHttpContext struct {
+	proxywasm.DefaultHttpContext
+	count *int
+}
+
+func (ctx *completingHttpContext) OnHttpStreamDone() { *ctx.count++ }
+
+func TestHostEmulator_CompleteContext(t *testing.T) {
+	t.Run("deferred", func(t *testing.T) {
+		root := &drainingRootContext{pending: 2}
+		opt := NewEmulatorOption().
+			WithNewRootContext(func(uint32) proxywasm.RootContext { return root })
+		host := NewHostEmulator(opt)
+		defer host.Done()
+
+		host.CompleteContext(RootContextID)
+		assert.Equal(t, []string{"draining"}, host.GetLogs(types.LogLevelInfo))
+		assert.Equal(t, 0, host.GetContextDeleteCount(RootContextID))
+
+		// not deleted until the plugin calls proxy_done
+		host.Tick()
+		host.CompleteContext(RootContextID)
+		assert.Equal(t, 0, host.GetContextDeleteCount(RootContextID))
+
+		host.Tick()
+		require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+		assert.Equal(t, []string{"draining", "proxy_done: 2"}, host.GetLogs(types.LogLevelInfo))
+		host.CompleteContext(RootContextID)
+		host.CompleteContext(RootContextID)
+		// OnVMDone is not called again
+		assert.Equal(t, []string{"draining", "proxy_done: 2"}, host.GetLogs(types.LogLevelInfo))
+		assert.Equal(t, 1, host.GetContextDeleteCount(RootContextID))
+	})
+
+	t.Run("http stream", func(t *testing.T) {
+		var count int
+		opt := NewEmulatorOption().
+			WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext {
+				return &completingHttpContext{count: &count}
+			})
+		host := NewHostEmulator(opt)
+		defer host.Done()
+
+		id := host.HttpFilterInitContext()
+		host.CompleteContext(id)
+		host.CompleteContext(id)
+		assert.Equal(t, 1, count)
+		assert.Equal(t, 1, host.GetContextDeleteCount(id))
+
+		// the deleted context is not deleted again on Reset
+		host.Reset()
+	})
+	t.Run("mixed with HttpFilterCompleteHttpStream", func(t *testing.T) {
+		var count int
+		opt := NewEmulatorOption().
+			WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext {
+				return &completingHttpContext{count: &count}
+			})
+		host := NewHostEmulator(opt)
+		defer host.Done()
+
+		completed := host.HttpFilterInitContext()
+		host.HttpFilterCompleteHttpStream(completed)
+		assert.Equal(t, 1, host.GetContextDeleteCount(completed))
+		host.CompleteContext(completed)
+		host.HttpFilterCompleteHttpStream(completed)
+		assert.Equal(t, 1, count)
+		assert.Equal(t, 1, host.GetContextDeleteCount(completed))
+
+		id := host.HttpFilterInitContext()
+		host.CompleteContext(id)
+		host.HttpFilterCompleteHttpStream(id)
+		assert.Equal(t, 2, count)
+		assert.Equal(t, 1, host.GetContextDeleteCount(id))
+	})
+
+	t.Run("network connection", func(t *testing.T) {
+		opt := NewEmulatorOption().
+			WithNewStreamContext(func(uint32, uint32) proxywasm.StreamContext { return &lineStreamContext{} })
+		host := NewHostEmulator(opt)
+		defer host.Done()
+
+		id := host.NetworkFilterInitConnection()
+		host.NetworkFilterCompleteConnection(id)
+		host.CompleteContext(id)
+		host.NetworkFilterCompleteConnection(id)
+		assert.Equal(t, 1, host.GetContextDeleteCount(id))
+	})
+}
@@ -15,7 +15,15 @@
 package proxytest
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"log"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
@@ -24,27 +32,63 @@ import (
 type (
 	rootHostEmulator struct {
 		logs       [types.LogLevelMax][]string
+		allLogs    []LogEntry // in the order of logging
 		tickPeriod uint32
+		tickCount  int
+
+		validateLogUTF8 bool
+		fatalLogPanics  bool
+		pluginStarted   bool
 
 		queues      map[uint32][][]byte
 		queueNameID map[string]uint32
+		// foreignQueueNameID holds the queues owned by other VMs
+		foreignQueueNameID map[[2]string]uint32 // key: [vm_id, name]
+		foreignQueueIDs    map[uint32]bool
+		// pendingReadyQueueIDs holds the queues to be notified by OnQueueReady in order
+		pendingReadyQueueIDs  []uint32
+		dispatchingQueueReady bool
 
 		sharedDataKVS map[string]*sharedData
 
+		properties map[string][]byte // key: serialized property path
+
+		foreignFunctions map[string]func(param []byte) ([]byte, error)
+		foreignCallData  []byte
+		// inBufferCallback is true while the foreign call data or a gRPC message is being delivered
+		inBufferCallback bool
+
 		metricIDToValue map[uint32]uint64
+		// histogramValues holds all the values recorded to histograms in order
+		histogramValues map[uint32][]uint64
 		metricIDToType  map[uint32]types.MetricType
 		metricNameToID  map[string]uint32
 
 		httpContextIDToCalloutInfos map[uint32][]HttpCalloutAttribute // key: contextID
-		httpCalloutIDToContextID    map[uint32]uint32                 // key: calloutID
+		httpCalloutIDToContextID    map[uint32]uint32                 // key: calloutID, removed once responded
 		httpCalloutResponse         map[uint32]struct {               // key: calloutID
 			headers, trailers [][2]string
 			body              []byte
 		}
 
+		// gRPC calls and streams share the ids with http callouts
+		grpcContextIDToCalloutInfos map[uint32][]GrpcCalloutAttribute // key: contextID
+		grpcCalloutIDToContextID    map[uint32]uint32                 // key: calloutID, removed once responded
+		grpcContextIDToStreams      map[uint32][]*GrpcStreamAttribute // key: contextID
+		grpcStreams                 map[uint32]*GrpcStreamAttribute   // key: streamID
+		grpcReceiveBuffer           []byte                            // the message being delivered
+
 		pluginConfiguration, vmConfiguration []byte
 
 		activeCalloutID uint32
+		nextCalloutID   uint32
+
+		calloutBodyLimit    int             // zero means unlimited
+		truncatedCalloutIDs map[uint32]bool // key: calloutID
+		// calloutResponseHeaders holds the headers of the delivered callout responses
+		calloutResponseHeaders map[uint32][][2]string // key: calloutID
+
+		lifecycles contextLifecycles
 	}
 
 	HttpCalloutAttribute struct {
@@ -52,6 +96,22 @@ type (
 		Upstream          string
 		Headers, Trailers [][2]string
 		Body              []byte
+		// Timeout is the timeout given to proxywasm.DispatchHttpCall.
+		Timeout time.Duration
+	}
+
+	MetricDefinition struct {
+		Name string
+		Type types.MetricType
+	}
+
+	// MetricSnapshot holds the metric values at a point of time keyed by metric names.
+	MetricSnapshot map[string]uint64
+
+	// LogEntry is a message logged by the plugin.
+	LogEntry struct {
+		Level   types.LogLevel
+		Message string
 	}
 )
 
@@ -60,12 +120,18 @@ type sharedData struct {
 	cas  uint32
 }
 
-func newRootHostEmulator(pluginConfiguration, vmConfiguration []byte) *rootHostEmulator {
+func newRootHostEmulator(pluginConfiguration, vmConfiguration []byte, fatalLogPanics bool,
+	lifecycles contextLifecycles) *rootHostEmulator {
 	host := &rootHostEmulator{
 		queues:                      map[uint32][][]byte{},
 		queueNameID:                 map[string]uint32{},
+		foreignQueueNameID:          map[[2]string]uint32{},
+		foreignQueueIDs:             map[uint32]bool{},
 		sharedDataKVS:               map[string]*sharedData{},
+		properties:                  map[string][]byte{},
+		foreignFunctions:            map[string]func(param []byte) ([]byte, error){},
 		metricIDToValue:             map[uint32]uint64{},
+		histogramValues:             map[uint32][]uint64{},
 		metricIDToType:              map[uint32]types.MetricType{},
 		metricNameToID:              map[string]uint32{},
 		httpContextIDToCalloutInfos: map[uint32][]HttpCalloutAttribute{},
@@ -74,19 +140,38 @@ func newRootHostEmulator(pluginConfiguration, vmConfiguration []byte) *rootHostE
 			headers, trailers [][2]string
 			body              []byte
 		}{},
+		truncatedCalloutIDs:    map[uint32]bool{},
+		calloutResponseHeaders: map[uint32][][2]string{},
 
+		grpcContextIDToCalloutInfos: map[uint32][]GrpcCalloutAttribute{},
+		grpcCalloutIDToContextID:    map[uint32]uint32{},
+		grpcContextIDToStreams:      map[uint32][]*GrpcStreamAttribute{},
+		grpcStreams:                 map[uint32]*GrpcStreamAttribute{},
+
+		fatalLogPanics:      fatalLogPanics,
 		pluginConfiguration: pluginConfiguration,
 		vmConfiguration:     vmConfiguration,
+		lifecycles:          lifecycles,
 	}
 	return host
 }
 
 // impl rawhostcall.ProxyWASMHost
 func (r *rootHostEmulator) ProxyLog(logLevel types.LogLevel, messageData *byte, messageSize int) types.Status {
-	str := proxywasm.RawBytePtrToString(messageData, messageSize)
+	// copied so that the recorded line, including any prefix added by the plugin, is kept intact
+	// even if the plugin reuses the memory of the message afterwards
+	str := string(proxywasm.RawBytePtrToByteSlice(messageData, messageSize))
+	if r.validateLogUTF8 && !utf8.ValidString(str) {
+		panic(fmt.Sprintf("invalid UTF-8 in %s log message: %q", logLevel, str))
+	}
 
 	log.Printf("proxy_%s_log: %s", logLevel, str)
 	r.logs[logLevel] = append(r.logs[logLevel], str)
+	r.allLogs = append(r.allLogs, LogEntry{Level: logLevel, Message: str})
+	if r.fatalLogPanics && logLevel == types.LogLevelCritical {
+		// Envoy terminates the VM on the fatal log
+		panic(FatalLogPanicValue(str))
+	}
 	return types.StatusOK
 }
 
@@ -96,6 +181,42 @@ func (r *rootHostEmulator) ProxySetTickPeriodMilliseconds(period uint32) types.S
 	return types.StatusOK
 }
 
+// impl rawhostcall.ProxyWASMHost
+func (r *rootHostEmulator) ProxyCallForeignFunction(funcNameData *byte, funcNameSize int,
+	paramData *byte, paramSize int, returnData **byte, returnSize *int) types.Status {
+	name := proxywasm.RawBytePtrToString(funcNameData, funcNameSize)
+	f, ok := r.foreignFunctions[name]
+	if !ok {
+		log.Printf("foreign function %s is not registered", name)
+		return types.StatusNotFound
+	}
+
+	ret, err := f(proxywasm.RawBytePtrToByteSlice(paramData, paramSize))
+	if err != nil {
+		log.Printf("foreign function %s failed: %v", name, err)
+		return types.StatusInternalFailure
+	}
+	if len(ret) == 0 {
+		*returnData = nil
+	} else {
+		*returnData = &ret[0]
+	}
+	*returnSize = len(ret)
+	return types.StatusOK
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) RegisterForeignFunction(name string, f func(param []byte) ([]byte, error)) {
+	r.foreignFunctions[name] = f
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) CallOnForeignFunction(funcID uint32, data []byte) {
+	r.foreignCallData, r.inBufferCallback = data, true
+	defer func() { r.foreignCallData, r.inBufferCallback = nil, false }()
+	proxywasm.ProxyOnForeignFunction(RootContextID, funcID, len(data))
+}
+
 // impl rawhostcall.ProxyWASMHost
 func (r *rootHostEmulator) ProxyRegisterSharedQueue(nameData *byte, nameSize int, returnID *uint32) types.Status {
 	name := proxywasm.RawBytePtrToString(nameData, nameSize)
@@ -111,6 +232,22 @@ func (r *rootHostEmulator) ProxyRegisterSharedQueue(nameData *byte, nameSize int
 	return types.StatusOK
 }
 
+// impl rawhostcall.ProxyWASMHost
+func (r *rootHostEmulator) ProxyResolveSharedQueue(vmIDData *byte, vmIDSize int, nameData *byte, nameSize int, returnID *uint32) types.Status {
+	vmID := proxywasm.RawBytePtrToString(vmIDData, vmIDSize)
+	name := proxywasm.RawBytePtrToString(nameData, nameSize)
+	if id, ok := r.foreignQueueNameID[[2]string{vmID, name}]; ok {
+		*returnID = id
+		return types.StatusOK
+	}
+	// the queues registered by this VM, whose vm_id is empty in the emulator
+	if id, ok := r.queueNameID[name]; ok && vmID == "" {
+		*returnID = id
+		return types.StatusOK
+	}
+	return types.StatusNotFound
+}
+
 // impl rawhostcall.ProxyWASMHost
 func (r *rootHostEmulator) ProxyDequeueSharedQueue(queueID uint32, returnValueData **byte, returnValueSize *int) types.Status {
 	queue, ok := r.queues[queueID]
@@ -137,11 +274,36 @@ func (r *rootHostEmulator) ProxyEnqueueSharedQueue(queueID uint32, valueData *by
 		return types.StatusNotFound
 	}
 
-	r.queues[queueID] = append(queue, proxywasm.RawBytePtrToByteSlice(valueData, valueSize))
+	// copied as the plugin may reuse the memory after the call
+	r.queues[queueID] = append(queue, append([]byte{}, proxywasm.RawBytePtrToByteSlice(valueData, valueSize)...))
+	if r.foreignQueueIDs[queueID] {
+		// the VM owning the queue is notified instead
+		return types.StatusOK
+	}
+
+	r.pendingReadyQueueIDs = append(r.pendingReadyQueueIDs, queueID)
+	if r.dispatchingQueueReady {
+		// enqueued in OnQueueReady: notified after the current callback returns rather than recursively,
+		// as Envoy posts the notification to the dispatcher
+		return types.StatusOK
+	}
 
 	// note that this behavior is not accurate for some old host implementations:
 	//	see: https://github.com/proxy-wasm/proxy-wasm-cpp-host/pull/36
-	proxywasm.ProxyOnQueueReady(RootContextID, queueID) // Note that this behavior is not accurate on Istio before 1.8.x
+	// the callback is invoked synchronously here, so the active context of the caller has to be
+	// restored afterwards so that its subsequent host calls are made on its own context.
+	active := proxywasm.VMStateGetActiveContextID()
+	r.dispatchingQueueReady = true
+	defer func() {
+		r.dispatchingQueueReady = false
+		r.pendingReadyQueueIDs = nil
+		proxywasm.VMStateSetActiveContextID(active)
+	}()
+	for len(r.pendingReadyQueueIDs) > 0 {
+		id := r.pendingReadyQueueIDs[0]
+		r.pendingReadyQueueIDs = r.pendingReadyQueueIDs[1:]
+		proxywasm.ProxyOnQueueReady(RootContextID, id) // Note that this behavior is not accurate on Istio before 1.8.x
+	}
 	return types.StatusOK
 }
 
@@ -151,7 +313,7 @@ func (r *rootHostEmulator) ProxyGetSharedData(keyData *byte, keySize int,
 	key := proxywasm.RawBytePtrToString(keyData, keySize)
 
 	value, ok := r.sharedDataKVS[key]
-	if !ok {
+	if !ok || len(value.data) == 0 {
 		return types.StatusNotFound
 	}
 
@@ -164,31 +326,79 @@ func (r *rootHostEmulator) ProxyGetSharedData(keyData *byte, keySize int,
 // impl rawhostcall.ProxyWASMHost
 func (r *rootHostEmulator) ProxySetSharedData(keyData *byte, keySize int,
 	valueData *byte, valueSize int, cas uint32) types.Status {
-	key := proxywasm.RawBytePtrToString(keyData, keySize)
-	value := proxywasm.RawBytePtrToByteSlice(valueData, valueSize)
+	key := string(proxywasm.RawBytePtrToByteSlice(keyData, keySize))
+	// copied as the plugin may reuse the memory after the call
+	value := append([]byte(nil), proxywasm.RawBytePtrToByteSlice(valueData, valueSize)...)
 
 	prev, ok := r.sharedDataKVS[key]
+	if len(value) == 0 {
+		// an empty value deletes the key as Envoy does
+		if !ok {
+			return types.StatusNotFound
+		} else if cas != 0 && prev.cas != cas {
+			return types.StatusCasMismatch
+		}
+		delete(r.sharedDataKVS, key)
+		return types.StatusOK
+	}
+
 	if !ok {
+		// Envoy ignores the given cas on the first write of the key
 		r.sharedDataKVS[key] = &sharedData{
 			data: value,
-			cas:  cas + 1,
+			cas:  1,
 		}
 		return types.StatusOK
 	}
 
-	if prev.cas != cas {
+	// cas 0 means the unconditional write
+	if cas != 0 && prev.cas != cas {
 		return types.StatusCasMismatch
 	}
 
-	r.sharedDataKVS[key].cas = cas + 1
+	r.sharedDataKVS[key].cas = prev.cas + 1
 	r.sharedDataKVS[key].data = value
 	return types.StatusOK
 }
 
+// impl rawhostcall.ProxyWASMHost
+func (r *rootHostEmulator) ProxyGetProperty(pathData *byte, pathSize int,
+	returnValueData **byte, returnValueSize *int) types.Status {
+	path := proxywasm.RawBytePtrToString(pathData, pathSize)
+
+	value, ok := r.properties[path]
+	if !ok {
+		return types.StatusNotFound
+	}
+
+	if len(value) == 0 {
+		*returnValueData = nil
+		*returnValueSize = 0
+		return types.StatusOK
+	}
+	// a fresh copy is returned as the real hosts do, so that the stored value is never modified by plugins
+	ret := append([]byte{}, value...)
+	*returnValueData = &ret[0]
+	*returnValueSize = len(ret)
+	return types.StatusOK
+}
+
+// impl rawhostcall.ProxyWASMHost
+func (r *rootHostEmulator) ProxySetProperty(pathData *byte, pathSize int, valueData *byte, valueSize int) types.Status {
+	path := proxywasm.RawBytePtrToString(pathData, pathSize)
+	r.properties[path] = append([]byte{}, proxywasm.RawBytePtrToByteSlice(valueData, valueSize)...)
+	return types.StatusOK
+}
+
 // impl rawhostcall.ProxyWASMHost
 func (r *rootHostEmulator) ProxyDefineMetric(metricType types.MetricType,
 	metricNameData *byte, metricNameSize int, returnMetricIDPtr *uint32) types.Status {
 	name := proxywasm.RawBytePtrToString(metricNameData, metricNameSize)
+	if name == "" {
+		log.Printf("metric name must not be empty")
+		return types.StatusBadArgument
+	}
+
 	id, ok := r.metricNameToID[name]
 	if !ok {
 		id = uint32(len(r.metricNameToID))
@@ -206,6 +416,10 @@ func (r *rootHostEmulator) ProxyIncrementMetric(metricID uint32, offset int64) t
 	if !ok {
 		return types.StatusBadArgument
 	}
+	if r.metricIDToType[metricID] == types.MetricTypeHistogram {
+		log.Printf("histogram %d cannot be incremented", metricID)
+		return types.StatusBadArgument
+	}
 
 	r.metricIDToValue[metricID] = val + uint64(offset)
 	return types.StatusOK
@@ -217,12 +431,20 @@ func (r *rootHostEmulator) ProxyRecordMetric(metricID uint32, value uint64) type
 	if !ok {
 		return types.StatusBadArgument
 	}
+	if r.metricIDToType[metricID] == types.MetricTypeCounter {
+		log.Printf("counter %d cannot be recorded", metricID)
+		return types.StatusBadArgument
+	}
 	r.metricIDToValue[metricID] = value
+	if r.metricIDToType[metricID] == types.MetricTypeHistogram {
+		r.histogramValues[metricID] = append(r.histogramValues[metricID], value)
+	}
 	return types.StatusOK
 }
 
 // impl rawhostcall.ProxyWASMHost
 func (r *rootHostEmulator) ProxyGetMetric(metricID uint32, returnMetricValue *uint64) types.Status {
+	// the last recorded value for histograms
 	value, ok := r.metricIDToValue[metricID]
 	if !ok {
 		return types.StatusBadArgument
@@ -244,7 +466,9 @@ func (r *rootHostEmulator) ProxyHttpCall(upstreamData *byte, upstreamSize int, h
 	log.Printf("[http callout to %s] body: %s", upstream, body)
 	log.Printf("[http callout to %s] trailers: %v", upstream, trailers)
 
-	calloutID := uint32(len(r.httpCalloutIDToContextID))
+	// ids are never reused even after the responses are delivered
+	calloutID := r.nextCalloutID
+	r.nextCalloutID++
 	contextID := proxywasm.VMStateGetActiveContextID()
 	r.httpCalloutIDToContextID[calloutID] = contextID
 	r.httpContextIDToCalloutInfos[contextID] = append(r.httpContextIDToCalloutInfos[contextID], HttpCalloutAttribute{
@@ -253,6 +477,7 @@ func (r *rootHostEmulator) ProxyHttpCall(upstreamData *byte, upstreamSize int, h
 		Headers:   headers,
 		Trailers:  trailers,
 		Body:      []byte(body),
+		Timeout:   time.Duration(timeout) * time.Millisecond,
 	})
 
 	*calloutIDPtr = calloutID
@@ -263,7 +488,8 @@ func (r *rootHostEmulator) ProxyHttpCall(upstreamData *byte, upstreamSize int, h
 func (r *rootHostEmulator) rootHostEmulatorProxyGetHeaderMapPairs(mapType types.MapType, returnValueData **byte, returnValueSize *int) types.Status {
 	res, ok := r.httpCalloutResponse[r.activeCalloutID]
 	if !ok {
-		log.Fatalf("callout response unregistered for %d", r.activeCalloutID)
+		log.Printf("callout response unregistered for %d", r.activeCalloutID)
+		return types.StatusBadArgument
 	}
 
 	var raw []byte
@@ -286,7 +512,8 @@ func (r *rootHostEmulator) rootHostEmulatorProxyGetMapValue(mapType types.MapTyp
 	keySize int, returnValueData **byte, returnValueSize *int) types.Status {
 	res, ok := r.httpCalloutResponse[r.activeCalloutID]
 	if !ok {
-		log.Fatalf("callout response unregistered for %d", r.activeCalloutID)
+		log.Printf("callout response unregistered for %d", r.activeCalloutID)
+		return types.StatusBadArgument
 	}
 
 	key := proxywasm.RawBytePtrToString(keyData, keySize)
@@ -301,11 +528,11 @@ func (r *rootHostEmulator) rootHostEmulatorProxyGetMapValue(mapType types.MapTyp
 		panic("unimplemented")
 	}
 
+	// header names are case-insensitive as in Envoy
 	for _, h := range hs {
-		if h[0] == key {
-			v := []byte(h[1])
-			*returnValueData = &v[0]
-			*returnValueSize = len(v)
+		if strings.EqualFold(h[0], key) {
+			*returnValueData = valueBytePtr(h[1])
+			*returnValueSize = len(h[1])
 			return types.StatusOK
 		}
 	}
@@ -317,22 +544,35 @@ func (r *rootHostEmulator) rootHostEmulatorProxyGetMapValue(mapType types.MapTyp
 func (r *rootHostEmulator) rootHostEmulatorProxyGetBufferBytes(bt types.BufferType, start int, maxSize int,
 	returnBufferData **byte, returnBufferSize *int) types.Status {
 	var buf []byte
+	// received is true if the buffer is being delivered to the plugin, which reads an empty one as empty
+	var received bool
 	switch bt {
 	case types.BufferTypePluginConfiguration:
 		buf = r.pluginConfiguration
 	case types.BufferTypeVMConfiguration:
 		buf = r.vmConfiguration
 	case types.BufferTypeHttpCallResponseBody:
-		activeID := proxywasm.VMStateGetActiveContextID()
+		// large bodies are read through repeated windows of [start, start+maxSize)
 		res, ok := r.httpCalloutResponse[r.activeCalloutID]
 		if !ok {
-			log.Fatalf("callout response unregistered for %d", activeID)
+			log.Printf("callout response unregistered for %d", r.activeCalloutID)
+			return types.StatusBadArgument
 		}
-		buf = res.body
+		buf, received = res.body, true
+	case types.BufferTypeCallData:
+		buf, received = r.foreignCallData, r.inBufferCallback
+	case types.BufferTypeGrpcReceiveBuffer:
+		buf, received = r.grpcReceiveBuffer, r.inBufferCallback
 	default:
 		panic("unreachable: maybe a bug in this host emulation or SDK")
 	}
 
+	if len(buf) == 0 && start == 0 && received {
+		*returnBufferData = &emptyBuffer[0]
+		*returnBufferSize = 0
+		return types.StatusOK
+	}
+
 	if start >= len(buf) {
 		log.Printf("start index out of range: %d (start) >= %d ", start, len(buf))
 		return types.StatusBadArgument
@@ -347,12 +587,114 @@ func (r *rootHostEmulator) rootHostEmulatorProxyGetBufferBytes(bt types.BufferTy
 	return types.StatusOK
 }
 
+func (r *rootHostEmulator) reset() {
+	r.logs = [types.LogLevelMax][]string{}
+	r.allLogs = nil
+	r.tickCount = 0
+	for id := range r.metricIDToValue {
+		r.metricIDToValue[id] = 0
+	}
+	r.histogramValues = map[uint32][]uint64{}
+	for id := range r.queues {
+		r.queues[id] = [][]byte{}
+	}
+	r.sharedDataKVS = map[string]*sharedData{}
+	r.resetCallouts()
+}
+
+// resetCallouts discards the pending http callouts, gRPC calls and streams, and the recorded callout responses.
+func (r *rootHostEmulator) resetCallouts() {
+	r.httpContextIDToCalloutInfos = map[uint32][]HttpCalloutAttribute{}
+	r.httpCalloutIDToContextID = map[uint32]uint32{}
+	r.truncatedCalloutIDs = map[uint32]bool{}
+	r.calloutResponseHeaders = map[uint32][][2]string{}
+	r.grpcContextIDToCalloutInfos = map[uint32][]GrpcCalloutAttribute{}
+	r.grpcCalloutIDToContextID = map[uint32]uint32{}
+	r.grpcContextIDToStreams = map[uint32][]*GrpcStreamAttribute{}
+	r.grpcStreams = map[uint32]*GrpcStreamAttribute{}
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetSharedData(key string) (value []byte, cas uint32, found bool) {
+	data, ok := r.sharedDataKVS[key]
+	if !ok {
+		return nil, 0, false
+	}
+	return append([]byte(nil), data.data...), data.cas, true
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) AssertSharedData(t testing.TB, key string, expected []byte) bool {
+	t.Helper()
+	value, ok := r.sharedDataKVS[key]
+	if !ok {
+		t.Errorf("shared data %s is not found", key)
+		return false
+	}
+	if bytes.Equal(value.data, expected) {
+		return true
+	}
+
+	offset := 0
+	for offset < len(value.data) && offset < len(expected) && value.data[offset] == expected[offset] {
+		offset++
+	}
+	t.Errorf("shared data %s differs at byte %d:\nexpected: %q\nactual  : %q", key, offset, expected, value.data)
+	return false
+}
+
 // impl HostEmulator
 func (r *rootHostEmulator) GetLogs(level types.LogLevel) []string {
+	logs, err := r.GetLogsE(level)
+	if err != nil {
+		// panics instead of exiting the process so that only the calling test fails
+		panic(err)
+	}
+	return logs
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetLogsE(level types.LogLevel) ([]string, error) {
+	if level >= types.LogLevelMax {
+		return nil, fmt.Errorf("invalid log level: %d", level)
+	}
+	return r.logs[level], nil
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetLogsAtOrAbove(level types.LogLevel) []string {
 	if level >= types.LogLevelMax {
-		log.Fatalf("invalid log level: %d", level)
+		panic(fmt.Sprintf("invalid log level: %d", level))
+	}
+	var ret []string
+	for l := level; l < types.LogLevelMax; l++ {
+		ret = append(ret, r.logs[l]...)
+	}
+	return ret
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetAllLogs() []LogEntry {
+	return append([]LogEntry{}, r.allLogs...)
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) AssertMaxLogs(t testing.TB, n int) bool {
+	t.Helper()
+	lines := make([]string, 0, len(r.allLogs))
+	for _, e := range r.allLogs {
+		lines = append(lines, fmt.Sprintf("[%s] %s", e.Level, e.Message))
+	}
+	if len(lines) > n {
+		t.Errorf("at most %d lines should be logged but logged %d lines:\n%s", n, len(lines), strings.Join(lines, "\n"))
+		return false
 	}
-	return r.logs[level]
+	return true
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) SetValidateLogUTF8(validate bool) {
+	r.validateLogUTF8 = validate
 }
 
 // impl HostEmulator
@@ -360,16 +702,251 @@ func (r *rootHostEmulator) GetTickPeriod() uint32 {
 	return r.tickPeriod
 }
 
+// impl HostEmulator
+func (r *rootHostEmulator) TickEnabled() bool {
+	return r.tickPeriod > 0
+}
+
 // impl HostEmulator
 func (r *rootHostEmulator) Tick() {
+	if r.tickPeriod == 0 {
+		// the host never fires ticks unless the plugin sets the period
+		log.Printf("tick ignored as the tick period is not set")
+		return
+	}
+	r.tickCount++
 	proxywasm.ProxyOnTick(RootContextID)
 }
 
+// impl HostEmulator
+func (r *rootHostEmulator) TickMultiple(n int) {
+	for i := 0; i < n; i++ {
+		r.Tick()
+	}
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) TickState() (periodMs uint32, enabled bool, fireCount int) {
+	return r.tickPeriod, r.TickEnabled(), r.tickCount
+}
+
 // impl HostEmulator
 func (r *rootHostEmulator) GetQueueSize(queueID uint32) int {
 	return len(r.queues[queueID])
 }
 
+// impl HostEmulator
+func (r *rootHostEmulator) GetQueue(queueID uint32) [][]byte {
+	queue := r.queues[queueID]
+	ret := make([][]byte, len(queue))
+	copy(ret, queue)
+	return ret
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) RegisterSharedQueueForVM(vmID, name string) uint32 {
+	if id, ok := r.foreignQueueNameID[[2]string{vmID, name}]; ok {
+		return id
+	}
+
+	id := uint32(len(r.queues))
+	r.queues[id] = [][]byte{}
+	r.foreignQueueNameID[[2]string{vmID, name}] = id
+	r.foreignQueueIDs[id] = true
+	return id
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetRegisteredQueues() []string {
+	ret := make([]string, 0, len(r.queueNameID))
+	for name := range r.queueNameID {
+		ret = append(ret, name)
+	}
+	// returned in the order of registration
+	sort.Slice(ret, func(i, j int) bool { return r.queueNameID[ret[i]] < r.queueNameID[ret[j]] })
+	return ret
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) SetProperty(path []string, value []byte) {
+	// copied as the host owns the property values
+	r.properties[string(proxywasm.SerializePropertyPath(path))] = append([]byte{}, value...)
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetProperty(path []string) ([]byte, bool) {
+	value, ok := r.properties[string(proxywasm.SerializePropertyPath(path))]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte{}, value...), true
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) SetTrafficDirection(direction types.TrafficDirection) {
+	// encoded as a 64-bit little endian integer as Envoy does
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(direction))
+	r.SetProperty([]string{"listener_direction"}, buf)
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) SetHttpRequestProtocol(protocol string) {
+	r.SetProperty([]string{"request", "protocol"}, []byte(protocol))
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) SetUpstreamClusterName(name string) {
+	r.SetProperty([]string{"xds", "cluster_name"}, []byte(name))
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) SetRequestTotalSize(size int64) {
+	// encoded as a 64-bit little endian integer as Envoy does
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(size))
+	r.SetProperty([]string{"request", "total_size"}, buf)
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) SetDurationProperty(path []string, d time.Duration) {
+	// encoded as nanoseconds in a 64-bit little endian integer as Envoy does
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, uint64(d.Nanoseconds()))
+	r.SetProperty(path, buf)
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) SetTypedFilterState(key, typeURL string, value []byte) {
+	r.properties[key] = proxywasm.SerializeAny(typeURL, value)
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetTypedFilterState(key string) (string, []byte, bool) {
+	raw, ok := r.properties[key]
+	if !ok {
+		return "", nil, false
+	}
+
+	typeURL, value, err := proxywasm.DeserializeAny(raw)
+	if err != nil {
+		log.Fatalf("filter state %s is not google.protobuf.Any: %v", key, err)
+	}
+	return typeURL, append([]byte{}, value...), true
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetDefinedMetrics() []MetricDefinition {
+	ids := make([]uint32, 0, len(r.metricNameToID))
+	idToName := make(map[uint32]string, len(r.metricNameToID))
+	for name, id := range r.metricNameToID {
+		ids = append(ids, id)
+		idToName[id] = name
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// returned in the order of definition
+	ret := make([]MetricDefinition, len(ids))
+	for i, id := range ids {
+		ret[i] = MetricDefinition{Name: idToName[id], Type: r.metricIDToType[id]}
+	}
+	return ret
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetMetricID(name string) (uint32, bool) {
+	id, ok := r.metricNameToID[name]
+	return id, ok
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetMetricByID(id uint32) (uint64, bool) {
+	if _, ok := r.metricIDToType[id]; !ok {
+		return 0, false
+	}
+	return r.metricIDToValue[id], true
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetCounterMetric(name string) (uint64, error) {
+	return r.getMetric(name, types.MetricTypeCounter)
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetGaugeMetric(name string) (uint64, error) {
+	return r.getMetric(name, types.MetricTypeGauge)
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetHistogramValues(metricID uint32) []uint64 {
+	return append([]uint64(nil), r.histogramValues[metricID]...)
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) AssertGaugeNonNegative(t testing.TB, name string) bool {
+	t.Helper()
+	value, err := r.GetGaugeMetric(name)
+	if err != nil {
+		t.Error(err)
+		return false
+	}
+	// gauges are decremented by adding negative offsets, which wrap around the unsigned value
+	if v := int64(value); v < 0 {
+		t.Errorf("gauge %s is negative: %d", name, v)
+		return false
+	}
+	return true
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetHistogramMetric(name string) (uint64, error) {
+	return r.getMetric(name, types.MetricTypeHistogram)
+}
+
+func (r *rootHostEmulator) getMetric(name string, metricType types.MetricType) (uint64, error) {
+	id, ok := r.metricNameToID[name]
+	if !ok {
+		return 0, fmt.Errorf("metric %s is not defined", name)
+	}
+	if actual := r.metricIDToType[id]; actual != metricType {
+		return 0, fmt.Errorf("metric %s is a %s, not a %s", name, metricTypeName(actual), metricTypeName(metricType))
+	}
+	return r.metricIDToValue[id], nil
+}
+
+func metricTypeName(metricType types.MetricType) string {
+	switch metricType {
+	case types.MetricTypeCounter:
+		return "counter"
+	case types.MetricTypeGauge:
+		return "gauge"
+	case types.MetricTypeHistogram:
+		return "histogram"
+	default:
+		return fmt.Sprintf("metric of unknown type %d", metricType)
+	}
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetMetricSnapshot() MetricSnapshot {
+	ret := make(MetricSnapshot, len(r.metricNameToID))
+	for name, id := range r.metricNameToID {
+		ret[name] = r.metricIDToValue[id]
+	}
+	return ret
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetMetricDelta(before MetricSnapshot) map[string]int64 {
+	ret := map[string]int64{}
+	for name, value := range r.GetMetricSnapshot() {
+		if delta := int64(value - before[name]); delta != 0 {
+			ret[name] = delta
+		}
+	}
+	return ret
+}
+
 // impl HostEmulator
 func (r *rootHostEmulator) GetCalloutAttributesFromContext(contextID uint32) []HttpCalloutAttribute {
 	infos := r.httpContextIDToCalloutInfos[contextID]
@@ -383,15 +960,54 @@ func (r *rootHostEmulator) StartVM() {
 
 // impl HostEmulator
 func (r *rootHostEmulator) StartPlugin() {
-	proxywasm.ProxyOnConfigure(RootContextID, len(r.pluginConfiguration))
+	numMetrics, numQueues, tickPeriod := len(r.metricNameToID), len(r.queues), r.tickPeriod
+	r.pluginStarted = proxywasm.ProxyOnConfigure(RootContextID, len(r.pluginConfiguration))
+	if r.pluginStarted {
+		return
+	}
+
+	// Envoy discards the VM of the plugin failed to start, so the metrics and queues registered
+	// in OnPluginStart are dropped. Ids are assigned sequentially, so the new ones are the last ones.
+	log.Printf("plugin failed to start")
+	for name, id := range r.metricNameToID {
+		if int(id) >= numMetrics {
+			delete(r.metricNameToID, name)
+			delete(r.metricIDToValue, id)
+			delete(r.histogramValues, id)
+			delete(r.metricIDToType, id)
+		}
+	}
+	for name, id := range r.queueNameID {
+		if int(id) >= numQueues {
+			delete(r.queueNameID, name)
+			delete(r.queues, id)
+		}
+	}
+	r.tickPeriod = tickPeriod
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) IsPluginStarted() bool {
+	return r.pluginStarted
 }
 
 // impl HostEmulator
 func (r *rootHostEmulator) PutCalloutResponse(calloutID uint32, headers, trailers [][2]string, body []byte) {
+	if _, ok := r.httpCalloutIDToContextID[calloutID]; !ok {
+		// either the callout has not been dispatched yet or the response has already been delivered
+		log.Printf("callout response rejected as callout %d is not pending", calloutID)
+		return
+	}
+
+	if r.calloutBodyLimit > 0 && len(body) > r.calloutBodyLimit {
+		body = body[:r.calloutBodyLimit]
+		r.truncatedCalloutIDs[calloutID] = true
+	}
 	r.httpCalloutResponse[calloutID] = struct {
 		headers, trailers [][2]string
 		body              []byte
 	}{headers: headers, trailers: trailers, body: body}
+	r.calloutResponseHeaders[calloutID] = cloneHeaders(headers)
 
 	// RootContextID, calloutID uint32, numHeaders, bodySize, numTrailers in
 	r.activeCalloutID = calloutID
@@ -403,7 +1019,30 @@ func (r *rootHostEmulator) PutCalloutResponse(calloutID uint32, headers, trailer
 	proxywasm.ProxyOnHttpCallResponse(RootContextID, calloutID, len(headers), len(body), len(trailers))
 }
 
+// impl HostEmulator
+func (r *rootHostEmulator) AbandonPendingHttpCalls() {
+	for calloutID := range r.httpCalloutIDToContextID {
+		log.Printf("callout %d abandoned", calloutID)
+	}
+	r.httpCalloutIDToContextID = map[uint32]uint32{}
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) SetCalloutBodyLimit(limit int) {
+	r.calloutBodyLimit = limit
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) IsCalloutBodyTruncated(calloutID uint32) bool {
+	return r.truncatedCalloutIDs[calloutID]
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) GetCalloutResponseHeaders(calloutID uint32) [][2]string {
+	return cloneHeaders(r.calloutResponseHeaders[calloutID])
+}
+
 // impl HostEmulator
 func (r *rootHostEmulator) FinishVM() {
-	proxywasm.ProxyOnDone(RootContextID)
+	r.lifecycles.onDone(RootContextID)
 }
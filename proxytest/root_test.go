@@ -0,0 +1,1738 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxytest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/rawhostcall"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+type metricsRootContext struct{ proxywasm.DefaultRootContext }
+
+func (ctx *metricsRootContext) OnPluginStart(int) bool {
+	_, err1 := proxywasm.DefineCounterMetric("requests_total")
+	_, err2 := proxywasm.DefineGaugeMetric("active_requests")
+	_, err3 := proxywasm.DefineHistogramMetric("request_duration_milliseconds")
+	return err1 == nil && err2 == nil && err3 == nil
+}
+
+func TestRootHostEmulator_GetDefinedMetrics(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewRootContext(func(uint32) proxywasm.RootContext { return &metricsRootContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	host.StartPlugin()
+
+	assert.Equal(t, []MetricDefinition{
+		{Name: "requests_total", Type: types.MetricTypeCounter},
+		{Name: "active_requests", Type: types.MetricTypeGauge},
+		{Name: "request_duration_milliseconds", Type: types.MetricTypeHistogram},
+	}, host.GetDefinedMetrics())
+}
+
+type tickRootContext struct {
+	proxywasm.DefaultRootContext
+	period uint32
+}
+
+func (ctx *tickRootContext) OnPluginStart(int) bool {
+	return proxywasm.SetTickPeriodMilliSeconds(ctx.period) == nil
+}
+
+func TestRootHostEmulator_TickEnabled(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		period  uint32
+		enabled bool
+	}{
+		{name: "enabled", period: 100, enabled: true},
+		{name: "disabled", period: 0, enabled: false},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opt := NewEmulatorOption().
+				WithNewRootContext(func(uint32) proxywasm.RootContext { return &tickRootContext{period: c.period} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			assert.False(t, host.TickEnabled())
+			host.StartPlugin()
+			assert.Equal(t, c.enabled, host.TickEnabled())
+			assert.Equal(t, c.period, host.GetTickPeriod())
+		})
+	}
+}
+
+type adaptiveTickRootContext struct{ proxywasm.DefaultRootContext }
+
+func (ctx *adaptiveTickRootContext) OnPluginStart(int) bool {
+	return proxywasm.SetTickPeriodMilliSeconds(100) == nil
+}
+
+func (ctx *adaptiveTickRootContext) OnTick() {
+	// backs off after the first tick
+	if err := proxywasm.SetTickPeriodMilliSeconds(1000); err != nil {
+		proxywasm.LogCriticalf("failed to set tick period: %v", err)
+	}
+}
+
+func TestRootHostEmulator_TickState(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewRootContext(func(uint32) proxywasm.RootContext { return &adaptiveTickRootContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	period, enabled, count := host.TickState()
+	assert.Equal(t, uint32(0), period)
+	assert.False(t, enabled)
+	assert.Equal(t, 0, count)
+
+	host.StartPlugin()
+	period, enabled, count = host.TickState()
+	assert.Equal(t, uint32(100), period)
+	assert.True(t, enabled)
+	assert.Equal(t, 0, count)
+
+	for i := 0; i < 3; i++ {
+		host.Tick()
+	}
+	period, enabled, count = host.TickState()
+	assert.Equal(t, uint32(1000), period)
+	assert.True(t, enabled)
+	assert.Equal(t, 3, count)
+	assert.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+
+	host.Reset()
+	period, _, count = host.TickState()
+	assert.Equal(t, uint32(1000), period)
+	assert.Equal(t, 0, count)
+}
+
+type tickCountingRootContext struct {
+	proxywasm.DefaultRootContext
+	period uint32
+	ticks  int
+}
+
+func (ctx *tickCountingRootContext) OnPluginStart(int) bool {
+	return proxywasm.SetTickPeriodMilliSeconds(ctx.period) == nil
+}
+
+func (ctx *tickCountingRootContext) OnTick() { ctx.ticks++ }
+
+func TestRootHostEmulator_Tick(t *testing.T) {
+	for _, c := range []struct {
+		name   string
+		period uint32
+		exp    int
+	}{
+		{name: "enabled", period: 100, exp: 6},
+		{name: "disabled", period: 0, exp: 0},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			root := &tickCountingRootContext{period: c.period}
+			opt := NewEmulatorOption().
+				WithNewRootContext(func(uint32) proxywasm.RootContext { return root })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			host.StartPlugin()
+			host.Tick()
+			host.TickMultiple(5)
+			assert.Equal(t, c.exp, root.ticks)
+			_, _, count := host.TickState()
+			assert.Equal(t, c.exp, count)
+		})
+	}
+}
+
+type listenerDirectionContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *listenerDirectionContext) OnHttpRequestHeaders(int, bool) types.Action {
+	direction, err := proxywasm.GetListenerDirection()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get listener direction: %v", err)
+		return types.ActionContinue
+	}
+
+	switch direction {
+	case types.TrafficDirectionInbound:
+		tenant, err := proxywasm.GetListenerMetadata("filter_metadata", "tenant")
+		if err != nil {
+			proxywasm.LogCriticalf("failed to get listener metadata: %v", err)
+			return types.ActionContinue
+		}
+		_ = proxywasm.SetHttpRequestHeader("x-tenant", string(tenant))
+	case types.TrafficDirectionOutbound:
+		_ = proxywasm.RemoveHttpRequestHeader("x-tenant")
+	}
+	return types.ActionContinue
+}
+
+func TestRootHostEmulator_ListenerProperties(t *testing.T) {
+	encode := func(d types.TrafficDirection) []byte {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, uint64(d))
+		return buf
+	}
+
+	for _, c := range []struct {
+		name      string
+		direction types.TrafficDirection
+		exp       [][2]string
+	}{
+		{name: "inbound", direction: types.TrafficDirectionInbound, exp: [][2]string{{"x-tenant", "acme"}}},
+		{name: "outbound", direction: types.TrafficDirectionOutbound, exp: [][2]string{}},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			opt := NewEmulatorOption().
+				WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &listenerDirectionContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+
+			host.SetProperty([]string{"listener_direction"}, encode(c.direction))
+			host.SetProperty([]string{"listener_metadata", "filter_metadata", "tenant"}, []byte("acme"))
+
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutRequestHeaders(id, [][2]string{{"x-tenant", "spoofed"}})
+
+			require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+			assert.Equal(t, c.exp, host.HttpFilterGetRequestHeaders(id))
+		})
+	}
+
+	t.Run("not found", func(t *testing.T) {
+		host := NewHostEmulator(NewEmulatorOption())
+		defer host.Done()
+
+		_, err := proxywasm.GetListenerDirection()
+		assert.Equal(t, types.ErrorStatusNotFound, err)
+	})
+}
+
+func TestRootHostEmulator_ValidateLogUTF8(t *testing.T) {
+	host := NewHostEmulator(NewEmulatorOption())
+	defer host.Done()
+
+	invalid := string([]byte{'b', 'o', 'd', 'y', ':', 0xff, 0xfe})
+
+	proxywasm.LogInfo(invalid) // not validated by default
+	assert.Equal(t, []string{invalid}, host.GetLogs(types.LogLevelInfo))
+
+	host.SetValidateLogUTF8(true)
+	proxywasm.LogInfo("valid: こんにちは")
+	assert.PanicsWithValue(t, `invalid UTF-8 in info log message: "body:\xff\xfe"`, func() {
+		proxywasm.LogInfo(invalid)
+	})
+	assert.Equal(t, []string{invalid, "valid: こんにちは"}, host.GetLogs(types.LogLevelInfo))
+}
+
+func TestRootHostEmulator_FatalLogPanics(t *testing.T) {
+	t.Run("default", func(t *testing.T) {
+		host := NewHostEmulator(NewEmulatorOption())
+		defer host.Done()
+
+		proxywasm.LogCritical("bad config")
+		proxywasm.LogInfo("still running")
+		assert.Equal(t, []string{"bad config"}, host.GetLogs(types.LogLevelCritical))
+		assert.Equal(t, []string{"still running"}, host.GetLogs(types.LogLevelInfo))
+	})
+
+	t.Run("panics", func(t *testing.T) {
+		host := NewHostEmulator(NewEmulatorOption().WithFatalLogPanics())
+		defer host.Done()
+
+		proxywasm.LogError("not fatal")
+		require.PanicsWithValue(t, FatalLogPanicValue("bad config: 1"), func() {
+			proxywasm.LogCriticalf("bad config: %d", 1)
+		})
+		assert.Equal(t, "proxy_critical_log: bad config: 1", FatalLogPanicValue("bad config: 1"))
+		assert.Equal(t, []string{"not fatal"}, host.GetLogs(types.LogLevelError))
+		assert.Equal(t, []string{"bad config: 1"}, host.GetLogs(types.LogLevelCritical))
+	})
+}
+
+func TestRootHostEmulator_GetAllLogs(t *testing.T) {
+	host := NewHostEmulator(NewEmulatorOption())
+	defer host.Done()
+
+	proxywasm.LogError("e1")
+	proxywasm.LogDebug("d1")
+	proxywasm.LogWarn("w1")
+	proxywasm.LogCritical("c1")
+	proxywasm.LogWarn("w2")
+
+	assert.Equal(t, []string{"w1", "w2", "e1", "c1"}, host.GetLogsAtOrAbove(types.LogLevelWarn))
+	assert.Equal(t, []string{"c1"}, host.GetLogsAtOrAbove(types.LogLevelCritical))
+	assert.Equal(t, []LogEntry{
+		{Level: types.LogLevelError, Message: "e1"},
+		{Level: types.LogLevelDebug, Message: "d1"},
+		{Level: types.LogLevelWarn, Message: "w1"},
+		{Level: types.LogLevelCritical, Message: "c1"},
+		{Level: types.LogLevelWarn, Message: "w2"},
+	}, host.GetAllLogs())
+	assert.Equal(t, []string{"w1", "w2"}, host.GetLogs(types.LogLevelWarn))
+
+	host.Reset()
+	assert.Len(t, host.GetAllLogs(), 0)
+	assert.Len(t, host.GetLogsAtOrAbove(types.LogLevelTrace), 0)
+}
+
+func TestRootHostEmulator_GetLogsInvalidLevel(t *testing.T) {
+	host := NewHostEmulator(NewEmulatorOption())
+	defer host.Done()
+
+	proxywasm.LogInfo("i1")
+	logs, err := host.GetLogsE(types.LogLevelInfo)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"i1"}, logs)
+
+	_, err = host.GetLogsE(types.LogLevelMax)
+	assert.EqualError(t, err, "invalid log level: 6")
+	assert.PanicsWithError(t, "invalid log level: 6", func() { host.GetLogs(types.LogLevelMax) })
+	assert.PanicsWithValue(t, "invalid log level: 6", func() { host.GetLogsAtOrAbove(types.LogLevelMax) })
+}
+
+type logBudgetContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *logBudgetContext) OnHttpRequestHeaders(int, bool) types.Action {
+	tenant, err := proxywasm.GetHttpRequestHeader("x-tenant")
+	if err != nil {
+		proxywasm.LogWarnf("failed to get x-tenant: %v", err)
+		proxywasm.LogWarn("falling back to the default tenant")
+		return types.ActionContinue
+	}
+	proxywasm.LogDebugf("tenant: %s", tenant)
+	return types.ActionContinue
+}
+
+func TestRootHostEmulator_AssertMaxLogs(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &logBudgetContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	t.Run("happy path", func(t *testing.T) {
+		host.Reset()
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestHeaders(id, [][2]string{{"x-tenant", "acme"}})
+		assert.True(t, host.AssertMaxLogs(t, 1))
+	})
+
+	t.Run("over budget", func(t *testing.T) {
+		host.Reset()
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestHeaders(id, nil)
+
+		mock := &testing.T{}
+		assert.False(t, host.AssertMaxLogs(mock, 1))
+		assert.True(t, mock.Failed())
+		assert.True(t, host.AssertMaxLogs(t, 2))
+	})
+}
+
+type queueConsumerRootContext struct {
+	proxywasm.DefaultRootContext
+	queueID uint32
+}
+
+func (ctx *queueConsumerRootContext) OnPluginStart(int) bool {
+	id, err := proxywasm.RegisterSharedQueue("events")
+	ctx.queueID = id
+	return err == nil
+}
+
+func (ctx *queueConsumerRootContext) OnQueueReady(queueID uint32) {
+	for {
+		data, err := proxywasm.DequeueSharedQueue(queueID)
+		if err == types.ErrorStatusEmpty {
+			return
+		} else if err != nil {
+			proxywasm.LogCriticalf("failed to dequeue: %v", err)
+			return
+		}
+		proxywasm.LogInfof("consumed: %s", string(data))
+	}
+}
+
+type queueProducerContext struct {
+	proxywasm.DefaultHttpContext
+	queueID uint32
+}
+
+func (ctx *queueProducerContext) OnHttpRequestHeaders(int, bool) types.Action {
+	for _, msg := range []string{"first", "second", "third"} {
+		if err := proxywasm.EnqueueSharedQueue(ctx.queueID, []byte(msg)); err != nil {
+			proxywasm.LogCriticalf("failed to enqueue: %v", err)
+		}
+		// host calls after enqueue must be made on this http context
+		if err := proxywasm.AddHttpRequestHeader("x-produced", msg); err != nil {
+			proxywasm.LogCriticalf("failed to add header: %v", err)
+		}
+	}
+	return types.ActionContinue
+}
+
+func TestRootHostEmulator_SharedQueueFIFO(t *testing.T) {
+	root := &queueConsumerRootContext{}
+	opt := NewEmulatorOption().
+		WithNewRootContext(func(uint32) proxywasm.RootContext { return root }).
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext {
+			return &queueProducerContext{queueID: root.queueID}
+		})
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	host.StartPlugin()
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, nil)
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{"consumed: first", "consumed: second", "consumed: third"},
+		host.GetLogs(types.LogLevelInfo))
+	assert.Equal(t, 0, host.GetQueueSize(root.queueID))
+	assert.Equal(t, [][2]string{{"x-produced", "first"}, {"x-produced", "second"}, {"x-produced", "third"}},
+		host.HttpFilterGetRequestHeaders(id))
+}
+
+type asyncForeignFunctionRootContext struct {
+	proxywasm.DefaultRootContext
+	funcID uint32
+}
+
+func (ctx *asyncForeignFunctionRootContext) OnPluginStart(int) bool {
+	ret, err := proxywasm.CallForeignFunction("start_async_lookup", []byte("example.com"))
+	if err != nil {
+		proxywasm.LogCriticalf("failed to call foreign function: %v", err)
+		return false
+	}
+	ctx.funcID = binary.LittleEndian.Uint32(ret)
+	return true
+}
+
+func (ctx *asyncForeignFunctionRootContext) OnForeignFunction(funcID uint32, dataSize int) {
+	if funcID != ctx.funcID {
+		proxywasm.LogCriticalf("unexpected function id: %d", funcID)
+		return
+	}
+
+	data, err := proxywasm.GetForeignFunctionData(dataSize)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get foreign function data: %v", err)
+		return
+	}
+	proxywasm.LogInfof("lookup completed: %s", string(data))
+}
+
+func TestRootHostEmulator_ForeignFunction(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewRootContext(func(uint32) proxywasm.RootContext { return &asyncForeignFunctionRootContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	var param []byte
+	host.RegisterForeignFunction("start_async_lookup", func(p []byte) ([]byte, error) {
+		param = p
+		ret := make([]byte, 4)
+		binary.LittleEndian.PutUint32(ret, 10)
+		return ret, nil
+	})
+
+	host.StartPlugin()
+	assert.Equal(t, "example.com", string(param))
+	assert.Len(t, host.GetLogs(types.LogLevelInfo), 0)
+
+	host.CallOnForeignFunction(10, []byte("93.184.216.34"))
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{"lookup completed: 93.184.216.34"}, host.GetLogs(types.LogLevelInfo))
+
+	t.Run("not registered", func(t *testing.T) {
+		_, err := proxywasm.CallForeignFunction("unknown", nil)
+		assert.Equal(t, types.ErrorStatusNotFound, err)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		host.RegisterForeignFunction("compress", func([]byte) ([]byte, error) {
+			return nil, errors.New("unsupported algorithm")
+		})
+		_, err := proxywasm.CallForeignFunction("compress", []byte("data"))
+		assert.Equal(t, types.ErrorInternalFailure, err)
+	})
+
+	t.Run("empty result", func(t *testing.T) {
+		host.RegisterForeignFunction("flush", func([]byte) ([]byte, error) { return nil, nil })
+		ret, err := proxywasm.CallForeignFunction("flush", nil)
+		require.NoError(t, err)
+		assert.Len(t, ret, 0)
+	})
+}
+
+type requestMetricsContext struct{ proxywasm.DefaultHttpContext }
+
+var (
+	deltaRequestCounter proxywasm.MetricCounter
+	deltaActiveGauge    proxywasm.MetricGauge
+)
+
+func (ctx *requestMetricsContext) OnHttpRequestHeaders(int, bool) types.Action {
+	deltaRequestCounter.Increment(1)
+	deltaActiveGauge.Add(1)
+	return types.ActionContinue
+}
+
+func (ctx *requestMetricsContext) OnHttpStreamDone() {
+	deltaActiveGauge.Add(-1)
+}
+
+func TestRootHostEmulator_GetMetricDelta(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &requestMetricsContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	var err error
+	deltaRequestCounter, err = proxywasm.DefineCounterMetric("requests_total")
+	require.NoError(t, err)
+	deltaActiveGauge, err = proxywasm.DefineGaugeMetric("active_requests")
+	require.NoError(t, err)
+	_, err = proxywasm.DefineCounterMetric("unused_total")
+	require.NoError(t, err)
+
+	// previous requests
+	for i := 0; i < 2; i++ {
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestHeaders(id, nil)
+	}
+
+	before := host.GetMetricSnapshot()
+	assert.Equal(t, MetricSnapshot{"requests_total": 2, "active_requests": 2, "unused_total": 0}, before)
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, nil)
+	assert.Equal(t, map[string]int64{"requests_total": 1, "active_requests": 1}, host.GetMetricDelta(before))
+
+	host.HttpFilterCompleteHttpStream(id)
+	assert.Equal(t, map[string]int64{"requests_total": 1}, host.GetMetricDelta(before))
+}
+
+type pollingRootContext struct{ proxywasm.DefaultRootContext }
+
+func (ctx *pollingRootContext) OnPluginStart(int) bool {
+	return proxywasm.SetTickPeriodMilliSeconds(1000) == nil
+}
+
+func (ctx *pollingRootContext) OnTick() {
+	if _, err := proxywasm.DispatchHttpCall("config-server", [][2]string{
+		{":method", "GET"}, {":path", "/config"}, {":authority", "config-server"},
+	}, "", nil, 1000, func(_, bodySize, _ int) {
+		body, err := proxywasm.GetHttpCallResponseBody(0, bodySize)
+		if err != nil {
+			proxywasm.LogCriticalf("failed to get response body: %v", err)
+			return
+		}
+		proxywasm.LogInfof("config: %s", string(body))
+	}); err != nil {
+		proxywasm.LogCriticalf("failed to dispatch http call: %v", err)
+	}
+}
+
+func TestRootHostEmulator_TickCallout(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewRootContext(func(uint32) proxywasm.RootContext { return &pollingRootContext{} }).
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &proxywasm.DefaultHttpContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	host.StartPlugin()
+
+	// the last active context is an http context when the tick fires
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, nil)
+	host.HttpFilterCompleteHttpStream(id)
+
+	host.Tick()
+	assert.Len(t, host.GetCalloutAttributesFromContext(id), 0)
+	attrs := host.GetCalloutAttributesFromContext(RootContextID)
+	require.Len(t, attrs, 1)
+	assert.Equal(t, "config-server", attrs[0].Upstream)
+
+	host.PutCalloutResponse(attrs[0].CalloutID, [][2]string{{":status", "200"}}, nil, []byte("version=2"))
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{"config: version=2"}, host.GetLogs(types.LogLevelInfo))
+}
+
+func TestRootHostEmulator_BinaryProperty(t *testing.T) {
+	host := NewHostEmulator(NewEmulatorOption())
+	defer host.Done()
+
+	// e.g. a DER encoded certificate
+	der := []byte{0x30, 0x82, 0x00, 0xff, 0xfe, 0x00, 0x80}
+	host.SetProperty([]string{"connection", "peer_certificate"}, der)
+	host.SetProperty([]string{"request", "path"}, []byte("/foo"))
+	der[0] = 0 // seeded values are copied
+
+	raw, err := proxywasm.GetProperty([]string{"connection", "peer_certificate"})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x30, 0x82, 0x00, 0xff, 0xfe, 0x00, 0x80}, raw)
+
+	// modifications on the returned value must not affect the host
+	raw[1] = 0
+	str, err := proxywasm.GetPropertyString([]string{"connection", "peer_certificate"})
+	require.NoError(t, err)
+	assert.Equal(t, "\x30\x82\x00\xff\xfe\x00\x80", str)
+
+	path, err := proxywasm.GetPropertyString([]string{"request", "path"})
+	require.NoError(t, err)
+	assert.Equal(t, "/foo", path)
+
+	_, err = proxywasm.GetPropertyString([]string{"request", "host"})
+	assert.Equal(t, types.ErrorStatusNotFound, err)
+}
+
+type cachedMetricIDRootContext struct {
+	proxywasm.DefaultRootContext
+	metricIDs map[string]uint32
+}
+
+func (ctx *cachedMetricIDRootContext) OnPluginStart(int) bool {
+	ctx.metricIDs = map[string]uint32{}
+	for _, name := range []string{"hits_total", "misses_total"} {
+		m, err := proxywasm.DefineCounterMetric(name)
+		if err != nil {
+			return false
+		}
+		ctx.metricIDs[name] = m.ID()
+	}
+	return proxywasm.SetTickPeriodMilliSeconds(1000) == nil
+}
+
+func (ctx *cachedMetricIDRootContext) OnTick() {
+	proxywasm.MetricCounter(ctx.metricIDs["misses_total"]).Increment(3)
+}
+
+func TestRootHostEmulator_GetMetricByID(t *testing.T) {
+	root := &cachedMetricIDRootContext{}
+	opt := NewEmulatorOption().
+		WithNewRootContext(func(uint32) proxywasm.RootContext { return root })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	host.StartPlugin()
+	host.Tick()
+
+	id, ok := host.GetMetricID("misses_total")
+	require.True(t, ok)
+	assert.Equal(t, root.metricIDs["misses_total"], id)
+	value, ok := host.GetMetricByID(id)
+	require.True(t, ok)
+	assert.Equal(t, uint64(3), value)
+
+	id, ok = host.GetMetricID("hits_total")
+	require.True(t, ok)
+	value, ok = host.GetMetricByID(id)
+	require.True(t, ok)
+	assert.Equal(t, uint64(0), value)
+
+	_, ok = host.GetMetricID("unknown_total")
+	assert.False(t, ok)
+	_, ok = host.GetMetricByID(100)
+	assert.False(t, ok)
+}
+
+type prefixedLoggerRootContext struct {
+	proxywasm.DefaultRootContext
+	prefix []byte
+}
+
+func (ctx *prefixedLoggerRootContext) OnPluginStart(int) bool {
+	rootID, err := proxywasm.GetPluginRootID()
+	if err != nil {
+		rootID = "unknown"
+	}
+	ctx.prefix = append(make([]byte, 0, 128), "["+rootID+"] "...)
+	ctx.log("plugin started")
+	ctx.log("  indented: message  ")
+	return true
+}
+
+// log reuses the buffer of the prefix as plugins often do for reducing allocations
+func (ctx *prefixedLoggerRootContext) log(msg string) {
+	buf := append(ctx.prefix, msg...)
+	proxywasm.LogInfo(*(*string)(unsafe.Pointer(&buf)))
+	ctx.prefix = buf[:len(ctx.prefix)]
+}
+
+func TestRootHostEmulator_PrefixedLogs(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewRootContext(func(uint32) proxywasm.RootContext { return &prefixedLoggerRootContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	host.SetProperty([]string{"plugin_root_id"}, []byte("my_plugin"))
+	host.StartPlugin()
+
+	assert.Equal(t, []string{"[my_plugin] plugin started", "[my_plugin]   indented: message  "},
+		host.GetLogs(types.LogLevelInfo))
+}
+
+func TestRootHostEmulator_DefineMetricWithEmptyName(t *testing.T) {
+	host := NewHostEmulator(NewEmulatorOption())
+	defer host.Done()
+
+	var id uint32
+	st := rawhostcall.ProxyDefineMetric(types.MetricTypeCounter, nil, 0, &id)
+	assert.Equal(t, types.StatusBadArgument, st)
+	assert.Len(t, host.GetDefinedMetrics(), 0)
+}
+
+func TestRootHostEmulator_MetricTypeCheck(t *testing.T) {
+	host := NewHostEmulator(NewEmulatorOption())
+	defer host.Done()
+
+	define := func(metricType types.MetricType, name string) uint32 {
+		var id uint32
+		require.Equal(t, types.StatusOK, rawhostcall.ProxyDefineMetric(metricType, &[]byte(name)[0], len(name), &id))
+		return id
+	}
+	counter := define(types.MetricTypeCounter, "counter")
+	gauge := define(types.MetricTypeGauge, "gauge")
+	histogram := define(types.MetricTypeHistogram, "histogram")
+
+	for _, c := range []struct {
+		name                    string
+		id                      uint32
+		expIncrement, expRecord types.Status
+	}{
+		{name: "counter", id: counter, expIncrement: types.StatusOK, expRecord: types.StatusBadArgument},
+		{name: "gauge", id: gauge, expIncrement: types.StatusOK, expRecord: types.StatusOK},
+		{name: "histogram", id: histogram, expIncrement: types.StatusBadArgument, expRecord: types.StatusOK},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal(t, c.expIncrement, rawhostcall.ProxyIncrementMetric(c.id, 1))
+			assert.Equal(t, c.expRecord, rawhostcall.ProxyRecordMetric(c.id, 10))
+		})
+	}
+
+	// the rejected operations don't change the values
+	assert.Equal(t, MetricSnapshot{"counter": 1, "gauge": 10, "histogram": 10}, host.GetMetricSnapshot())
+}
+
+func TestRootHostEmulator_GetMetricByName(t *testing.T) {
+	host := NewHostEmulator(NewEmulatorOption())
+	defer host.Done()
+
+	counter, err := proxywasm.DefineCounterMetric("requests")
+	require.NoError(t, err)
+	gauge, err := proxywasm.DefineGaugeMetric("connections")
+	require.NoError(t, err)
+	histogram, err := proxywasm.DefineHistogramMetric("latency")
+	require.NoError(t, err)
+
+	counter.Increment(3)
+	gauge.Add(2)
+	histogram.Record(120)
+
+	v, err := host.GetCounterMetric("requests")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), v)
+	v, err = host.GetGaugeMetric("connections")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), v)
+	v, err = host.GetHistogramMetric("latency")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(120), v)
+
+	_, err = host.GetCounterMetric("undefined")
+	assert.EqualError(t, err, "metric undefined is not defined")
+	_, err = host.GetGaugeMetric("requests")
+	assert.EqualError(t, err, "metric requests is a counter, not a gauge")
+	_, err = host.GetHistogramMetric("connections")
+	assert.EqualError(t, err, "metric connections is a gauge, not a histogram")
+	_, err = host.GetCounterMetric("latency")
+	assert.EqualError(t, err, "metric latency is a histogram, not a counter")
+}
+
+func TestRootHostEmulator_SharedDataCas(t *testing.T) {
+	host := NewHostEmulator(NewEmulatorOption())
+	defer host.Done()
+
+	_, _, found := host.GetSharedData("config")
+	require.False(t, found)
+
+	t.Run("create", func(t *testing.T) {
+		// the cas given on the first write is ignored
+		require.NoError(t, proxywasm.SetSharedData("config", []byte("v1"), 10))
+		value, cas, found := host.GetSharedData("config")
+		require.True(t, found)
+		assert.Equal(t, []byte("v1"), value)
+		assert.Equal(t, uint32(1), cas)
+	})
+
+	t.Run("compare and swap", func(t *testing.T) {
+		_, cas, err := proxywasm.GetSharedData("config")
+		require.NoError(t, err)
+		require.NoError(t, proxywasm.SetSharedData("config", []byte("v2"), cas))
+		value, newCas, found := host.GetSharedData("config")
+		require.True(t, found)
+		assert.Equal(t, []byte("v2"), value)
+		assert.Equal(t, cas+1, newCas)
+	})
+
+	t.Run("cas mismatch", func(t *testing.T) {
+		assert.Equal(t, types.ErrorStatusCasMismatch, proxywasm.SetSharedData("config", []byte("v3"), 1))
+		value, cas, found := host.GetSharedData("config")
+		require.True(t, found)
+		assert.Equal(t, []byte("v2"), value)
+		assert.Equal(t, uint32(2), cas)
+	})
+
+	t.Run("unconditional", func(t *testing.T) {
+		// cas 0 overwrites the existing value regardless of its cas as Envoy does
+		require.NoError(t, proxywasm.SetSharedData("config", []byte("v3"), 0))
+		value, cas, found := host.GetSharedData("config")
+		require.True(t, found)
+		assert.Equal(t, []byte("v3"), value)
+		assert.Equal(t, uint32(3), cas)
+
+		require.NoError(t, proxywasm.SetSharedData("config", nil, 0))
+		_, _, found = host.GetSharedData("config")
+		assert.False(t, found)
+	})
+}
+
+type cachingJSONContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *cachingJSONContext) OnHttpRequestHeaders(int, bool) types.Action {
+	path, err := proxywasm.GetHttpRequestHeader(":path")
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get :path: %v", err)
+		return types.ActionContinue
+	}
+	entry, err := json.Marshal(struct {
+		Path string `json:"path"`
+		Hits int    `json:"hits"`
+	}{Path: path, Hits: 1})
+	if err != nil {
+		proxywasm.LogCriticalf("failed to marshal: %v", err)
+		return types.ActionContinue
+	}
+	if err := proxywasm.SetSharedData("cache:"+path, entry, 0); err != nil {
+		proxywasm.LogCriticalf("failed to set shared data: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestRootHostEmulator_AssertSharedData(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &cachingJSONContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{":path", "/users"}})
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+
+	assert.True(t, host.AssertSharedData(t, "cache:/users", []byte(`{"path":"/users","hits":1}`)))
+
+	t.Run("mismatch", func(t *testing.T) {
+		mock := &testing.T{}
+		assert.False(t, host.AssertSharedData(mock, "cache:/users", []byte(`{"path":"/users","hits":2}`)))
+		assert.True(t, mock.Failed())
+	})
+
+	t.Run("not found", func(t *testing.T) {
+		mock := &testing.T{}
+		assert.False(t, host.AssertSharedData(mock, "cache:/groups", nil))
+		assert.True(t, mock.Failed())
+	})
+}
+
+type queueRegisteringRootContext struct{ proxywasm.DefaultRootContext }
+
+func (ctx *queueRegisteringRootContext) OnPluginStart(int) bool {
+	for _, name := range []string{"events", "deadletter", "events"} {
+		if _, err := proxywasm.RegisterSharedQueue(name); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRootHostEmulator_GetRegisteredQueues(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewRootContext(func(uint32) proxywasm.RootContext { return &queueRegisteringRootContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	assert.Len(t, host.GetRegisteredQueues(), 0)
+	host.StartPlugin()
+	assert.Equal(t, []string{"events", "deadletter"}, host.GetRegisteredQueues())
+}
+
+type trafficDirectionContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *trafficDirectionContext) OnHttpRequestHeaders(int, bool) types.Action {
+	direction, err := proxywasm.GetTrafficDirection()
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get traffic direction: %v", err)
+		return types.ActionContinue
+	}
+
+	var header string
+	switch direction {
+	case types.TrafficDirectionInbound:
+		header = "x-inbound"
+	case types.TrafficDirectionOutbound:
+		header = "x-outbound"
+	default:
+		header = "x-unspecified"
+	}
+	if err := proxywasm.SetHttpRequestHeader(header, "true"); err != nil {
+		proxywasm.LogCriticalf("failed to set header: %v", err)
+	}
+	return types.ActionContinue
+}
+
+func TestRootHostEmulator_Property(t *testing.T) {
+	host := NewHostEmulator(NewEmulatorOption())
+	defer host.Done()
+
+	t.Run("set by host", func(t *testing.T) {
+		host.SetProperty([]string{"source", "address"}, []byte("10.0.0.1:8080"))
+		value, err := proxywasm.GetProperty([]string{"source", "address"})
+		require.NoError(t, err)
+		assert.Equal(t, []byte("10.0.0.1:8080"), value)
+	})
+
+	t.Run("set by plugin", func(t *testing.T) {
+		path := []string{"filter_state", "tenant"}
+		require.NoError(t, proxywasm.SetProperty(string(proxywasm.SerializePropertyPath(path)), []byte("acme")))
+		value, ok := host.GetProperty(path)
+		require.True(t, ok)
+		assert.Equal(t, []byte("acme"), value)
+
+		value, err := proxywasm.GetProperty(path)
+		require.NoError(t, err)
+		assert.Equal(t, []byte("acme"), value)
+	})
+
+	t.Run("empty value", func(t *testing.T) {
+		require.NoError(t, proxywasm.SetProperty("empty", nil))
+		value, ok := host.GetProperty([]string{"empty"})
+		require.True(t, ok)
+		assert.Len(t, value, 0)
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		_, err := proxywasm.GetProperty([]string{"request", "path"})
+		assert.Equal(t, types.ErrorStatusNotFound, err)
+		_, ok := host.GetProperty([]string{"request", "path"})
+		assert.False(t, ok)
+	})
+}
+
+func TestRootHostEmulator_SetTrafficDirection(t *testing.T) {
+	for _, c := range []struct {
+		name      string
+		direction types.TrafficDirection
+		exp       [][2]string
+	}{
+		{name: "unspecified", direction: types.TrafficDirectionUnspecified, exp: [][2]string{{"x-unspecified", "true"}}},
+		{name: "inbound", direction: types.TrafficDirectionInbound, exp: [][2]string{{"x-inbound", "true"}}},
+		{name: "outbound", direction: types.TrafficDirectionOutbound, exp: [][2]string{{"x-outbound", "true"}}},
+	} {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			opt := NewEmulatorOption().
+				WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &trafficDirectionContext{} })
+			host := NewHostEmulator(opt)
+			defer host.Done()
+			host.SetTrafficDirection(c.direction)
+
+			id := host.HttpFilterInitContext()
+			host.HttpFilterPutRequestHeaders(id, nil)
+
+			require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+			assert.Equal(t, c.exp, host.HttpFilterGetRequestHeaders(id))
+		})
+	}
+}
+
+const calloutWindowSize = 64 << 10
+
+// calloutBodyReader reads the callout response body in windows of calloutWindowSize bytes.
+type calloutBodyReader struct {
+	offset, size int
+	windows      []int
+}
+
+func (r *calloutBodyReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	maxSize := calloutWindowSize
+	if len(p) < maxSize {
+		maxSize = len(p)
+	}
+	window, err := proxywasm.GetHttpCallResponseBody(r.offset, maxSize)
+	if err != nil {
+		return 0, err
+	}
+	r.offset += len(window)
+	r.windows = append(r.windows, len(window))
+	return copy(p, window), nil
+}
+
+type largeCalloutContext struct {
+	proxywasm.DefaultHttpContext
+	reader *calloutBodyReader
+}
+
+func (ctx *largeCalloutContext) OnHttpRequestHeaders(int, bool) types.Action {
+	if _, err := proxywasm.DispatchHttpCall("catalog", [][2]string{
+		{":method", "GET"}, {":path", "/items"}, {":authority", "catalog"},
+	}, "", nil, 1000, func(_, bodySize, _ int) {
+		ctx.reader = &calloutBodyReader{size: bodySize}
+		dec := json.NewDecoder(bufio.NewReaderSize(ctx.reader, calloutWindowSize))
+		if _, err := dec.Token(); err != nil { // [
+			proxywasm.LogCriticalf("failed to parse response: %v", err)
+			return
+		}
+		var items int
+		for dec.More() {
+			var item struct{ ID int }
+			if err := dec.Decode(&item); err != nil {
+				proxywasm.LogCriticalf("failed to parse item: %v", err)
+				return
+			}
+			if item.ID != items {
+				proxywasm.LogCriticalf("unexpected item: %d", item.ID)
+				return
+			}
+			items++
+		}
+		proxywasm.LogInfof("items: %d", items)
+	}); err != nil {
+		proxywasm.LogCriticalf("failed to dispatch http call: %v", err)
+	}
+	return types.ActionPause
+}
+
+func TestRootHostEmulator_LargeCalloutResponse(t *testing.T) {
+	ctx := &largeCalloutContext{}
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return ctx })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	const items = 100000
+	var body bytes.Buffer
+	body.WriteString("[")
+	for i := 0; i < items; i++ {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `{"id":%d,"name":"item-%d"}`, i, i)
+	}
+	body.WriteString("]")
+	require.Greater(t, body.Len(), 2<<20)
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, nil)
+	attrs := host.GetCalloutAttributesFromContext(id)
+	require.Len(t, attrs, 1)
+	host.PutCalloutResponse(attrs[0].CalloutID, [][2]string{{":status", "200"}}, nil, body.Bytes())
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{"items: 100000"}, host.GetLogs(types.LogLevelInfo))
+
+	// every window is full except for the last one
+	windows := ctx.reader.windows
+	require.Equal(t, (body.Len()+calloutWindowSize-1)/calloutWindowSize, len(windows))
+	for _, w := range windows[:len(windows)-1] {
+		assert.Equal(t, calloutWindowSize, w)
+	}
+	assert.Equal(t, body.Len()-calloutWindowSize*(len(windows)-1), windows[len(windows)-1])
+}
+
+type emptyCalloutBodyContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *emptyCalloutBodyContext) OnHttpRequestHeaders(int, bool) types.Action {
+	if _, err := proxywasm.DispatchHttpCall("cluster", [][2]string{
+		{":method", "GET"}, {":path", "/"}, {":authority", "cluster"},
+	}, "", nil, 1000, func(_, bodySize, _ int) {
+		body, err := proxywasm.GetHttpCallResponseBody(0, bodySize)
+		if err != nil {
+			proxywasm.LogCriticalf("failed to get callout response body: %v", err)
+			return
+		}
+		proxywasm.LogInfof("body: %q", body)
+	}); err != nil {
+		proxywasm.LogCriticalf("failed to dispatch http call: %v", err)
+	}
+	return types.ActionPause
+}
+
+func TestRootHostEmulator_EmptyCalloutResponseBody(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &emptyCalloutBodyContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, nil)
+	attrs := host.GetCalloutAttributesFromContext(id)
+	require.Len(t, attrs, 1)
+	host.PutCalloutResponse(attrs[0].CalloutID, [][2]string{{":status", "204"}}, nil, nil)
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.Equal(t, []string{`body: ""`}, host.GetLogs(types.LogLevelInfo))
+}
+
+type calloutCountingContext struct {
+	proxywasm.DefaultHttpContext
+	responses *[]int
+}
+
+func (ctx *calloutCountingContext) OnHttpRequestHeaders(int, bool) types.Action {
+	if _, err := proxywasm.DispatchHttpCall("cluster", [][2]string{
+		{":method", "GET"}, {":path", "/"}, {":authority", "cluster"},
+	}, "", nil, 1000, func(_, bodySize, _ int) {
+		*ctx.responses = append(*ctx.responses, bodySize)
+	}); err != nil {
+		proxywasm.LogCriticalf("failed to dispatch http call: %v", err)
+	}
+	return types.ActionPause
+}
+
+func TestRootHostEmulator_PutCalloutResponse(t *testing.T) {
+	var responses []int
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext {
+			return &calloutCountingContext{responses: &responses}
+		})
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	first := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(first, nil)
+	firstAttrs := host.GetCalloutAttributesFromContext(first)
+	require.Len(t, firstAttrs, 1)
+	host.PutCalloutResponse(firstAttrs[0].CalloutID, nil, nil, []byte("a"))
+	require.Equal(t, []int{1}, responses)
+
+	// the id of the responded callout is not reused
+	second := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(second, nil)
+	secondAttrs := host.GetCalloutAttributesFromContext(second)
+	require.Len(t, secondAttrs, 1)
+	assert.NotEqual(t, firstAttrs[0].CalloutID, secondAttrs[0].CalloutID)
+
+	t.Run("duplicated response", func(t *testing.T) {
+		host.PutCalloutResponse(firstAttrs[0].CalloutID, nil, nil, []byte("aa"))
+		assert.Equal(t, []int{1}, responses)
+	})
+
+	t.Run("unknown callout", func(t *testing.T) {
+		host.PutCalloutResponse(secondAttrs[0].CalloutID+1, nil, nil, []byte("aaa"))
+		assert.Equal(t, []int{1}, responses)
+	})
+
+	t.Run("read outside of callbacks", func(t *testing.T) {
+		_, err := proxywasm.GetHttpCallResponseBody(0, 1)
+		assert.Equal(t, types.ErrorStatusBadArgument, err)
+		_, err = proxywasm.GetHttpCallResponseHeaders()
+		assert.Equal(t, types.ErrorStatusBadArgument, err)
+	})
+
+	host.PutCalloutResponse(secondAttrs[0].CalloutID, nil, nil, []byte("bb"))
+	assert.Equal(t, []int{1, 2}, responses)
+}
+
+func TestRootHostEmulator_AbandonPendingHttpCalls(t *testing.T) {
+	var responses []int
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext {
+			return &calloutCountingContext{responses: &responses}
+		})
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	var calloutIDs []uint32
+	for i := 0; i < 2; i++ {
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestHeaders(id, nil)
+		attrs := host.GetCalloutAttributesFromContext(id)
+		require.Len(t, attrs, 1)
+		calloutIDs = append(calloutIDs, attrs[0].CalloutID)
+	}
+
+	host.AbandonPendingHttpCalls()
+	for _, id := range calloutIDs {
+		host.PutCalloutResponse(id, nil, nil, []byte("a"))
+	}
+	assert.Len(t, responses, 0)
+
+	// callouts dispatched afterwards are delivered as usual
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, nil)
+	attrs := host.GetCalloutAttributesFromContext(id)
+	require.Len(t, attrs, 1)
+	host.PutCalloutResponse(attrs[0].CalloutID, nil, nil, []byte("bb"))
+	assert.Equal(t, []int{2}, responses)
+}
+
+type slaCalloutContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *slaCalloutContext) OnHttpRequestHeaders(int, bool) types.Action {
+	if _, err := proxywasm.DispatchHttpCall("quota", [][2]string{{":method", "GET"}}, "", nil, 250,
+		func(int, int, int) {}); err != nil {
+		proxywasm.LogCriticalf("failed to dispatch http call: %v", err)
+	}
+	return types.ActionPause
+}
+
+func TestRootHostEmulator_CalloutTimeout(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &slaCalloutContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, nil)
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+
+	attrs := host.GetCalloutAttributesFromContext(id)
+	require.Len(t, attrs, 1)
+	assert.Equal(t, "quota", attrs[0].Upstream)
+	assert.Equal(t, 250*time.Millisecond, attrs[0].Timeout)
+}
+
+type batchingRootContext struct {
+	proxywasm.DefaultRootContext
+	queueID uint32
+}
+
+func (ctx *batchingRootContext) OnPluginStart(int) bool {
+	id, err := proxywasm.RegisterSharedQueue("events")
+	if err != nil {
+		proxywasm.LogCriticalf("failed to register queue: %v", err)
+		return false
+	}
+	ctx.queueID = id
+	return proxywasm.SetTickPeriodMilliSeconds(1000) == nil
+}
+
+func (ctx *batchingRootContext) OnQueueReady(queueID uint32) {
+	// the events are flushed in batches on ticks
+	proxywasm.LogInfof("ready: %d", queueID)
+}
+
+func (ctx *batchingRootContext) OnTick() {
+	for {
+		data, err := proxywasm.DequeueSharedQueue(ctx.queueID)
+		if err != nil {
+			return
+		}
+		proxywasm.LogInfof("flushed: %s", string(data))
+	}
+}
+
+type pipelineRootContext struct {
+	proxywasm.DefaultRootContext
+	inQueueID, outQueueID uint32
+}
+
+func (ctx *pipelineRootContext) OnPluginStart(int) bool {
+	var err error
+	if ctx.inQueueID, err = proxywasm.RegisterSharedQueue("in"); err != nil {
+		return false
+	}
+	ctx.outQueueID, err = proxywasm.RegisterSharedQueue("out")
+	return err == nil
+}
+
+func (ctx *pipelineRootContext) OnQueueReady(queueID uint32) {
+	data, err := proxywasm.DequeueSharedQueue(queueID)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to dequeue: %v", err)
+		return
+	}
+
+	switch queueID {
+	case ctx.inQueueID:
+		proxywasm.LogInfof("in: %s", data)
+		if err := proxywasm.EnqueueSharedQueue(ctx.outQueueID, bytes.ToUpper(data)); err != nil {
+			proxywasm.LogCriticalf("failed to enqueue: %v", err)
+		}
+		proxywasm.LogInfof("in: %s handled", data)
+	case ctx.outQueueID:
+		proxywasm.LogInfof("out: %s", data)
+		if string(data) == "PING" {
+			// goes back to the first queue
+			if err := proxywasm.EnqueueSharedQueue(ctx.inQueueID, []byte("pong")); err != nil {
+				proxywasm.LogCriticalf("failed to enqueue: %v", err)
+			}
+		}
+	}
+}
+
+func TestRootHostEmulator_ReentrantEnqueue(t *testing.T) {
+	root := &pipelineRootContext{}
+	opt := NewEmulatorOption().
+		WithNewRootContext(func(uint32) proxywasm.RootContext { return root })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	host.StartPlugin()
+	require.NoError(t, proxywasm.EnqueueSharedQueue(root.inQueueID, []byte("ping")))
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	// each callback completes before the queues enqueued in it are notified
+	assert.Equal(t, []string{
+		"in: ping", "in: ping handled",
+		"out: PING",
+		"in: pong", "in: pong handled",
+		"out: PONG",
+	}, host.GetLogs(types.LogLevelInfo))
+	assert.Equal(t, 0, host.GetQueueSize(root.inQueueID))
+	assert.Equal(t, 0, host.GetQueueSize(root.outQueueID))
+
+	// enqueues after the dispatch are notified again
+	require.NoError(t, proxywasm.EnqueueSharedQueue(root.outQueueID, []byte("done")))
+	assert.Equal(t, "out: done", host.GetLogs(types.LogLevelInfo)[6])
+}
+
+type eventsHttpContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *eventsHttpContext) OnHttpRequestHeaders(int, bool) types.Action {
+	events, err := proxywasm.ResolveSharedQueue("", "events")
+	if err != nil {
+		proxywasm.LogCriticalf("failed to resolve events queue: %v", err)
+		return types.ActionContinue
+	}
+	audit, err := proxywasm.ResolveSharedQueue("audit_vm", "audit")
+	if err != nil {
+		proxywasm.LogCriticalf("failed to resolve audit queue: %v", err)
+		return types.ActionContinue
+	}
+
+	buf := []byte("request")
+	for _, id := range []uint32{events, audit} {
+		if err := proxywasm.EnqueueSharedQueue(id, buf); err != nil {
+			proxywasm.LogCriticalf("failed to enqueue: %v", err)
+		}
+	}
+	// the enqueued data is kept intact
+	copy(buf, "xxxxxxx")
+	return types.ActionContinue
+}
+
+func TestRootHostEmulator_OnQueueReady(t *testing.T) {
+	root := &batchingRootContext{}
+	opt := NewEmulatorOption().
+		WithNewRootContext(func(uint32) proxywasm.RootContext { return root }).
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &eventsHttpContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	host.StartPlugin()
+	audit := host.RegisterSharedQueueForVM("audit_vm", "audit")
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, nil)
+
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	// OnQueueReady is called only for the queue owned by this VM
+	assert.Equal(t, []string{fmt.Sprintf("ready: %d", root.queueID)}, host.GetLogs(types.LogLevelInfo))
+	assert.Equal(t, [][]byte{[]byte("request")}, host.GetQueue(root.queueID))
+	assert.Equal(t, [][]byte{[]byte("request")}, host.GetQueue(audit))
+
+	host.Tick()
+	assert.Equal(t, "flushed: request", host.GetLogs(types.LogLevelInfo)[1])
+	assert.Len(t, host.GetQueue(root.queueID), 0)
+	assert.Len(t, host.GetQueue(audit), 1)
+
+	t.Run("not found", func(t *testing.T) {
+		_, err := proxywasm.ResolveSharedQueue("unknown_vm", "events")
+		assert.Equal(t, types.ErrorStatusNotFound, err)
+	})
+}
+
+type jsonConfigRootContext struct {
+	proxywasm.DefaultRootContext
+	vmConfigSize, pluginConfigSize int
+	logLevel                       string
+	upstreams                      []string
+}
+
+func (ctx *jsonConfigRootContext) OnVMStart(vmConfigurationSize int) bool {
+	ctx.vmConfigSize = vmConfigurationSize
+	data, err := proxywasm.GetVMConfiguration(vmConfigurationSize)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get vm configuration: %v", err)
+		return false
+	}
+	var config struct {
+		LogLevel string `json:"log_level"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		proxywasm.LogCriticalf("failed to parse vm configuration: %v", err)
+		return false
+	}
+	ctx.logLevel = config.LogLevel
+	return true
+}
+
+func (ctx *jsonConfigRootContext) OnPluginStart(pluginConfigurationSize int) bool {
+	ctx.pluginConfigSize = pluginConfigurationSize
+	data, err := proxywasm.GetPluginConfiguration(pluginConfigurationSize)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get plugin configuration: %v", err)
+		return false
+	}
+	var config struct {
+		Upstreams []string `json:"upstreams"`
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		proxywasm.LogCriticalf("failed to parse plugin configuration: %v", err)
+		return false
+	}
+	ctx.upstreams = config.Upstreams
+	return true
+}
+
+func TestRootHostEmulator_JSONConfiguration(t *testing.T) {
+	vmConfig := []byte(`{"log_level":"debug"}`)
+	pluginConfig := []byte(`{"upstreams":["a.example.com","b.example.com"]}`)
+	root := &jsonConfigRootContext{}
+	opt := NewEmulatorOption().
+		WithVMConfiguration(vmConfig).
+		WithPluginConfiguration(pluginConfig).
+		WithNewRootContext(func(uint32) proxywasm.RootContext { return root })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	host.StartVM()
+	host.StartPlugin()
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+
+	assert.Equal(t, len(vmConfig), root.vmConfigSize)
+	assert.Equal(t, len(pluginConfig), root.pluginConfigSize)
+	assert.Equal(t, "debug", root.logLevel)
+	assert.Equal(t, []string{"a.example.com", "b.example.com"}, root.upstreams)
+}
+
+type activeRequestsContext struct {
+	proxywasm.DefaultHttpContext
+	active proxywasm.MetricGauge
+}
+
+func (ctx *activeRequestsContext) OnHttpRequestHeaders(int, bool) types.Action {
+	ctx.active.Add(1)
+	return types.ActionContinue
+}
+
+func (ctx *activeRequestsContext) OnHttpStreamDone() {
+	ctx.active.Add(-1)
+}
+
+func TestRootHostEmulator_AssertGaugeNonNegative(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext {
+			active, err := proxywasm.DefineGaugeMetric("active_requests")
+			if err != nil {
+				proxywasm.LogCriticalf("failed to define metric: %v", err)
+			}
+			return &activeRequestsContext{active: active}
+		})
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	first, second := host.HttpFilterInitContext(), host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(first, nil)
+	host.HttpFilterPutRequestHeaders(second, nil)
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	assert.True(t, host.AssertGaugeNonNegative(t, "active_requests"))
+	host.HttpFilterCompleteHttpStream(first)
+	host.HttpFilterCompleteHttpStream(second)
+	assert.True(t, host.AssertGaugeNonNegative(t, "active_requests"))
+	value, err := host.GetGaugeMetric("active_requests")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), value)
+
+	t.Run("negative", func(t *testing.T) {
+		// the stream done without the request headers decrements the gauge below zero
+		id := host.HttpFilterInitContext()
+		host.HttpFilterCompleteHttpStream(id)
+
+		mock := &testing.T{}
+		assert.False(t, host.AssertGaugeNonNegative(mock, "active_requests"))
+		assert.True(t, mock.Failed())
+	})
+
+	t.Run("not a gauge", func(t *testing.T) {
+		mock := &testing.T{}
+		assert.False(t, host.AssertGaugeNonNegative(mock, "undefined"))
+		assert.True(t, mock.Failed())
+	})
+}
+
+func TestRootHostEmulator_DeleteSharedData(t *testing.T) {
+	host := NewHostEmulator(NewEmulatorOption())
+	defer host.Done()
+
+	require.NoError(t, proxywasm.SetSharedData("session", []byte("token"), 0))
+	_, cas, err := proxywasm.GetSharedData("session")
+	require.NoError(t, err)
+
+	// the stale cas doesn't delete the key
+	assert.Equal(t, types.ErrorStatusCasMismatch, proxywasm.SetSharedData("session", nil, cas+1))
+	_, _, found := host.GetSharedData("session")
+	assert.True(t, found)
+
+	require.NoError(t, proxywasm.SetSharedData("session", nil, cas))
+	_, _, err = proxywasm.GetSharedData("session")
+	assert.Equal(t, types.ErrorStatusNotFound, err)
+	_, _, found = host.GetSharedData("session")
+	assert.False(t, found)
+
+	t.Run("empty value of unknown key", func(t *testing.T) {
+		assert.Equal(t, types.ErrorStatusNotFound, proxywasm.SetSharedData("unknown", []byte{}, 0))
+		// the empty value is never stored, which would otherwise make the read index out of range
+		_, _, err := proxywasm.GetSharedData("unknown")
+		assert.Equal(t, types.ErrorStatusNotFound, err)
+	})
+
+	// the deleted key is written again as a new key
+	require.NoError(t, proxywasm.SetSharedData("session", []byte("renewed"), 0))
+	value, cas, err := proxywasm.GetSharedData("session")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("renewed"), value)
+	assert.Equal(t, uint32(1), cas)
+}
+
+type authUserContext struct{ proxywasm.DefaultHttpContext }
+
+func (ctx *authUserContext) OnHttpRequestHeaders(int, bool) types.Action {
+	if _, err := proxywasm.DispatchHttpCall("auth", [][2]string{{":method", "GET"}}, "", nil, 1000,
+		func(int, int, int) {
+			user, err := proxywasm.GetHttpCallResponseHeader("x-auth-user")
+			if err != nil {
+				proxywasm.LogCriticalf("failed to get x-auth-user: %v", err)
+			} else if err := proxywasm.SetHttpRequestHeader("x-user", user); err != nil {
+				proxywasm.LogCriticalf("failed to set x-user: %v", err)
+			}
+			proxywasm.ResumeHttpRequest()
+		}); err != nil {
+		proxywasm.LogCriticalf("failed to dispatch http call: %v", err)
+	}
+	return types.ActionPause
+}
+
+func TestRootHostEmulator_GetCalloutResponseHeaders(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &authUserContext{} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, [][2]string{{":path", "/"}})
+	attrs := host.GetCalloutAttributesFromContext(id)
+	require.Len(t, attrs, 1)
+
+	// looked up case-insensitively by the plugin
+	headers := [][2]string{{":status", "200"}, {"X-Auth-User", "alice"}}
+	host.PutCalloutResponse(attrs[0].CalloutID, headers, nil, nil)
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+
+	assert.Equal(t, headers, host.GetCalloutResponseHeaders(attrs[0].CalloutID))
+	assert.Equal(t, [][2]string{{":path", "/"}, {"x-user", "alice"}}, host.HttpFilterGetRequestHeaders(id))
+	assert.Equal(t, types.ActionContinue, host.HttpFilterGetCurrentStreamAction(id))
+	assert.Nil(t, host.GetCalloutResponseHeaders(attrs[0].CalloutID+1))
+	host.Reset()
+	assert.Nil(t, host.GetCalloutResponseHeaders(attrs[0].CalloutID))
+}
+
+type validatingRootContext struct{ proxywasm.DefaultRootContext }
+
+func (ctx *validatingRootContext) OnPluginStart(pluginConfigurationSize int) bool {
+	if _, err := proxywasm.DefineCounterMetric("requests"); err != nil {
+		proxywasm.LogCriticalf("failed to define metric: %v", err)
+		return false
+	}
+	if _, err := proxywasm.RegisterSharedQueue("events"); err != nil {
+		proxywasm.LogCriticalf("failed to register queue: %v", err)
+		return false
+	}
+	if err := proxywasm.SetTickPeriodMilliSeconds(1000); err != nil {
+		proxywasm.LogCriticalf("failed to set tick period: %v", err)
+		return false
+	}
+
+	data, err := proxywasm.GetPluginConfiguration(pluginConfigurationSize)
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get plugin configuration: %v", err)
+		return false
+	}
+	if !json.Valid(data) {
+		proxywasm.LogErrorf("invalid plugin configuration: %s", data)
+		return false
+	}
+	return true
+}
+
+func TestRootHostEmulator_StartPluginFailure(t *testing.T) {
+	run := func(config string) HostEmulator {
+		opt := NewEmulatorOption().
+			WithPluginConfiguration([]byte(config)).
+			WithNewRootContext(func(uint32) proxywasm.RootContext { return &validatingRootContext{} })
+		host := NewHostEmulator(opt)
+		host.StartPlugin()
+		require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+		return host
+	}
+
+	t.Run("started", func(t *testing.T) {
+		host := run(`{}`)
+		defer host.Done()
+
+		assert.True(t, host.IsPluginStarted())
+		assert.Len(t, host.GetDefinedMetrics(), 1)
+		assert.Equal(t, []string{"events"}, host.GetRegisteredQueues())
+		assert.Equal(t, uint32(1000), host.GetTickPeriod())
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		host := run(`{`)
+		defer host.Done()
+
+		assert.False(t, host.IsPluginStarted())
+		assert.Equal(t, []string{"invalid plugin configuration: {"}, host.GetLogs(types.LogLevelError))
+		// the registrations made before the failure are discarded
+		assert.Len(t, host.GetDefinedMetrics(), 0)
+		assert.Len(t, host.GetRegisteredQueues(), 0)
+		assert.Equal(t, uint32(0), host.GetTickPeriod())
+		_, err := proxywasm.ResolveSharedQueue("", "events")
+		assert.Equal(t, types.ErrorStatusNotFound, err)
+	})
+}
+
+type latencyContext struct {
+	proxywasm.DefaultHttpContext
+	latency proxywasm.MetricHistogram
+}
+
+func (ctx *latencyContext) OnHttpResponseHeaders(int, bool) types.Action {
+	d, err := proxywasm.GetDurationProperty([]string{"response", "duration"})
+	if err != nil {
+		proxywasm.LogCriticalf("failed to get response duration: %v", err)
+		return types.ActionContinue
+	}
+	ctx.latency.Record(uint64(d.Milliseconds()))
+	return types.ActionContinue
+}
+
+func TestRootHostEmulator_GetHistogramValues(t *testing.T) {
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext {
+			latency, err := proxywasm.DefineHistogramMetric("latency_ms")
+			if err != nil {
+				proxywasm.LogCriticalf("failed to define metric: %v", err)
+			}
+			return &latencyContext{latency: latency}
+		})
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	for _, d := range []time.Duration{120 * time.Millisecond, 15 * time.Millisecond, 480 * time.Millisecond} {
+		host.SetDurationProperty([]string{"response", "duration"}, d)
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutResponseHeaders(id, [][2]string{{":status", "200"}})
+	}
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+
+	id, ok := host.GetMetricID("latency_ms")
+	require.True(t, ok)
+	assert.Equal(t, []uint64{120, 15, 480}, host.GetHistogramValues(id))
+	// the metric value is the last recorded one
+	last, err := host.GetHistogramMetric("latency_ms")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(480), last)
+
+	host.Reset()
+	assert.Len(t, host.GetHistogramValues(id), 0)
+}
+
+type queueResolvingContext struct {
+	proxywasm.DefaultHttpContext
+	vmID string
+}
+
+func (ctx *queueResolvingContext) OnHttpRequestHeaders(int, bool) types.Action {
+	id, err := proxywasm.ResolveSharedQueue(ctx.vmID, "audit")
+	if err != nil {
+		proxywasm.LogCriticalf("failed to resolve queue: %v", err)
+		return types.ActionContinue
+	}
+	proxywasm.LogInfof("resolved: %d", id)
+	return types.ActionContinue
+}
+
+func TestRootHostEmulator_RegisterSharedQueueForVM(t *testing.T) {
+	vmID := "audit_vm"
+	opt := NewEmulatorOption().
+		WithNewHttpContext(func(uint32, uint32) proxywasm.HttpContext { return &queueResolvingContext{vmID: vmID} })
+	host := NewHostEmulator(opt)
+	defer host.Done()
+
+	// the queue of the same name in this VM is a different one
+	local, err := proxywasm.RegisterSharedQueue("audit")
+	require.NoError(t, err)
+	audit := host.RegisterSharedQueueForVM("audit_vm", "audit")
+	assert.NotEqual(t, local, audit)
+	assert.Equal(t, audit, host.RegisterSharedQueueForVM("audit_vm", "audit"))
+
+	for i := 0; i < 2; i++ {
+		id := host.HttpFilterInitContext()
+		host.HttpFilterPutRequestHeaders(id, nil)
+	}
+	require.Len(t, host.GetLogs(types.LogLevelCritical), 0)
+	exp := fmt.Sprintf("resolved: %d", audit)
+	assert.Equal(t, []string{exp, exp}, host.GetLogs(types.LogLevelInfo))
+
+	vmID = "unknown_vm"
+	id := host.HttpFilterInitContext()
+	host.HttpFilterPutRequestHeaders(id, nil)
+	assert.Equal(t, []string{"failed to resolve queue: error status returned by host: not found"},
+		host.GetLogs(types.LogLevelCritical))
+}
@@ -0,0 +1,164 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxytest
+
+import "github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+
+// EmulatorState is a deep copy of the mutable state of the emulator taken by HostEmulator.Snapshot.
+type EmulatorState struct {
+	logs       [types.LogLevelMax][]string
+	allLogs    []LogEntry
+	tickCount  int
+	tickPeriod uint32
+
+	queues             map[uint32][][]byte
+	queueNameID        map[string]uint32
+	foreignQueueNameID map[[2]string]uint32
+	foreignQueueIDs    map[uint32]bool
+
+	sharedDataKVS map[string]sharedData
+	properties    map[string][]byte
+
+	metricIDToValue map[uint32]uint64
+	histogramValues map[uint32][]uint64
+	metricIDToType  map[uint32]types.MetricType
+	metricNameToID  map[string]uint32
+}
+
+// impl HostEmulator
+func (r *rootHostEmulator) Snapshot() *EmulatorState {
+	s := &EmulatorState{
+		allLogs:            append([]LogEntry{}, r.allLogs...),
+		tickCount:          r.tickCount,
+		tickPeriod:         r.tickPeriod,
+		queues:             make(map[uint32][][]byte, len(r.queues)),
+		queueNameID:        make(map[string]uint32, len(r.queueNameID)),
+		foreignQueueNameID: make(map[[2]string]uint32, len(r.foreignQueueNameID)),
+		foreignQueueIDs:    make(map[uint32]bool, len(r.foreignQueueIDs)),
+		sharedDataKVS:      make(map[string]sharedData, len(r.sharedDataKVS)),
+		properties:         make(map[string][]byte, len(r.properties)),
+		metricIDToValue:    make(map[uint32]uint64, len(r.metricIDToValue)),
+		histogramValues:    make(map[uint32][]uint64, len(r.histogramValues)),
+		metricIDToType:     make(map[uint32]types.MetricType, len(r.metricIDToType)),
+		metricNameToID:     make(map[string]uint32, len(r.metricNameToID)),
+	}
+	for level, logs := range r.logs {
+		s.logs[level] = append([]string{}, logs...)
+	}
+	for id, queue := range r.queues {
+		s.queues[id] = cloneQueue(queue)
+	}
+	for name, id := range r.queueNameID {
+		s.queueNameID[name] = id
+	}
+	for key, id := range r.foreignQueueNameID {
+		s.foreignQueueNameID[key] = id
+	}
+	for id := range r.foreignQueueIDs {
+		s.foreignQueueIDs[id] = true
+	}
+	for key, value := range r.sharedDataKVS {
+		s.sharedDataKVS[key] = sharedData{data: append([]byte{}, value.data...), cas: value.cas}
+	}
+	for path, value := range r.properties {
+		s.properties[path] = append([]byte{}, value...)
+	}
+	for id, value := range r.metricIDToValue {
+		s.metricIDToValue[id] = value
+	}
+	for id, values := range r.histogramValues {
+		s.histogramValues[id] = append([]uint64(nil), values...)
+	}
+	for id, metricType := range r.metricIDToType {
+		s.metricIDToType[id] = metricType
+	}
+	for name, id := range r.metricNameToID {
+		s.metricNameToID[name] = id
+	}
+	return s
+}
+
+// impl HostEmulator
+func (h *hostEmulator) Restore(s *EmulatorState) {
+	// the contexts held by the plugin are not captured, so they are discarded along with their callouts
+	for _, id := range h.httpHostEmulator.reset() {
+		h.lifecycles.onDelete(id)
+	}
+	for _, id := range h.networkHostEmulator.reset() {
+		h.lifecycles.onDelete(id)
+	}
+	h.lifecycles.reset()
+	h.rootHostEmulator.resetCallouts()
+	h.rootHostEmulator.restore(s)
+}
+
+func (r *rootHostEmulator) restore(s *EmulatorState) {
+	// copied again so that the same state can be restored multiple times
+	for level, logs := range s.logs {
+		r.logs[level] = append([]string{}, logs...)
+	}
+	r.allLogs = append([]LogEntry{}, s.allLogs...)
+	r.tickCount = s.tickCount
+	r.tickPeriod = s.tickPeriod
+
+	r.queues = make(map[uint32][][]byte, len(s.queues))
+	for id, queue := range s.queues {
+		r.queues[id] = cloneQueue(queue)
+	}
+	r.queueNameID = make(map[string]uint32, len(s.queueNameID))
+	for name, id := range s.queueNameID {
+		r.queueNameID[name] = id
+	}
+	r.foreignQueueNameID = make(map[[2]string]uint32, len(s.foreignQueueNameID))
+	for key, id := range s.foreignQueueNameID {
+		r.foreignQueueNameID[key] = id
+	}
+	r.foreignQueueIDs = make(map[uint32]bool, len(s.foreignQueueIDs))
+	for id := range s.foreignQueueIDs {
+		r.foreignQueueIDs[id] = true
+	}
+	r.sharedDataKVS = make(map[string]*sharedData, len(s.sharedDataKVS))
+	for key, value := range s.sharedDataKVS {
+		r.sharedDataKVS[key] = &sharedData{data: append([]byte{}, value.data...), cas: value.cas}
+	}
+	r.properties = make(map[string][]byte, len(s.properties))
+	for path, value := range s.properties {
+		r.properties[path] = append([]byte{}, value...)
+	}
+	r.metricIDToValue = make(map[uint32]uint64, len(s.metricIDToValue))
+	for id, value := range s.metricIDToValue {
+		r.metricIDToValue[id] = value
+	}
+	r.histogramValues = make(map[uint32][]uint64, len(s.histogramValues))
+	for id, values := range s.histogramValues {
+		r.histogramValues[id] = append([]uint64(nil), values...)
+	}
+	r.metricIDToType = make(map[uint32]types.MetricType, len(s.metricIDToType))
+	for id, metricType := range s.metricIDToType {
+		r.metricIDToType[id] = metricType
+	}
+	r.metricNameToID = make(map[string]uint32, len(s.metricNameToID))
+	for name, id := range s.metricNameToID {
+		r.metricNameToID[name] = id
+	}
+}
+
+func cloneQueue(queue [][]byte) [][]byte {
+	ret := make([][]byte, len(queue))
+	for i, item := range queue {
+		ret[i] = append([]byte{}, item...)
+	}
+	return ret
+}
@@ -0,0 +1,251 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxytest
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/rawhostcall"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// tracingHost records the names of the host functions called by the plugin,
+// e.g. "ProxyHttpCall", before delegating them to the underlying host.
+type tracingHost struct {
+	rawhostcall.ProxyWASMHost
+	calls *[]string
+	meter *allocMeter
+}
+
+var _ rawhostcall.ProxyWASMHost = &tracingHost{}
+
+// record records the call and returns the function to be deferred till the end of the call.
+func (t *tracingHost) record(name string) func() {
+	end := t.meter.hostCall()
+	*t.calls = append(*t.calls, name)
+	return end
+}
+
+func (t *tracingHost) ProxyLog(logLevel types.LogLevel, messageData *byte, messageSize int) types.Status {
+	defer t.record("ProxyLog")()
+	return t.ProxyWASMHost.ProxyLog(logLevel, messageData, messageSize)
+}
+
+func (t *tracingHost) ProxySetProperty(pathData *byte, pathSize int, valueData *byte, valueSize int) types.Status {
+	defer t.record("ProxySetProperty")()
+	return t.ProxyWASMHost.ProxySetProperty(pathData, pathSize, valueData, valueSize)
+}
+
+func (t *tracingHost) ProxyGetProperty(pathData *byte, pathSize int, returnValueData **byte, returnValueSize *int) types.Status {
+	defer t.record("ProxyGetProperty")()
+	return t.ProxyWASMHost.ProxyGetProperty(pathData, pathSize, returnValueData, returnValueSize)
+}
+
+func (t *tracingHost) ProxySendLocalResponse(statusCode uint32, statusCodeDetailData *byte, statusCodeDetailsSize int,
+	bodyData *byte, bodySize int, headersData *byte, headersSize int, grpcStatus int32) types.Status {
+	defer t.record("ProxySendLocalResponse")()
+	return t.ProxyWASMHost.ProxySendLocalResponse(statusCode, statusCodeDetailData, statusCodeDetailsSize,
+		bodyData, bodySize, headersData, headersSize, grpcStatus)
+}
+
+func (t *tracingHost) ProxyGetSharedData(keyData *byte, keySize int, returnValueData **byte, returnValueSize *int, returnCas *uint32) types.Status {
+	defer t.record("ProxyGetSharedData")()
+	return t.ProxyWASMHost.ProxyGetSharedData(keyData, keySize, returnValueData, returnValueSize, returnCas)
+}
+
+func (t *tracingHost) ProxySetSharedData(keyData *byte, keySize int, valueData *byte, valueSize int, cas uint32) types.Status {
+	defer t.record("ProxySetSharedData")()
+	return t.ProxyWASMHost.ProxySetSharedData(keyData, keySize, valueData, valueSize, cas)
+}
+
+func (t *tracingHost) ProxyRegisterSharedQueue(nameData *byte, nameSize int, returnID *uint32) types.Status {
+	defer t.record("ProxyRegisterSharedQueue")()
+	return t.ProxyWASMHost.ProxyRegisterSharedQueue(nameData, nameSize, returnID)
+}
+
+func (t *tracingHost) ProxyResolveSharedQueue(vmIDData *byte, vmIDSize int, nameData *byte, nameSize int, returnID *uint32) types.Status {
+	defer t.record("ProxyResolveSharedQueue")()
+	return t.ProxyWASMHost.ProxyResolveSharedQueue(vmIDData, vmIDSize, nameData, nameSize, returnID)
+}
+
+func (t *tracingHost) ProxyDequeueSharedQueue(queueID uint32, returnValueData **byte, returnValueSize *int) types.Status {
+	defer t.record("ProxyDequeueSharedQueue")()
+	return t.ProxyWASMHost.ProxyDequeueSharedQueue(queueID, returnValueData, returnValueSize)
+}
+
+func (t *tracingHost) ProxyEnqueueSharedQueue(queueID uint32, valueData *byte, valueSize int) types.Status {
+	defer t.record("ProxyEnqueueSharedQueue")()
+	return t.ProxyWASMHost.ProxyEnqueueSharedQueue(queueID, valueData, valueSize)
+}
+
+func (t *tracingHost) ProxyGetHeaderMapValue(mapType types.MapType, keyData *byte, keySize int, returnValueData **byte, returnValueSize *int) types.Status {
+	defer t.record("ProxyGetHeaderMapValue")()
+	return t.ProxyWASMHost.ProxyGetHeaderMapValue(mapType, keyData, keySize, returnValueData, returnValueSize)
+}
+
+func (t *tracingHost) ProxyAddHeaderMapValue(mapType types.MapType, keyData *byte, keySize int, valueData *byte, valueSize int) types.Status {
+	defer t.record("ProxyAddHeaderMapValue")()
+	return t.ProxyWASMHost.ProxyAddHeaderMapValue(mapType, keyData, keySize, valueData, valueSize)
+}
+
+func (t *tracingHost) ProxyReplaceHeaderMapValue(mapType types.MapType, keyData *byte, keySize int, valueData *byte, valueSize int) types.Status {
+	defer t.record("ProxyReplaceHeaderMapValue")()
+	return t.ProxyWASMHost.ProxyReplaceHeaderMapValue(mapType, keyData, keySize, valueData, valueSize)
+}
+
+func (t *tracingHost) ProxyContinueStream(streamType types.StreamType) types.Status {
+	defer t.record("ProxyContinueStream")()
+	return t.ProxyWASMHost.ProxyContinueStream(streamType)
+}
+
+func (t *tracingHost) ProxyCloseStream(streamType types.StreamType) types.Status {
+	defer t.record("ProxyCloseStream")()
+	return t.ProxyWASMHost.ProxyCloseStream(streamType)
+}
+
+func (t *tracingHost) ProxyRemoveHeaderMapValue(mapType types.MapType, keyData *byte, keySize int) types.Status {
+	defer t.record("ProxyRemoveHeaderMapValue")()
+	return t.ProxyWASMHost.ProxyRemoveHeaderMapValue(mapType, keyData, keySize)
+}
+
+func (t *tracingHost) ProxyGetHeaderMapPairs(mapType types.MapType, returnValueData **byte, returnValueSize *int) types.Status {
+	defer t.record("ProxyGetHeaderMapPairs")()
+	return t.ProxyWASMHost.ProxyGetHeaderMapPairs(mapType, returnValueData, returnValueSize)
+}
+
+func (t *tracingHost) ProxySetHeaderMapPairs(mapType types.MapType, mapData *byte, mapSize int) types.Status {
+	defer t.record("ProxySetHeaderMapPairs")()
+	return t.ProxyWASMHost.ProxySetHeaderMapPairs(mapType, mapData, mapSize)
+}
+
+func (t *tracingHost) ProxyGetBufferBytes(bt types.BufferType, start int, maxSize int, returnBufferData **byte, returnBufferSize *int) types.Status {
+	defer t.record("ProxyGetBufferBytes")()
+	return t.ProxyWASMHost.ProxyGetBufferBytes(bt, start, maxSize, returnBufferData, returnBufferSize)
+}
+
+func (t *tracingHost) ProxySetBufferBytes(bt types.BufferType, start int, maxSize int, bufferData *byte, bufferSize int) types.Status {
+	defer t.record("ProxySetBufferBytes")()
+	return t.ProxyWASMHost.ProxySetBufferBytes(bt, start, maxSize, bufferData, bufferSize)
+}
+
+func (t *tracingHost) ProxyHttpCall(upstreamData *byte, upstreamSize int, headerData *byte, headerSize int,
+	bodyData *byte, bodySize int, trailersData *byte, trailersSize int, timeout uint32, calloutIDPtr *uint32) types.Status {
+	defer t.record("ProxyHttpCall")()
+	return t.ProxyWASMHost.ProxyHttpCall(upstreamData, upstreamSize, headerData, headerSize,
+		bodyData, bodySize, trailersData, trailersSize, timeout, calloutIDPtr)
+}
+
+func (t *tracingHost) ProxyGrpcCall(upstreamData *byte, upstreamSize int, serviceNameData *byte, serviceNameSize int,
+	methodData *byte, methodSize int, initialMetadataData *byte, initialMetadataSize int,
+	messageData *byte, messageSize int, timeout uint32, calloutIDPtr *uint32) types.Status {
+	defer t.record("ProxyGrpcCall")()
+	return t.ProxyWASMHost.ProxyGrpcCall(upstreamData, upstreamSize, serviceNameData, serviceNameSize,
+		methodData, methodSize, initialMetadataData, initialMetadataSize, messageData, messageSize, timeout, calloutIDPtr)
+}
+
+func (t *tracingHost) ProxyGrpcStream(upstreamData *byte, upstreamSize int, serviceNameData *byte, serviceNameSize int,
+	methodData *byte, methodSize int, initialMetadataData *byte, initialMetadataSize int, streamIDPtr *uint32) types.Status {
+	defer t.record("ProxyGrpcStream")()
+	return t.ProxyWASMHost.ProxyGrpcStream(upstreamData, upstreamSize, serviceNameData, serviceNameSize,
+		methodData, methodSize, initialMetadataData, initialMetadataSize, streamIDPtr)
+}
+
+func (t *tracingHost) ProxyGrpcSend(streamID uint32, messageData *byte, messageSize int, endOfStream bool) types.Status {
+	defer t.record("ProxyGrpcSend")()
+	return t.ProxyWASMHost.ProxyGrpcSend(streamID, messageData, messageSize, endOfStream)
+}
+
+func (t *tracingHost) ProxyGrpcCancel(calloutID uint32) types.Status {
+	defer t.record("ProxyGrpcCancel")()
+	return t.ProxyWASMHost.ProxyGrpcCancel(calloutID)
+}
+
+func (t *tracingHost) ProxyGrpcClose(streamID uint32) types.Status {
+	defer t.record("ProxyGrpcClose")()
+	return t.ProxyWASMHost.ProxyGrpcClose(streamID)
+}
+
+func (t *tracingHost) ProxySetTickPeriodMilliseconds(period uint32) types.Status {
+	defer t.record("ProxySetTickPeriodMilliseconds")()
+	return t.ProxyWASMHost.ProxySetTickPeriodMilliseconds(period)
+}
+
+func (t *tracingHost) ProxySetEffectiveContext(contextID uint32) types.Status {
+	defer t.record("ProxySetEffectiveContext")()
+	return t.ProxyWASMHost.ProxySetEffectiveContext(contextID)
+}
+
+func (t *tracingHost) ProxyDone() types.Status {
+	defer t.record("ProxyDone")()
+	return t.ProxyWASMHost.ProxyDone()
+}
+
+func (t *tracingHost) ProxyDefineMetric(metricType types.MetricType, metricNameData *byte, metricNameSize int, returnMetricIDPtr *uint32) types.Status {
+	defer t.record("ProxyDefineMetric")()
+	return t.ProxyWASMHost.ProxyDefineMetric(metricType, metricNameData, metricNameSize, returnMetricIDPtr)
+}
+
+func (t *tracingHost) ProxyIncrementMetric(metricID uint32, offset int64) types.Status {
+	defer t.record("ProxyIncrementMetric")()
+	return t.ProxyWASMHost.ProxyIncrementMetric(metricID, offset)
+}
+
+func (t *tracingHost) ProxyRecordMetric(metricID uint32, value uint64) types.Status {
+	defer t.record("ProxyRecordMetric")()
+	return t.ProxyWASMHost.ProxyRecordMetric(metricID, value)
+}
+
+func (t *tracingHost) ProxyGetMetric(metricID uint32, returnMetricValue *uint64) types.Status {
+	defer t.record("ProxyGetMetric")()
+	return t.ProxyWASMHost.ProxyGetMetric(metricID, returnMetricValue)
+}
+
+func (t *tracingHost) ProxyCallForeignFunction(funcNameData *byte, funcNameSize int, paramData *byte, paramSize int,
+	returnData **byte, returnSize *int) types.Status {
+	defer t.record("ProxyCallForeignFunction")()
+	return t.ProxyWASMHost.ProxyCallForeignFunction(funcNameData, funcNameSize, paramData, paramSize, returnData, returnSize)
+}
+
+// impl HostEmulator
+func (h *hostEmulator) GetHostCalls() []string {
+	return append([]string(nil), h.hostCalls...)
+}
+
+// impl HostEmulator
+func (h *hostEmulator) ClearHostCalls() {
+	h.hostCalls = nil
+}
+
+// impl HostEmulator
+func (h *hostEmulator) AssertNotCalled(t testing.TB, name string) bool {
+	t.Helper()
+	if _, ok := reflect.TypeOf((*rawhostcall.ProxyWASMHost)(nil)).Elem().MethodByName(name); !ok {
+		t.Errorf("unknown host function: %s", name)
+		return false
+	}
+
+	var count int
+	for _, call := range h.hostCalls {
+		if call == name {
+			count++
+		}
+	}
+	if count > 0 {
+		t.Errorf("%s should not be called but called %d times", name, count)
+		return false
+	}
+	return true
+}
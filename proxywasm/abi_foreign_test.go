@@ -0,0 +1,33 @@
+package proxywasm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type foreignFunctionContext struct {
+	DefaultRootContext
+	funcID   uint32
+	dataSize int
+}
+
+func (ctx *foreignFunctionContext) OnForeignFunction(funcID uint32, dataSize int) {
+	ctx.funcID = funcID
+	ctx.dataSize = dataSize
+}
+
+func Test_onForeignFunction(t *testing.T) {
+	var id uint32 = 100
+	currentStateMux.Lock()
+	defer currentStateMux.Unlock()
+
+	currentState = &state{rootContexts: map[uint32]*rootContextState{id: {context: &foreignFunctionContext{}}}}
+	ctx, ok := currentState.rootContexts[id].context.(*foreignFunctionContext)
+	require.True(t, ok)
+	proxyOnForeignFunction(id, 3, 10)
+	assert.Equal(t, uint32(3), ctx.funcID)
+	assert.Equal(t, 10, ctx.dataSize)
+	assert.Equal(t, id, currentState.activeContextID)
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxywasm
+
+import "github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+
+//export proxy_on_grpc_receive
+func proxyOnGrpcReceive(rootContextID, id uint32, messageSize int) {
+	root, ok := currentState.rootContexts[rootContextID]
+	if !ok {
+		panic("grpc_receive on invalid root context")
+	}
+
+	cb := root.grpcCallbacks[id]
+	if cb == nil {
+		panic("invalid grpc call or stream id")
+	}
+
+	SetEffectiveContext(cb.callerContextID)
+	currentState.setActiveContextID(cb.callerContextID)
+	if cb.onResponse != nil {
+		// the response of unary calls is the last message
+		delete(root.grpcCallbacks, id)
+		cb.onResponse(types.GrpcStatusOK, messageSize)
+		return
+	}
+	cb.onMessage(messageSize)
+}
+
+//export proxy_on_grpc_close
+func proxyOnGrpcClose(rootContextID, id uint32, statusCode uint32) {
+	root, ok := currentState.rootContexts[rootContextID]
+	if !ok {
+		panic("grpc_close on invalid root context")
+	}
+
+	cb := root.grpcCallbacks[id]
+	if cb == nil {
+		panic("invalid grpc call or stream id")
+	}
+
+	SetEffectiveContext(cb.callerContextID)
+	currentState.setActiveContextID(cb.callerContextID)
+	delete(root.grpcCallbacks, id)
+	if cb.onResponse != nil {
+		// unary calls are closed without the response on failures
+		cb.onResponse(types.GrpcStatus(statusCode), 0)
+		return
+	}
+	cb.onClose(types.GrpcStatus(statusCode))
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxywasm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/rawhostcall"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+func Test_proxyOnGrpc(t *testing.T) {
+	hostMutex.Lock()
+	defer hostMutex.Unlock()
+	rawhostcall.RegisterMockWASMHost(rawhostcall.DefaultProxyWAMSHost{})
+
+	currentStateMux.Lock()
+	defer currentStateMux.Unlock()
+
+	var (
+		rootContextID uint32 = 1
+		callID        uint32 = 10
+		streamID      uint32 = 11
+		statuses      []types.GrpcStatus
+		sizes         []int
+	)
+	currentState = &state{
+		rootContexts: map[uint32]*rootContextState{rootContextID: {
+			grpcCallbacks: map[uint32]*grpcCallbackAttribute{
+				callID: {onResponse: func(status types.GrpcStatus, messageSize int) {
+					statuses = append(statuses, status)
+					sizes = append(sizes, messageSize)
+				}},
+				streamID: {
+					onMessage: func(messageSize int) { sizes = append(sizes, messageSize) },
+					onClose:   func(status types.GrpcStatus) { statuses = append(statuses, status) },
+				},
+			},
+		}},
+	}
+	callbacks := currentState.rootContexts[rootContextID].grpcCallbacks
+
+	// the callback of the unary call is removed on the response
+	proxyOnGrpcReceive(rootContextID, callID, 5)
+	_, ok := callbacks[callID]
+	require.False(t, ok)
+
+	// the callbacks of the stream are kept until the stream is closed
+	proxyOnGrpcReceive(rootContextID, streamID, 3)
+	proxyOnGrpcReceive(rootContextID, streamID, 4)
+	_, ok = callbacks[streamID]
+	require.True(t, ok)
+	proxyOnGrpcClose(rootContextID, streamID, uint32(types.GrpcStatusUnavailable))
+	_, ok = callbacks[streamID]
+	require.False(t, ok)
+
+	assert.Equal(t, []types.GrpcStatus{types.GrpcStatusOK, types.GrpcStatusUnavailable}, statuses)
+	assert.Equal(t, []int{5, 3, 4}, sizes)
+}
@@ -76,6 +76,14 @@ func ProxyOnHttpCallResponse(rootContextID, calloutID uint32, numHeaders, bodySi
 	proxyOnHttpCallResponse(rootContextID, calloutID, numHeaders, bodySize, numTrailers)
 }
 
+func ProxyOnGrpcReceive(rootContextID, id uint32, messageSize int) {
+	proxyOnGrpcReceive(rootContextID, id, messageSize)
+}
+
+func ProxyOnGrpcClose(rootContextID, id uint32, statusCode uint32) {
+	proxyOnGrpcClose(rootContextID, id, statusCode)
+}
+
 func ProxyOnContextCreate(contextID uint32, rootContextID uint32) {
 	proxyOnContextCreate(contextID, rootContextID)
 }
@@ -99,3 +107,15 @@ func ProxyOnLog(contextID uint32) {
 func ProxyOnDelete(contextID uint32) {
 	proxyOnDelete(contextID)
 }
+
+func ProxyOnForeignFunction(rootContextID, funcID uint32, dataSize int) {
+	proxyOnForeignFunction(rootContextID, funcID, dataSize)
+}
+
+func SerializeAny(typeURL string, value []byte) []byte {
+	return serializeAny(typeURL, value)
+}
+
+func DeserializeAny(raw []byte) (typeURL string, value []byte, err error) {
+	return deserializeAny(raw)
+}
@@ -20,5 +20,7 @@ func proxyOnTick(rootContextID uint32) {
 	if !ok {
 		panic("invalid root_context_id")
 	}
+
+	currentState.setActiveContextID(rootContextID)
 	ctx.context.OnTick()
 }
@@ -26,4 +26,5 @@ func Test_onTick(t *testing.T) {
 	require.True(t, ok)
 	proxyOnTick(id)
 	assert.True(t, ctx.onTick)
+	assert.Equal(t, id, currentState.activeContextID)
 }
@@ -21,6 +21,7 @@ import (
 type RootContext interface {
 	OnQueueReady(queueID uint32)
 	OnTick()
+	OnForeignFunction(funcID uint32, dataSize int)
 	OnVMStart(vmConfigurationSize int) bool
 	OnPluginStart(pluginConfigurationSize int) bool
 	OnVMDone() bool
@@ -61,12 +62,13 @@ var (
 )
 
 // impl RootContext
-func (*DefaultRootContext) OnQueueReady(uint32)    {}
-func (*DefaultRootContext) OnTick()                {}
-func (*DefaultRootContext) OnVMStart(int) bool     { return true }
-func (*DefaultRootContext) OnPluginStart(int) bool { return true }
-func (*DefaultRootContext) OnVMDone() bool         { return true }
-func (*DefaultRootContext) OnLog()                 {}
+func (*DefaultRootContext) OnQueueReady(uint32)           {}
+func (*DefaultRootContext) OnTick()                       {}
+func (*DefaultRootContext) OnForeignFunction(uint32, int) {}
+func (*DefaultRootContext) OnVMStart(int) bool            { return true }
+func (*DefaultRootContext) OnPluginStart(int) bool        { return true }
+func (*DefaultRootContext) OnVMDone() bool                { return true }
+func (*DefaultRootContext) OnLog()                        {}
 
 // impl StreamContext
 func (*DefaultStreamContext) OnDownstreamData(int, bool) types.Action { return types.ActionContinue }
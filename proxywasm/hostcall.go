@@ -15,6 +15,12 @@
 package proxywasm
 
 import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/rawhostcall"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
 )
@@ -31,12 +37,28 @@ func GetVMConfiguration(size int) ([]byte, error) {
 	return ret, types.StatusToError(st)
 }
 
+// SendHttpResponse sends a local response with the given status code, headers and body.
+//
+// Note that the reason phrase of the status line, e.g. "I'm a teapot" of 418, cannot be set by plugins.
+// The ABI has neither a pseudo-header nor an argument for it, and Envoy always derives the reason phrase
+// from the status code on HTTP/1 while HTTP/2 has no reason phrase at all.
 func SendHttpResponse(statusCode uint32, headers [][2]string, body string) types.Status {
+	return sendLocalResponse(statusCode, headers, body, -1)
+}
+
+// SendHttpResponseWithGrpcStatus sends a local response with the given gRPC status,
+// which is used by Envoy when the request is a gRPC one.
+func SendHttpResponseWithGrpcStatus(statusCode uint32, headers [][2]string, body string,
+	grpcStatus types.GrpcStatus) types.Status {
+	return sendLocalResponse(statusCode, headers, body, int32(grpcStatus))
+}
+
+func sendLocalResponse(statusCode uint32, headers [][2]string, body string, grpcStatus int32) types.Status {
 	shs := SerializeMap(headers)
 	hp := &shs[0]
 	hl := len(shs)
 	return rawhostcall.ProxySendLocalResponse(statusCode, nil, 0,
-		stringBytePtr(body), len(body), hp, hl, -1,
+		stringBytePtr(body), len(body), hp, hl, grpcStatus,
 	)
 }
 
@@ -71,6 +93,13 @@ func GetHttpCallResponseHeaders() ([][2]string, error) {
 	return ret, types.StatusToError(st)
 }
 
+// GetHttpCallResponseHeader returns the value of the given header of the callout response.
+// This must be called in the callback of DispatchHttpCall.
+func GetHttpCallResponseHeader(key string) (string, error) {
+	ret, st := getMapValue(types.MapTypeHttpCallResponseHeaders, key)
+	return ret, types.StatusToError(st)
+}
+
 func GetHttpCallResponseBody(start, maxSize int) ([]byte, error) {
 	ret, st := getBuffer(types.BufferTypeHttpCallResponseBody, start, maxSize)
 	return ret, types.StatusToError(st)
@@ -91,6 +120,16 @@ func GetUpstreamData(start, maxSize int) ([]byte, error) {
 	return ret, types.StatusToError(st)
 }
 
+// SetDownstreamData replaces the downstream data currently buffered with the given data.
+func SetDownstreamData(data []byte) error {
+	return setBuffer(types.BufferTypeDownstreamData, 0, math.MaxInt32, data)
+}
+
+// SetUpstreamData replaces the upstream data currently buffered with the given data.
+func SetUpstreamData(data []byte) error {
+	return setBuffer(types.BufferTypeUpstreamData, 0, math.MaxInt32, data)
+}
+
 func GetHttpRequestHeaders() ([][2]string, error) {
 	ret, st := getMap(types.MapTypeHttpRequestHeaders)
 	return ret, types.StatusToError(st)
@@ -117,18 +156,125 @@ func AddHttpRequestHeader(key, value string) error {
 	return types.StatusToError(addMapValue(types.MapTypeHttpRequestHeaders, key, value))
 }
 
+// GetTraceID returns the trace id of the current request, which is taken from the W3C
+// traceparent header, or the B3 x-b3-traceid header if the former is absent.
+func GetTraceID() (string, error) {
+	traceparent, err := GetHttpRequestHeader("traceparent")
+	if err == types.ErrorStatusNotFound {
+		return GetHttpRequestHeader("x-b3-traceid")
+	} else if err != nil {
+		return "", err
+	}
+
+	// version "-" trace-id "-" parent-id "-" trace-flags
+	fields := strings.Split(traceparent, "-")
+	if len(fields) < 4 || len(fields[1]) != 32 {
+		return "", fmt.Errorf("invalid traceparent header: %s", traceparent)
+	}
+	return fields[1], nil
+}
+
+// IsWebSocketUpgrade returns true if the current request asks for the upgrade to WebSocket,
+// i.e. it has the "upgrade: websocket" header and the "upgrade" token in the connection header.
+func IsWebSocketUpgrade() (bool, error) {
+	upgrade, err := GetHttpRequestHeader("upgrade")
+	if err == types.ErrorStatusNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if !strings.EqualFold(strings.TrimSpace(upgrade), "websocket") {
+		return false, nil
+	}
+
+	connection, err := GetHttpRequestHeader("connection")
+	if err == types.ErrorStatusNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	// e.g. "keep-alive, Upgrade"
+	for _, token := range strings.Split(connection, ",") {
+		if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// GetHttpRequestPath returns the :path pseudo header including the query string.
+// Modifications by SetHttpRequestPath or SetHttpRequestHeader(":path", ...) are reflected immediately.
+func GetHttpRequestPath() (string, error) {
+	return GetHttpRequestHeader(":path")
+}
+
+// SetHttpRequestPath sets the :path pseudo header.
+func SetHttpRequestPath(path string) error {
+	return SetHttpRequestHeader(":path", path)
+}
+
+// GetHttpRequestQueryParameters returns the query parameters parsed from the :path pseudo header.
+func GetHttpRequestQueryParameters() (url.Values, error) {
+	path, err := GetHttpRequestPath()
+	if err != nil {
+		return nil, err
+	}
+
+	var query string
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		query = path[i+1:]
+	}
+	if i := strings.IndexByte(query, '#'); i >= 0 {
+		query = query[:i]
+	}
+	return url.ParseQuery(query)
+}
+
+// GetHttpRequestQueryParameter returns the first value of the query parameter of the given name.
+// The returned bool reports whether the parameter is present in the :path pseudo header.
+func GetHttpRequestQueryParameter(name string) (string, bool, error) {
+	params, err := GetHttpRequestQueryParameters()
+	if err != nil {
+		return "", false, err
+	}
+
+	values, ok := params[name]
+	if !ok || len(values) == 0 {
+		return "", false, nil
+	}
+	return values[0], true, nil
+}
+
 func GetHttpRequestBody(start, maxSize int) ([]byte, error) {
 	ret, st := getBuffer(types.BufferTypeHttpRequestBody, start, maxSize)
 	return ret, types.StatusToError(st)
 }
 
+// GetWholeHttpRequestBody returns the entire request body currently buffered in the host.
+func GetWholeHttpRequestBody() ([]byte, error) {
+	ret, st := getBuffer(types.BufferTypeHttpRequestBody, 0, math.MaxInt32)
+	return ret, types.StatusToError(st)
+}
+
+// GetHttpRequestBodySize returns the size of the request body, which is derived from
+// the content-length header if present, otherwise from the length of the buffered body.
+func GetHttpRequestBodySize() (int, error) {
+	return getHttpBodySize(types.MapTypeHttpRequestHeaders, types.BufferTypeHttpRequestBody)
+}
+
+// SetHttpRequestBody replaces the whole request body with the given body.
 func SetHttpRequestBody(body []byte) error {
-	var bufferData *byte
-	if len(body) != 0 {
-		bufferData = &body[0]
-	}
-	st := rawhostcall.ProxySetBufferBytes(types.BufferTypeHttpRequestBody, 0, len(body), bufferData, len(body))
-	return types.StatusToError(st)
+	return setBuffer(types.BufferTypeHttpRequestBody, 0, math.MaxInt32, body)
+}
+
+// AppendHttpRequestBody appends the given data to the request body.
+func AppendHttpRequestBody(data []byte) error {
+	return setBuffer(types.BufferTypeHttpRequestBody, math.MaxInt32, 0, data)
+}
+
+// PrependHttpRequestBody prepends the given data to the request body.
+func PrependHttpRequestBody(data []byte) error {
+	return setBuffer(types.BufferTypeHttpRequestBody, 0, 0, data)
 }
 
 func GetHttpRequestTrailers() ([][2]string, error) {
@@ -192,13 +338,63 @@ func GetHttpResponseBody(start, maxSize int) ([]byte, error) {
 	return ret, types.StatusToError(st)
 }
 
-func SetHttpResponseBody(body []byte) error {
-	var bufferData *byte
-	if len(body) != 0 {
-		bufferData = &body[0]
+// GetWholeHttpResponseBody returns the entire response body currently buffered in the host.
+func GetWholeHttpResponseBody() ([]byte, error) {
+	ret, st := getBuffer(types.BufferTypeHttpResponseBody, 0, math.MaxInt32)
+	return ret, types.StatusToError(st)
+}
+
+// GetHttpResponseContentType returns the media type in the content-type response header
+// in lower case without parameters, e.g. "application/json" for "application/json; charset=utf-8".
+func GetHttpResponseContentType() (string, error) {
+	contentType, err := GetHttpResponseHeader("content-type")
+	if err != nil {
+		return "", err
 	}
-	st := rawhostcall.ProxySetBufferBytes(types.BufferTypeHttpResponseBody, 0, len(body), bufferData, len(body))
-	return types.StatusToError(st)
+
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType)), nil
+}
+
+// GetGrpcStatus returns the gRPC status of the response. The grpc-status is looked up in the response
+// trailers first as in normal responses, then in the response headers as in trailers-only responses.
+func GetGrpcStatus() (types.GrpcStatus, error) {
+	value, err := GetHttpResponseTrailer("grpc-status")
+	if err == types.ErrorStatusNotFound {
+		value, err = GetHttpResponseHeader("grpc-status")
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	status, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid grpc-status: %s", value)
+	}
+	return types.GrpcStatus(status), nil
+}
+
+// GetHttpResponseBodySize returns the size of the response body, which is derived from
+// the content-length header if present, otherwise from the length of the buffered body.
+func GetHttpResponseBodySize() (int, error) {
+	return getHttpBodySize(types.MapTypeHttpResponseHeaders, types.BufferTypeHttpResponseBody)
+}
+
+// SetHttpResponseBody replaces the whole response body with the given body.
+func SetHttpResponseBody(body []byte) error {
+	return setBuffer(types.BufferTypeHttpResponseBody, 0, math.MaxInt32, body)
+}
+
+// AppendHttpResponseBody appends the given data to the response body.
+func AppendHttpResponseBody(data []byte) error {
+	return setBuffer(types.BufferTypeHttpResponseBody, math.MaxInt32, 0, data)
+}
+
+// PrependHttpResponseBody prepends the given data to the response body.
+func PrependHttpResponseBody(data []byte) error {
+	return setBuffer(types.BufferTypeHttpResponseBody, 0, 0, data)
 }
 
 func GetHttpResponseTrailers() ([][2]string, error) {
@@ -271,9 +467,15 @@ func GetSharedData(key string) (value []byte, cas uint32, err error) {
 	return RawBytePtrToByteSlice(raw, size), cas, nil
 }
 
+// SetSharedData sets the data of the given key if the given cas matches the current one.
+// Setting empty data deletes the key.
 func SetSharedData(key string, data []byte, cas uint32) error {
+	var dataPtr *byte
+	if len(data) != 0 {
+		dataPtr = &data[0]
+	}
 	st := rawhostcall.ProxySetSharedData(stringBytePtr(key),
-		len(key), &data[0], len(data), cas)
+		len(key), dataPtr, len(data), cas)
 	return types.StatusToError(st)
 }
 
@@ -291,12 +493,64 @@ func GetProperty(path []string) ([]byte, error) {
 
 }
 
+// SetProperty sets the property of the given path. Paths with multiple segments must be given
+// in the serialized form, i.e. string(SerializePropertyPath(segments)), to be read by GetProperty.
+//
+// Note that Envoy stores the values set by this function as filter state, not as dynamic metadata,
+// even under the "metadata" path. Dynamic metadata, e.g. read by access logs with %DYNAMIC_METADATA%,
+// cannot be written by plugins in the ABI version 0.2.0. Use SetTypedFilterState for values consumed by other filters.
 func SetProperty(path string, data []byte) error {
+	var valueData *byte
+	if len(data) != 0 {
+		valueData = &data[0]
+	}
 	return types.StatusToError(rawhostcall.ProxySetProperty(
-		stringBytePtr(path), len(path), &data[0], len(data),
+		stringBytePtr(path), len(path), valueData, len(data),
 	))
 }
 
+// CallForeignFunction calls the foreign function registered in the host under the given name,
+// and returns the data returned by the function.
+func CallForeignFunction(funcName string, param []byte) ([]byte, error) {
+	var paramData *byte
+	if len(param) != 0 {
+		paramData = &param[0]
+	}
+
+	var ret *byte
+	var retSize int
+	st := rawhostcall.ProxyCallForeignFunction(stringBytePtr(funcName), len(funcName),
+		paramData, len(param), &ret, &retSize)
+	if st != types.StatusOK {
+		return nil, types.StatusToError(st)
+	}
+	return RawBytePtrToByteSlice(ret, retSize), nil
+}
+
+// GetForeignFunctionData returns the data passed to RootContext.OnForeignFunction.
+// This must be called in the callback.
+func GetForeignFunctionData(dataSize int) ([]byte, error) {
+	ret, st := getBuffer(types.BufferTypeCallData, 0, dataSize)
+	return ret, types.StatusToError(st)
+}
+
+func getHttpBodySize(mapType types.MapType, bufType types.BufferType) (int, error) {
+	contentLength, st := getMapValue(mapType, "content-length")
+	switch st {
+	case types.StatusOK:
+		size, err := strconv.Atoi(contentLength)
+		if err != nil || size < 0 {
+			return 0, fmt.Errorf("invalid content-length header: %s", contentLength)
+		}
+		return size, nil
+	case types.StatusNotFound:
+		body, st := getBuffer(bufType, 0, math.MaxInt32)
+		return len(body), types.StatusToError(st)
+	default:
+		return 0, types.StatusToError(st)
+	}
+}
+
 func setMap(mapType types.MapType, headers [][2]string) types.Status {
 	shs := SerializeMap(headers)
 	hp := &shs[0]
@@ -340,6 +594,15 @@ func getMap(mapType types.MapType) ([][2]string, types.Status) {
 	return DeserializeMap(bs), types.StatusOK
 }
 
+func setBuffer(bufType types.BufferType, start, maxSize int, data []byte) error {
+	var bufferData *byte
+	if len(data) != 0 {
+		bufferData = &data[0]
+	}
+	st := rawhostcall.ProxySetBufferBytes(bufType, start, maxSize, bufferData, len(data))
+	return types.StatusToError(st)
+}
+
 func getBuffer(bufType types.BufferType, start, maxSize int) ([]byte, types.Status) {
 	var retData *byte
 	var retSize int
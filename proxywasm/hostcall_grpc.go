@@ -0,0 +1,84 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxywasm
+
+import (
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/rawhostcall"
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// DispatchGrpcCall dispatches the unary gRPC call of the given service and method to the upstream cluster.
+// The message is the serialized request message. The callback is called with the status of the call
+// and the size of the response message, which can be read by GetGrpcReceiveBuffer in the callback.
+//
+// Note that the initial and trailing metadata of the response are not available to plugins.
+func DispatchGrpcCall(upstream, serviceName, method string, initialMetadata [][2]string, message []byte,
+	timeoutMillisecond uint32, callBack GrpcCallCallBack) (calloutID uint32, err error) {
+	md := SerializeMap(initialMetadata)
+	switch st := rawhostcall.ProxyGrpcCall(stringBytePtr(upstream), len(upstream),
+		stringBytePtr(serviceName), len(serviceName), stringBytePtr(method), len(method),
+		&md[0], len(md), bytesPtr(message), len(message), timeoutMillisecond, &calloutID); st {
+	case types.StatusOK:
+		currentState.registerGrpcCallbacks(calloutID, &grpcCallbackAttribute{onResponse: callBack})
+		return calloutID, nil
+	default:
+		return 0, types.StatusToError(st)
+	}
+}
+
+// CancelGrpcCall cancels the gRPC call dispatched by DispatchGrpcCall, whose callback is never called afterwards.
+func CancelGrpcCall(calloutID uint32) error {
+	if err := types.StatusToError(rawhostcall.ProxyGrpcCancel(calloutID)); err != nil {
+		return err
+	}
+	currentState.unregisterGrpcCallbacks(calloutID)
+	return nil
+}
+
+// OpenGrpcStream opens the gRPC stream of the given service and method to the upstream cluster.
+// onMessage is called on each message received on the stream, which can be read by GetGrpcReceiveBuffer,
+// and onClose is called once the stream is closed by the remote.
+func OpenGrpcStream(upstream, serviceName, method string, initialMetadata [][2]string,
+	onMessage GrpcStreamMessageCallBack, onClose GrpcStreamCloseCallBack) (streamID uint32, err error) {
+	md := SerializeMap(initialMetadata)
+	switch st := rawhostcall.ProxyGrpcStream(stringBytePtr(upstream), len(upstream),
+		stringBytePtr(serviceName), len(serviceName), stringBytePtr(method), len(method),
+		&md[0], len(md), &streamID); st {
+	case types.StatusOK:
+		currentState.registerGrpcCallbacks(streamID, &grpcCallbackAttribute{onMessage: onMessage, onClose: onClose})
+		return streamID, nil
+	default:
+		return 0, types.StatusToError(st)
+	}
+}
+
+// SendGrpcStreamMessage sends the serialized message on the gRPC stream opened by OpenGrpcStream.
+// Setting endOfStream half-closes the stream, after which the remote can still send messages.
+func SendGrpcStreamMessage(streamID uint32, message []byte, endOfStream bool) error {
+	return types.StatusToError(rawhostcall.ProxyGrpcSend(streamID, bytesPtr(message), len(message), endOfStream))
+}
+
+// CloseGrpcStream half-closes the gRPC stream opened by OpenGrpcStream.
+// The close callback is still called once the remote closes the stream.
+func CloseGrpcStream(streamID uint32) error {
+	return types.StatusToError(rawhostcall.ProxyGrpcClose(streamID))
+}
+
+// GetGrpcReceiveBuffer returns the gRPC message received by the host.
+// This must be called in the callback of DispatchGrpcCall or in the message callback of OpenGrpcStream.
+func GetGrpcReceiveBuffer(start, maxSize int) ([]byte, error) {
+	ret, st := getBuffer(types.BufferTypeGrpcReceiveBuffer, start, maxSize)
+	return ret, types.StatusToError(st)
+}
@@ -25,16 +25,23 @@ type (
 	MetricHistogram uint32
 )
 
-// counter
+func defineMetric(metricType types.MetricType, name string) (uint32, error) {
+	if name == "" {
+		return 0, types.ErrorStatusBadArgument
+	}
 
-func DefineCounterMetric(name string) MetricCounter {
 	var id uint32
-	ptr := stringBytePtr(name)
-	st := rawhostcall.ProxyDefineMetric(types.MetricTypeCounter, ptr, len(name), &id)
-	if err := types.StatusToError(st); err != nil {
-		LogCriticalf("define metric of name %s: %v", name, types.StatusToError(st))
-	}
-	return MetricCounter(id)
+	st := rawhostcall.ProxyDefineMetric(metricType, stringBytePtr(name), len(name), &id)
+	return id, types.StatusToError(st)
+}
+
+// counter
+
+// DefineCounterMetric defines the counter metric of the given name.
+// The name must not be empty.
+func DefineCounterMetric(name string) (MetricCounter, error) {
+	id, err := defineMetric(types.MetricTypeCounter, name)
+	return MetricCounter(id), err
 }
 
 func (m MetricCounter) ID() uint32 {
@@ -60,15 +67,11 @@ func (m MetricCounter) Increment(offset uint64) {
 
 // gauge
 
-func DefineGaugeMetric(name string) MetricGauge {
-	var id uint32
-	ptr := stringBytePtr(name)
-	st := rawhostcall.ProxyDefineMetric(types.MetricTypeGauge, ptr, len(name), &id)
-	if err := types.StatusToError(st); err != nil {
-		LogCriticalf("error define metric of name %s: %v", name, types.StatusToError(st))
-		panic("") // abort
-	}
-	return MetricGauge(id)
+// DefineGaugeMetric defines the gauge metric of the given name.
+// The name must not be empty.
+func DefineGaugeMetric(name string) (MetricGauge, error) {
+	id, err := defineMetric(types.MetricTypeGauge, name)
+	return MetricGauge(id), err
 }
 
 func (m MetricGauge) ID() uint32 {
@@ -93,15 +96,11 @@ func (m MetricGauge) Add(offset int64) {
 
 // histogram
 
-func DefineHistogramMetric(name string) MetricHistogram {
-	var id uint32
-	ptr := stringBytePtr(name)
-	st := rawhostcall.ProxyDefineMetric(types.MetricTypeHistogram, ptr, len(name), &id)
-	if err := types.StatusToError(st); err != nil {
-		LogCriticalf("error define metric of name %s: %v", name, types.StatusToError(st))
-		panic("") // abort
-	}
-	return MetricHistogram(id)
+// DefineHistogramMetric defines the histogram metric of the given name.
+// The name must not be empty.
+func DefineHistogramMetric(name string) (MetricHistogram, error) {
+	id, err := defineMetric(types.MetricTypeHistogram, name)
+	return MetricHistogram(id), err
 }
 
 func (m MetricHistogram) ID() uint32 {
@@ -4,6 +4,7 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/rawhostcall"
 	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
 )
@@ -77,7 +78,8 @@ func TestHostCall_Metric(t *testing.T) {
 		} {
 			t.Run(c.name, func(t *testing.T) {
 				// define metric
-				m := DefineCounterMetric(c.name)
+				m, err := DefineCounterMetric(c.name)
+				require.NoError(t, err)
 
 				// increment
 				m.Increment(c.offset)
@@ -97,7 +99,8 @@ func TestHostCall_Metric(t *testing.T) {
 		} {
 			t.Run(c.name, func(t *testing.T) {
 				// define metric
-				m := DefineGaugeMetric(c.name)
+				m, err := DefineGaugeMetric(c.name)
+				require.NoError(t, err)
 
 				// increment
 				m.Add(c.offset)
@@ -117,7 +120,8 @@ func TestHostCall_Metric(t *testing.T) {
 		} {
 			t.Run(c.name, func(t *testing.T) {
 				// define metric
-				m := DefineHistogramMetric(c.name)
+				m, err := DefineHistogramMetric(c.name)
+				require.NoError(t, err)
 
 				// record
 				m.Record(c.value)
@@ -127,4 +131,14 @@ func TestHostCall_Metric(t *testing.T) {
 			})
 		}
 	})
+
+	t.Run("empty name", func(t *testing.T) {
+		_, err := DefineCounterMetric("")
+		assert.Equal(t, types.ErrorStatusBadArgument, err)
+		_, err = DefineGaugeMetric("")
+		assert.Equal(t, types.ErrorStatusBadArgument, err)
+		_, err = DefineHistogramMetric("")
+		assert.Equal(t, types.ErrorStatusBadArgument, err)
+		assert.Len(t, host.nameToID, 3, "must not be defined in host")
+	})
 }
@@ -0,0 +1,159 @@
+// Copyright 2020 Tetrate
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package proxywasm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
+)
+
+// typed accessors on well-known properties
+// see https://www.envoyproxy.io/docs/envoy/latest/intro/arch_overview/advanced/attributes
+//
+// Note that property values are returned as raw bytes by the host. Integer attributes
+// (e.g. listener_direction, source.port, response.code) are 64-bit little endian values,
+// boolean attributes (e.g. connection.mtls) are single bytes and timestamp/duration attributes
+// are encoded in binary as well. Use GetProperty for these attributes, and GetPropertyString
+// only for string attributes such as request.path or connection.subject_peer_certificate.
+//
+// Note that not all the fields of the plugin's configuration in the host are available as properties.
+// For example, the failure mode of the plugin (fail_open in Envoy's PluginConfig) is handled by the host
+// and exposed neither as a property nor in the plugin configuration in the ABI version 0.2.0,
+// so there is no accessor for it. Plugins which behave differently depending on the failure mode
+// should have it in their own plugin configuration read by GetPluginConfiguration.
+
+// GetPropertyString returns the property at the given path as a string.
+// The value is copied so that binary data is retrieved without any loss.
+func GetPropertyString(path []string) (string, error) {
+	raw, err := GetProperty(path)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
+
+// GetTrafficDirection returns the traffic direction of the listener on which the plugin runs,
+// so that the plugin configured on both inbound and outbound listeners can behave differently.
+func GetTrafficDirection() (types.TrafficDirection, error) {
+	raw, err := GetProperty([]string{"listener_direction"})
+	if err != nil {
+		return types.TrafficDirectionUnspecified, err
+	}
+
+	v, err := decodeInt64Property(raw)
+	if err != nil {
+		return types.TrafficDirectionUnspecified, fmt.Errorf("listener_direction: %v", err)
+	}
+	return types.TrafficDirection(v), nil
+}
+
+// GetListenerDirection is the same as GetTrafficDirection.
+func GetListenerDirection() (types.TrafficDirection, error) {
+	return GetTrafficDirection()
+}
+
+// GetDurationProperty returns the duration attribute at the given path,
+// e.g. GetDurationProperty([]string{"response", "duration"}).
+func GetDurationProperty(path []string) (time.Duration, error) {
+	raw, err := GetProperty(path)
+	if err != nil {
+		return 0, err
+	}
+
+	// durations are encoded as nanoseconds in the same way as integer attributes
+	v, err := decodeInt64Property(raw)
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", strings.Join(path, "."), err)
+	}
+	return time.Duration(v), nil
+}
+
+// GetRequestSize returns the "request.total_size" attribute, which is the size of the request including
+// the headers as counted by the host. Unlike GetHttpRequestBodySize, this doesn't depend on the body
+// currently buffered, e.g. while the request body is still being streamed.
+func GetRequestSize() (int64, error) {
+	raw, err := GetProperty([]string{"request", "total_size"})
+	if err != nil {
+		return 0, err
+	}
+
+	v, err := decodeInt64Property(raw)
+	if err != nil {
+		return 0, fmt.Errorf("request.total_size: %v", err)
+	}
+	return v, nil
+}
+
+// GetListenerMetadata returns the listener metadata at the given path,
+// e.g. GetListenerMetadata("filter_metadata", "my.namespace", "key").
+func GetListenerMetadata(path ...string) ([]byte, error) {
+	return GetProperty(append([]string{"listener_metadata"}, path...))
+}
+
+// GetRouteName returns the name of the route selected for the current request.
+// Note that the route may change after the plugin modifies the request headers such as :authority.
+func GetRouteName() (string, error) {
+	return GetPropertyString([]string{"xds", "route_name"})
+}
+
+// GetUpstreamClusterName returns the name of the upstream cluster selected by the router for the current request,
+// which is available after the routing, e.g. in OnHttpResponseHeaders.
+func GetUpstreamClusterName() (string, error) {
+	return GetPropertyString([]string{"xds", "cluster_name"})
+}
+
+// GetHttpRequestProtocol returns the protocol of the downstream request such as "HTTP/1.1" and "HTTP/2".
+func GetHttpRequestProtocol() (string, error) {
+	return GetPropertyString([]string{"request", "protocol"})
+}
+
+// GetPluginRootID returns the root_id of the plugin configured in the host.
+func GetPluginRootID() (string, error) {
+	return GetPropertyString([]string{"plugin_root_id"})
+}
+
+// SetTypedFilterState sets the filter state of the given key with the value wrapped
+// in google.protobuf.Any of the given type URL, so that it can be consumed by the other filters.
+// This is not dynamic metadata: access logs read it with %FILTER_STATE% rather than %DYNAMIC_METADATA%.
+func SetTypedFilterState(key, typeURL string, value []byte) error {
+	return SetProperty(key, serializeAny(typeURL, value))
+}
+
+// GetTypedFilterState returns the type URL and the value of the filter state
+// set by SetTypedFilterState.
+func GetTypedFilterState(key string) (typeURL string, value []byte, err error) {
+	raw, err := GetProperty([]string{key})
+	if err != nil {
+		return "", nil, err
+	}
+
+	typeURL, value, err = deserializeAny(raw)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %v", key, err)
+	}
+	return typeURL, value, nil
+}
+
+// integer attributes are encoded as 64-bit little endian values by Envoy
+func decodeInt64Property(raw []byte) (int64, error) {
+	if len(raw) != 8 {
+		return 0, fmt.Errorf("invalid size of integer property: %d", len(raw))
+	}
+	return int64(binary.LittleEndian.Uint64(raw)), nil
+}
@@ -11,3 +11,10 @@ func stringBytePtr(msg string) *byte {
 	bt := *(*[]byte)(unsafe.Pointer(&msg))
 	return &bt[0]
 }
+
+func bytesPtr(data []byte) *byte {
+	if len(data) == 0 {
+		return nil
+	}
+	return &data[0]
+}
@@ -80,6 +80,26 @@ func ProxyHttpCall(upstreamData *byte, upstreamSize int, headerData *byte, heade
 	bodyData *byte, bodySize int, trailersData *byte, trailersSize int, timeout uint32, calloutIDPtr *uint32,
 ) types.Status
 
+//export proxy_grpc_call
+func ProxyGrpcCall(upstreamData *byte, upstreamSize int, serviceNameData *byte, serviceNameSize int,
+	methodData *byte, methodSize int, initialMetadataData *byte, initialMetadataSize int,
+	messageData *byte, messageSize int, timeout uint32, calloutIDPtr *uint32,
+) types.Status
+
+//export proxy_grpc_stream
+func ProxyGrpcStream(upstreamData *byte, upstreamSize int, serviceNameData *byte, serviceNameSize int,
+	methodData *byte, methodSize int, initialMetadataData *byte, initialMetadataSize int, streamIDPtr *uint32,
+) types.Status
+
+//export proxy_grpc_send
+func ProxyGrpcSend(streamID uint32, messageData *byte, messageSize int, endOfStream bool) types.Status
+
+//export proxy_grpc_cancel
+func ProxyGrpcCancel(calloutID uint32) types.Status
+
+//export proxy_grpc_close
+func ProxyGrpcClose(streamID uint32) types.Status
+
 //export proxy_set_tick_period_milliseconds
 func ProxySetTickPeriodMilliseconds(period uint32) types.Status
 
@@ -106,3 +126,7 @@ func ProxyGetProperty(pathData *byte, pathSize int, returnValueData **byte, retu
 
 //export proxy_set_property
 func ProxySetProperty(pathData *byte, pathSize int, valueData *byte, valueSize int) types.Status
+
+//export proxy_call_foreign_function
+func ProxyCallForeignFunction(funcNameData *byte, funcNameSize int, paramData *byte, paramSize int,
+	returnData **byte, returnSize *int) types.Status
@@ -46,6 +46,11 @@ type ProxyWASMHost interface {
 	ProxyGetBufferBytes(bt types.BufferType, start int, maxSize int, returnBufferData **byte, returnBufferSize *int) types.Status
 	ProxySetBufferBytes(bt types.BufferType, start int, maxSize int, bufferData *byte, bufferSize int) types.Status
 	ProxyHttpCall(upstreamData *byte, upstreamSize int, headerData *byte, headerSize int, bodyData *byte, bodySize int, trailersData *byte, trailersSize int, timeout uint32, calloutIDPtr *uint32) types.Status
+	ProxyGrpcCall(upstreamData *byte, upstreamSize int, serviceNameData *byte, serviceNameSize int, methodData *byte, methodSize int, initialMetadataData *byte, initialMetadataSize int, messageData *byte, messageSize int, timeout uint32, calloutIDPtr *uint32) types.Status
+	ProxyGrpcStream(upstreamData *byte, upstreamSize int, serviceNameData *byte, serviceNameSize int, methodData *byte, methodSize int, initialMetadataData *byte, initialMetadataSize int, streamIDPtr *uint32) types.Status
+	ProxyGrpcSend(streamID uint32, messageData *byte, messageSize int, endOfStream bool) types.Status
+	ProxyGrpcCancel(calloutID uint32) types.Status
+	ProxyGrpcClose(streamID uint32) types.Status
 	ProxySetTickPeriodMilliseconds(period uint32) types.Status
 	ProxySetEffectiveContext(contextID uint32) types.Status
 	ProxyDone() types.Status
@@ -53,6 +58,7 @@ type ProxyWASMHost interface {
 	ProxyIncrementMetric(metricID uint32, offset int64) types.Status
 	ProxyRecordMetric(metricID uint32, value uint64) types.Status
 	ProxyGetMetric(metricID uint32, returnMetricValue *uint64) types.Status
+	ProxyCallForeignFunction(funcNameData *byte, funcNameSize int, paramData *byte, paramSize int, returnData **byte, returnSize *int) types.Status
 }
 
 type DefaultProxyWAMSHost struct{}
@@ -118,6 +124,17 @@ func (d DefaultProxyWAMSHost) ProxySetBufferBytes(bt types.BufferType, start int
 func (d DefaultProxyWAMSHost) ProxyHttpCall(upstreamData *byte, upstreamSize int, headerData *byte, headerSize int, bodyData *byte, bodySize int, trailersData *byte, trailersSize int, timeout uint32, calloutIDPtr *uint32) types.Status {
 	return 0
 }
+func (d DefaultProxyWAMSHost) ProxyGrpcCall(upstreamData *byte, upstreamSize int, serviceNameData *byte, serviceNameSize int, methodData *byte, methodSize int, initialMetadataData *byte, initialMetadataSize int, messageData *byte, messageSize int, timeout uint32, calloutIDPtr *uint32) types.Status {
+	return 0
+}
+func (d DefaultProxyWAMSHost) ProxyGrpcStream(upstreamData *byte, upstreamSize int, serviceNameData *byte, serviceNameSize int, methodData *byte, methodSize int, initialMetadataData *byte, initialMetadataSize int, streamIDPtr *uint32) types.Status {
+	return 0
+}
+func (d DefaultProxyWAMSHost) ProxyGrpcSend(streamID uint32, messageData *byte, messageSize int, endOfStream bool) types.Status {
+	return 0
+}
+func (d DefaultProxyWAMSHost) ProxyGrpcCancel(calloutID uint32) types.Status             { return 0 }
+func (d DefaultProxyWAMSHost) ProxyGrpcClose(streamID uint32) types.Status               { return 0 }
 func (d DefaultProxyWAMSHost) ProxySetTickPeriodMilliseconds(period uint32) types.Status { return 0 }
 func (d DefaultProxyWAMSHost) ProxySetEffectiveContext(contextID uint32) types.Status    { return 0 }
 func (d DefaultProxyWAMSHost) ProxyDone() types.Status                                   { return 0 }
@@ -131,6 +148,9 @@ func (d DefaultProxyWAMSHost) ProxyRecordMetric(metricID uint32, value uint64) t
 func (d DefaultProxyWAMSHost) ProxyGetMetric(metricID uint32, returnMetricValue *uint64) types.Status {
 	return 0
 }
+func (d DefaultProxyWAMSHost) ProxyCallForeignFunction(funcNameData *byte, funcNameSize int, paramData *byte, paramSize int, returnData **byte, returnSize *int) types.Status {
+	return 0
+}
 
 func ProxyLog(logLevel types.LogLevel, messageData *byte, messageSize int) types.Status {
 	return currentHost.ProxyLog(logLevel, messageData, messageSize)
@@ -219,6 +239,31 @@ func ProxyHttpCall(upstreamData *byte, upstreamSize int, headerData *byte, heade
 		headerData, headerSize, bodyData, bodySize, trailersData, trailersSize, timeout, calloutIDPtr)
 }
 
+func ProxyGrpcCall(upstreamData *byte, upstreamSize int, serviceNameData *byte, serviceNameSize int,
+	methodData *byte, methodSize int, initialMetadataData *byte, initialMetadataSize int,
+	messageData *byte, messageSize int, timeout uint32, calloutIDPtr *uint32) types.Status {
+	return currentHost.ProxyGrpcCall(upstreamData, upstreamSize, serviceNameData, serviceNameSize,
+		methodData, methodSize, initialMetadataData, initialMetadataSize, messageData, messageSize, timeout, calloutIDPtr)
+}
+
+func ProxyGrpcStream(upstreamData *byte, upstreamSize int, serviceNameData *byte, serviceNameSize int,
+	methodData *byte, methodSize int, initialMetadataData *byte, initialMetadataSize int, streamIDPtr *uint32) types.Status {
+	return currentHost.ProxyGrpcStream(upstreamData, upstreamSize, serviceNameData, serviceNameSize,
+		methodData, methodSize, initialMetadataData, initialMetadataSize, streamIDPtr)
+}
+
+func ProxyGrpcSend(streamID uint32, messageData *byte, messageSize int, endOfStream bool) types.Status {
+	return currentHost.ProxyGrpcSend(streamID, messageData, messageSize, endOfStream)
+}
+
+func ProxyGrpcCancel(calloutID uint32) types.Status {
+	return currentHost.ProxyGrpcCancel(calloutID)
+}
+
+func ProxyGrpcClose(streamID uint32) types.Status {
+	return currentHost.ProxyGrpcClose(streamID)
+}
+
 func ProxySetTickPeriodMilliseconds(period uint32) types.Status {
 	return currentHost.ProxySetTickPeriodMilliseconds(period)
 }
@@ -247,3 +292,8 @@ func ProxyRecordMetric(metricID uint32, value uint64) types.Status {
 func ProxyGetMetric(metricID uint32, returnMetricValue *uint64) types.Status {
 	return currentHost.ProxyGetMetric(metricID, returnMetricValue)
 }
+
+func ProxyCallForeignFunction(funcNameData *byte, funcNameSize int, paramData *byte, paramSize int,
+	returnData **byte, returnSize *int) types.Status {
+	return currentHost.ProxyCallForeignFunction(funcNameData, funcNameSize, paramData, paramSize, returnData, returnSize)
+}
@@ -16,6 +16,7 @@ package proxywasm
 
 import (
 	"encoding/binary"
+	"errors"
 	"unsafe"
 )
 
@@ -100,3 +101,49 @@ func SerializePropertyPath(path []string) []byte {
 	ret = ret[:len(ret)-1]
 	return ret
 }
+
+// protobuf wire format of google.protobuf.Any:
+//
+//	type_url: field number 1 with wire type 2 (length-delimited)
+//	value:    field number 2 with wire type 2 (length-delimited)
+const (
+	anyTypeURLTag = 1<<3 | 2
+	anyValueTag   = 2<<3 | 2
+)
+
+func serializeAny(typeURL string, value []byte) []byte {
+	ret := make([]byte, 0, len(typeURL)+len(value)+2*(1+binary.MaxVarintLen64))
+	var buf [binary.MaxVarintLen64]byte
+
+	ret = append(ret, anyTypeURLTag)
+	ret = append(ret, buf[:binary.PutUvarint(buf[:], uint64(len(typeURL)))]...)
+	ret = append(ret, typeURL...)
+	if len(value) != 0 { // default values are omitted in proto3
+		ret = append(ret, anyValueTag)
+		ret = append(ret, buf[:binary.PutUvarint(buf[:], uint64(len(value)))]...)
+		ret = append(ret, value...)
+	}
+	return ret
+}
+
+func deserializeAny(raw []byte) (typeURL string, value []byte, err error) {
+	for len(raw) > 0 {
+		tag := raw[0]
+		size, n := binary.Uvarint(raw[1:])
+		if n <= 0 || uint64(len(raw)-1-n) < size {
+			return "", nil, errors.New("invalid length of google.protobuf.Any field")
+		}
+		data := raw[1+n : 1+n+int(size)]
+		raw = raw[1+n+int(size):]
+
+		switch tag {
+		case anyTypeURLTag:
+			typeURL = string(data)
+		case anyValueTag:
+			value = data
+		default:
+			return "", nil, errors.New("invalid field of google.protobuf.Any")
+		}
+	}
+	return typeURL, value, nil
+}
@@ -90,3 +90,18 @@ func TestSerializePropertyPath(t *testing.T) {
 		})
 	}
 }
+
+func TestSerializeAny(t *testing.T) {
+	raw := serializeAny("type.googleapis.com/google.protobuf.StringValue", []byte{0x0a, 0x03, 'f', 'o', 'o'})
+	exp := append([]byte{0x0a, 47}, "type.googleapis.com/google.protobuf.StringValue"...)
+	exp = append(exp, 0x12, 5, 0x0a, 0x03, 'f', 'o', 'o')
+	assert.Equal(t, exp, raw)
+
+	typeURL, value, err := deserializeAny(raw)
+	assert.NoError(t, err)
+	assert.Equal(t, "type.googleapis.com/google.protobuf.StringValue", typeURL)
+	assert.Equal(t, []byte{0x0a, 0x03, 'f', 'o', 'o'}, value)
+
+	_, _, err = deserializeAny(raw[:len(raw)-1])
+	assert.Error(t, err)
+}
@@ -14,11 +14,19 @@
 
 package types
 
+import "strconv"
+
+// Action is the status returned by the plugin's callbacks.
+// Envoy's other filter statuses such as StopAllIterationAndBuffer are not supported in the ABI version 0.2.0.
 type Action uint32
 
 const (
+	// ActionContinue lets the host continue the iteration of the filter chain.
 	ActionContinue Action = 0
-	ActionPause    Action = 1
+	// ActionPause stops the iteration of the filter chain until it is resumed by
+	// proxywasm.ResumeHttpRequest/ResumeHttpResponse, which corresponds to StopIteration
+	// for headers and StopIterationAndBuffer for bodies in Envoy.
+	ActionPause Action = 1
 )
 
 type PeerType uint32
@@ -110,3 +118,81 @@ const (
 	MetricTypeGauge     = 1
 	MetricTypeHistogram = 2
 )
+
+// TrafficDirection is the direction of the traffic relative to the local proxy,
+// which is given by the "listener_direction" property.
+type TrafficDirection int64
+
+const (
+	// TrafficDirectionUnspecified is returned when the listener doesn't have the direction configured.
+	TrafficDirectionUnspecified TrafficDirection = 0
+	// TrafficDirectionInbound is the traffic from the downstream to the local service.
+	TrafficDirectionInbound TrafficDirection = 1
+	// TrafficDirectionOutbound is the traffic from the local service to the upstream.
+	TrafficDirectionOutbound TrafficDirection = 2
+)
+
+// GrpcStatus is the status code of gRPC.
+// see https://github.com/grpc/grpc/blob/master/doc/statuscodes.md
+type GrpcStatus int32
+
+const (
+	GrpcStatusOK                 GrpcStatus = 0
+	GrpcStatusCancelled          GrpcStatus = 1
+	GrpcStatusUnknown            GrpcStatus = 2
+	GrpcStatusInvalidArgument    GrpcStatus = 3
+	GrpcStatusDeadlineExceeded   GrpcStatus = 4
+	GrpcStatusNotFound           GrpcStatus = 5
+	GrpcStatusAlreadyExists      GrpcStatus = 6
+	GrpcStatusPermissionDenied   GrpcStatus = 7
+	GrpcStatusResourceExhausted  GrpcStatus = 8
+	GrpcStatusFailedPrecondition GrpcStatus = 9
+	GrpcStatusAborted            GrpcStatus = 10
+	GrpcStatusOutOfRange         GrpcStatus = 11
+	GrpcStatusUnimplemented      GrpcStatus = 12
+	GrpcStatusInternal           GrpcStatus = 13
+	GrpcStatusUnavailable        GrpcStatus = 14
+	GrpcStatusDataLoss           GrpcStatus = 15
+	GrpcStatusUnauthenticated    GrpcStatus = 16
+)
+
+func (s GrpcStatus) String() string {
+	switch s {
+	case GrpcStatusOK:
+		return "OK"
+	case GrpcStatusCancelled:
+		return "Cancelled"
+	case GrpcStatusUnknown:
+		return "Unknown"
+	case GrpcStatusInvalidArgument:
+		return "InvalidArgument"
+	case GrpcStatusDeadlineExceeded:
+		return "DeadlineExceeded"
+	case GrpcStatusNotFound:
+		return "NotFound"
+	case GrpcStatusAlreadyExists:
+		return "AlreadyExists"
+	case GrpcStatusPermissionDenied:
+		return "PermissionDenied"
+	case GrpcStatusResourceExhausted:
+		return "ResourceExhausted"
+	case GrpcStatusFailedPrecondition:
+		return "FailedPrecondition"
+	case GrpcStatusAborted:
+		return "Aborted"
+	case GrpcStatusOutOfRange:
+		return "OutOfRange"
+	case GrpcStatusUnimplemented:
+		return "Unimplemented"
+	case GrpcStatusInternal:
+		return "Internal"
+	case GrpcStatusUnavailable:
+		return "Unavailable"
+	case GrpcStatusDataLoss:
+		return "DataLoss"
+	case GrpcStatusUnauthenticated:
+		return "Unauthenticated"
+	default:
+		return "GrpcStatus(" + strconv.Itoa(int(s)) + ")"
+	}
+}
@@ -17,12 +17,15 @@ package proxywasm
 import (
 	"errors"
 	"fmt"
+
+	"github.com/tetratelabs/proxy-wasm-go-sdk/proxywasm/types"
 )
 
 type (
 	rootContextState struct {
 		context       RootContext
 		httpCallbacks map[uint32]*httpCallbackAttribute
+		grpcCallbacks map[uint32]*grpcCallbackAttribute // key: the id of the call or the stream
 	}
 
 	HttpCalloutCallBack = func(numHeaders, bodySize, numTrailers int)
@@ -31,6 +34,22 @@ type (
 		callback        HttpCalloutCallBack
 		callerContextID uint32
 	}
+
+	// GrpcCallCallBack is called with the status of the gRPC call dispatched by DispatchGrpcCall
+	// and the size of the response message, which is zero unless the status is OK.
+	GrpcCallCallBack = func(status types.GrpcStatus, messageSize int)
+	// GrpcStreamMessageCallBack is called with the size of each message received on the gRPC stream.
+	GrpcStreamMessageCallBack = func(messageSize int)
+	// GrpcStreamCloseCallBack is called with the status of the gRPC stream closed by the remote.
+	GrpcStreamCloseCallBack = func(status types.GrpcStatus)
+
+	// grpcCallbackAttribute holds either the callback of a call or the ones of a stream.
+	grpcCallbackAttribute struct {
+		onResponse      GrpcCallCallBack
+		onMessage       GrpcStreamMessageCallBack
+		onClose         GrpcStreamCloseCallBack
+		callerContextID uint32
+	}
 )
 
 type state struct {
@@ -86,6 +105,7 @@ func (s *state) createRootContext(contextID uint32) {
 	s.rootContexts[contextID] = &rootContextState{
 		context:       ctx,
 		httpCallbacks: map[uint32]*httpCallbackAttribute{},
+		grpcCallbacks: map[uint32]*grpcCallbackAttribute{},
 	}
 
 	// NOTE: this is a temporary work around for avoiding nil pointer panic
@@ -128,6 +148,17 @@ func (s *state) registerHttpCallOut(calloutID uint32, callback HttpCalloutCallBa
 	r.httpCallbacks[calloutID] = &httpCallbackAttribute{callback: callback, callerContextID: s.activeContextID}
 }
 
+func (s *state) registerGrpcCallbacks(id uint32, attr *grpcCallbackAttribute) {
+	r := s.rootContexts[s.contextIDToRootID[s.activeContextID]]
+	attr.callerContextID = s.activeContextID
+	r.grpcCallbacks[id] = attr
+}
+
+func (s *state) unregisterGrpcCallbacks(id uint32) {
+	r := s.rootContexts[s.contextIDToRootID[s.activeContextID]]
+	delete(r.grpcCallbacks, id)
+}
+
 //go:inline
 func (s *state) setActiveContextID(contextID uint32) {
 	s.activeContextID = contextID
@@ -29,3 +29,18 @@ func VMStateReset() {
 func VMStateGetActiveContextID() uint32 {
 	return currentState.activeContextID
 }
+
+func VMStateSetActiveContextID(contextID uint32) {
+	currentState.setActiveContextID(contextID)
+}
+
+// VMState is the state of a VM, which is switched by proxytest to emulate multiple plugins at the same time.
+type VMState struct{ s *state }
+
+func VMStateGet() VMState {
+	return VMState{s: currentState}
+}
+
+func VMStateSet(s VMState) {
+	currentState = s.s
+}